@@ -0,0 +1,248 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package audit keeps a tamper-evident record of every encryption and decryption made by the proxy.  The log is an
+// append-only file of JSON lines, each holding a record and the HMAC-SHA256 of the record, which names the MAC of the
+// entry before it.  The key of the MACs is kept apart from the log, so editing or deleting an entry breaks the chain
+// for whoever can write the log but not read the key, see Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Actions recorded
+const (
+	ActionEncrypt = "encrypt"
+	ActionDecrypt = "decrypt"
+)
+
+// MinKeySize is the size, in bytes, of the shortest key accepted for the MACs of the log
+const MinKeySize = 32
+
+// OutcomeOK is the outcome of a successful operation, others are the cause of the failure
+const OutcomeOK = "ok"
+
+// Record is the audit record of one encryption or decryption
+type Record struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Identity   string    `json:"identity,omitempty"`   // of the client, empty when it was not authenticated
+	AuthMethod string    `json:"authMethod,omitempty"` // how the client was authenticated
+	Object     string    `json:"object"`               // gs://<bucket>/<object>
+	Generation string    `json:"generation,omitempty"`
+	KEK        string    `json:"kek,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Bytes      int64     `json:"bytes"` // of plaintext
+
+	// Prev is the MAC of the entry before this one, empty for the first entry of the log
+	Prev string `json:"prev"`
+}
+
+// entry is a line of the log.  The MAC covers the record exactly as written.
+type entry struct {
+	MAC    string          `json:"mac"`
+	Record json.RawMessage `json:"record"`
+}
+
+// TornError is returned by Verify for a log ending within an entry, as a crash while writing it leaves the log.  The
+// entries before it are intact, and Open drops the torn one.
+type TornError struct {
+	Entry  int   // number of the torn entry
+	Offset int64 // where it starts in the log
+}
+
+func (e *TornError) Error() string {
+	return fmt.Sprintf("entry %d is torn: the log ends within it, e.g after a crash while it was written", e.Entry)
+}
+
+// Log appends records to an audit file
+type Log struct {
+	mu      sync.Mutex
+	f       *os.File
+	key     []byte
+	head    string
+	size    int64 // of the entries written in full
+	dropped int64
+}
+
+// ReadKey reads the key of the MACs of a log from the file in path, at least MinKeySize random bytes
+func ReadKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read audit key")
+	}
+	if len(key) < MinKeySize {
+		return nil, errors.Errorf("audit key %s is %d bytes, want at least %d", path, len(key), MinKeySize)
+	}
+	return key, nil
+}
+
+// Open opens the audit log in path for appending with the key of its MACs, creating it when missing.  A log which
+// fails Verify is not appended to, except that a torn entry at its end is dropped, see Dropped.
+func Open(path string, key []byte) (*Log, error) {
+	if len(key) < MinKeySize {
+		return nil, errors.Errorf("audit key is %d bytes, want at least %d", len(key), MinKeySize)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open audit log")
+	}
+	l, err := open(f, key)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "audit log %s", path)
+	}
+	return l, nil
+}
+
+func open(f *os.File, key []byte) (*Log, error) {
+	_, head, err := Verify(f, key)
+	var torn *TornError
+	if err != nil && !errors.As(err, &torn) {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read audit log")
+	}
+	l := &Log{f: f, key: key, head: head, size: fi.Size()}
+	if torn != nil {
+		if err := f.Truncate(torn.Offset); err != nil {
+			return nil, errors.Wrap(err, "cannot drop torn entry")
+		}
+		l.size, l.dropped = torn.Offset, fi.Size()-torn.Offset
+	}
+
+	// an entry written in full but for its line feed is intact
+	if l.size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, l.size-1); err != nil {
+			return nil, errors.Wrap(err, "cannot read audit log")
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				return nil, errors.Wrap(err, "cannot write audit log")
+			}
+			l.size++
+		}
+	}
+	return l, nil
+}
+
+// Dropped returns the size of the torn entry Open dropped from the end of the log, 0 when there was none
+func (l *Log) Dropped() int64 {
+	return l.dropped
+}
+
+// Write chains the record to the log and syncs it to disk.  An entry which cannot be written in full is removed, so
+// the log stays intact.
+func (l *Log) Write(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Prev = l.head
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal audit record")
+	}
+	mac := macOf(l.key, body)
+	line, err := json.Marshal(entry{MAC: mac, Record: body})
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal audit record")
+	}
+	line = append(line, '\n')
+	if _, err := l.f.Write(line); err != nil {
+		l.f.Truncate(l.size)
+		return errors.Wrap(err, "cannot write audit log")
+	}
+	if err := l.f.Sync(); err != nil {
+		l.f.Truncate(l.size)
+		return errors.Wrap(err, "cannot sync audit log")
+	}
+	l.head = mac
+	l.size += int64(len(line))
+	return nil
+}
+
+// Close closes the file of the log
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// Verify checks the MAC chain of the log read from r with key, and returns the number of records and the MAC of the
+// last one.  An edited, inserted or deleted entry fails, except for entries deleted from the end: keep the last MAC
+// elsewhere to detect those.  A last entry missing its line feed counts when intact, and fails with a TornError
+// otherwise.
+func Verify(r io.Reader, key []byte) (int, string, error) {
+	br := bufio.NewReader(r)
+	count, head, offset := 0, "", int64(0)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return count, head, nil
+		}
+		if err != nil && err != io.EOF {
+			return count, head, errors.Wrap(err, "cannot read audit log")
+		}
+		mac, errEntry := checkEntry(bytes.TrimSuffix(line, []byte("\n")), key, head, count+1)
+		if errEntry != nil {
+			if err == io.EOF {
+				return count, head, &TornError{Entry: count + 1, Offset: offset}
+			}
+			return count, head, errEntry
+		}
+		count, head, offset = count+1, mac, offset+int64(len(line))
+	}
+}
+
+// checkEntry checks the MAC of entry n of a log, and that it follows the entry whose MAC is prev.  It returns its MAC.
+func checkEntry(line []byte, key []byte, prev string, n int) (string, error) {
+	var e entry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return "", errors.Wrapf(err, "entry %d is malformed", n)
+	}
+	if !hmac.Equal([]byte(macOf(key, e.Record)), []byte(e.MAC)) {
+		return "", errors.Errorf("entry %d was modified: its MAC does not match", n)
+	}
+	var rec Record
+	if err := json.Unmarshal(e.Record, &rec); err != nil {
+		return "", errors.Wrapf(err, "entry %d is malformed", n)
+	}
+	if rec.Prev != prev {
+		return "", errors.Errorf("entry %d does not follow entry %d: entries were removed or reordered", n, n-1)
+	}
+	return e.MAC, nil
+}
+
+func macOf(key []byte, record []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(record)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,232 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey is the key of the MACs of test logs
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// testLog writes n records to a new log and returns its path
+func testLog(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < n; i++ {
+		rec := Record{Time: time.Unix(int64(i), 0).UTC(), Action: ActionDecrypt, Identity: "CN=alice",
+			Object: "gs://bucket/object", KEK: "local://kek", Outcome: OutcomeOK, Bytes: int64(i)}
+		if err := l.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name      string
+		tamper    func(lines []string) []string
+		wantCount int
+		wantErr   string
+	}{
+		{"intact", func(lines []string) []string { return lines }, 3, ""},
+		{"edited", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "CN=alice", "CN=mallory", 1)
+			return lines
+		}, 1, "was modified"},
+		{"deleted", func(lines []string) []string { return append(lines[:1], lines[2:]...) }, 1, "removed or reordered"},
+		{"reordered", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 1, "removed or reordered"},
+		{"first deleted", func(lines []string) []string { return lines[1:] }, 0, "removed or reordered"},
+		{"malformed", func(lines []string) []string { return append(lines, "{") }, 3, "malformed"},
+		{"edited and chained again without the key", func(lines []string) []string {
+			key := []byte("fedcba9876543210fedcba9876543210")
+			prev := ""
+			for i, line := range lines {
+				var e entry
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					panic(err)
+				}
+				var rec Record
+				if err := json.Unmarshal(e.Record, &rec); err != nil {
+					panic(err)
+				}
+				rec.Identity, rec.Prev = "CN=mallory", prev
+				body, _ := json.Marshal(rec)
+				prev = macOf(key, body)
+				b, _ := json.Marshal(entry{MAC: prev, Record: body})
+				lines[i] = string(b)
+			}
+			return lines
+		}, 0, "was modified"},
+		{"tail deleted", func(lines []string) []string { return lines[:2] }, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := ioutil.ReadFile(testLog(t, 3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+			tampered := strings.Join(tt.tamper(lines), "\n") + "\n"
+
+			count, _, err := Verify(strings.NewReader(tampered), testKey)
+			if count != tt.wantCount {
+				t.Errorf("Verify() count = %d, want %d", count, tt.wantCount)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Verify() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := testLog(t, 2)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, head, err := Verify(bytes.NewReader(content), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a short key, or another key, is refused
+	if _, err := Open(path, testKey[:MinKeySize-1]); err == nil {
+		t.Error("Open() with a short key, want error")
+	}
+	if _, err := Open(path, bytes.ToUpper(testKey)); err == nil {
+		t.Error("Open() with another key, want error")
+	}
+
+	// reopening continues the chain
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(Record{Action: ActionEncrypt, Object: "gs://bucket/new", Outcome: OutcomeOK}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, _, err := Verify(f, testKey)
+	f.Close()
+	if err != nil || count != 3 {
+		t.Fatalf("Verify() = %d, %v after reopening", count, err)
+	}
+	if !strings.Contains(readLine(t, path, 2), `"prev":"`+head+`"`) {
+		t.Errorf("record written after reopening does not follow %s", head)
+	}
+
+	// a broken log is not appended to
+	broken := strings.Replace(string(content), "CN=alice", "CN=mallory", 1)
+	if err := ioutil.WriteFile(path, []byte(broken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, testKey); err == nil {
+		t.Error("Open() of a modified log, want error")
+	}
+}
+
+func TestOpen_torn(t *testing.T) {
+	tests := []struct {
+		name        string
+		tear        func(content string) string
+		wantDropped bool
+	}{
+		{"torn entry", func(content string) string { return content + `{"mac":"0123` }, true},
+		{"line feed missing", func(content string) string { return strings.TrimSuffix(content, "\n") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := testLog(t, 2)
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			torn := tt.tear(string(content))
+			if err := ioutil.WriteFile(path, []byte(torn), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Verify(strings.NewReader(torn), testKey)
+			var tornErr *TornError
+			if tt.wantDropped != errors.As(err, &tornErr) {
+				t.Errorf("Verify() error = %v", err)
+			}
+
+			// the proxy still starts, and continues the chain
+			l, err := Open(path, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped := l.Dropped() > 0; dropped != tt.wantDropped {
+				t.Errorf("Open() dropped %d bytes", l.Dropped())
+			}
+			if err := l.Write(Record{Action: ActionEncrypt, Object: "gs://bucket/new", Outcome: OutcomeOK}); err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if count, _, err := Verify(f, testKey); err != nil || count != 3 {
+				t.Errorf("Verify() = %d, %v after Open, want 3 records", count, err)
+			}
+		})
+	}
+}
+
+func readLine(t *testing.T, path string, i int) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(content), "\n")[i]
+}
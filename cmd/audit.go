@@ -0,0 +1,71 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+
+	"github.com/spf13/cobra"
+)
+
+// auditCmd groups the commands on the audit log of the proxy
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with the audit log of the proxy",
+}
+
+// auditKeyFile is the file holding the key of the MACs of the audit log
+var auditKeyFile string
+
+// auditVerifyCmd represents the audit verify command
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <audit log>",
+	Short: "Check the MAC chain of an audit log",
+	Long: `Checks, with the key of the proxy, that no entry of the audit log was edited, inserted, reordered or
+deleted, and prints the number of records and the MAC of the last one.  Entries deleted from the end of the log leave
+a valid chain: compare the MAC printed with one kept elsewhere to detect those.  A last entry torn by a crash while it
+was written is reported, and dropped by the proxy when it starts.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := audit.ReadKey(auditKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		count, head, err := audit.Verify(f, key)
+		if err != nil {
+			log.Fatalf("%s is not intact after %d records: %v", args[0], count, err)
+		}
+		fmt.Printf("%d records verified, head %s\n", count, head)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditVerifyCmd.Flags().StringVar(&auditKeyFile, "key-file", "", "file holding the key of the MACs (TINKPROXY_PROXY_AUDIT_KEY_FILE of the proxy)")
+	auditVerifyCmd.MarkFlagRequired("key-file")
+}
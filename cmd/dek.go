@@ -0,0 +1,110 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dekPath       string
+	dekDisableOld bool
+	dekDestroyOld bool
+)
+
+// dekCmd groups the commands managing the wrapped DEK keyset
+var dekCmd = &cobra.Command{
+	Use:   "dek",
+	Short: "Manage the wrapped DEK keyset",
+}
+
+// dekRotateCmd represents the dek rotate command
+var dekRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new primary key to the wrapped DEK keyset",
+	Long: `Adds a new primary key to the wrapped DEK keyset, which vanish --share-dek then encrypts new files with.
+Every envelope carries the keyset it was encrypted with, so older files still decrypt.  --disable-old or --destroy-old
+retires the older keys, which keeps them out of the envelopes written from then on.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("dek rotate called")
+
+		config, err := env.Get()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger := config.Logger()
+
+		if dekDisableOld && dekDestroyOld {
+			logger.Fatal("choose one of --disable-old and --destroy-old")
+		}
+		path := dekPath
+		if path == "" {
+			path = config.DekPathName
+		}
+
+		kmsClient, err := kms.NewClient(config.KmsMkekURI)
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		ee := data.NewEncryptionEngine(config.KmsMkekURI, path, kmsClient, logger)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// nothing to rotate yet, start the keyset vanish --share-dek encrypts with
+			if err := ee.NewSharedDek(); err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			logger.Infof("created the DEK keyset %s", path)
+			return
+		}
+		if err := ee.ReadWdek(); err != nil {
+			logger.Fatalf("%+v", errors.Wrapf(err, "cannot load the DEK keyset %s", path))
+		}
+
+		if err := ee.RotateDek(); err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		if dekDisableOld || dekDestroyOld {
+			retired, err := ee.RetireDeks(dekDestroyOld)
+			if err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			logger.Infof("retired %d keys", retired)
+		}
+
+		if err := ee.WriteWdek(); err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		logger.Infof("rotated the DEK keyset %s", path)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dekCmd)
+	dekCmd.AddCommand(dekRotateCmd)
+	dekRotateCmd.Flags().StringVar(&dekPath, "wdek", "", "wrapped DEK keyset to rotate (default is TINKPROXY_DEK_PATH_NAME)")
+	dekRotateCmd.Flags().BoolVar(&dekDisableOld, "disable-old", false, "disable every key but the new primary")
+	dekRotateCmd.Flags().BoolVar(&dekDestroyOld, "destroy-old", false, "destroy the key material of every key but the new primary")
+}
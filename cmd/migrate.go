@@ -0,0 +1,246 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/store"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var migrateCheckpoint string
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate <directory or gs://bucket/prefix>",
+	Short: "Re-encrypt version 1 JSON objects into version 2 envelopes",
+	Long: `Decrypts every object in a version 1 JSON envelope and encrypts it again, with a new DEK under the configured
+KEK and AAD mode, into a version 2 envelope.  The new object is decrypted and compared with the original plaintext
+before it replaces the original.  Other objects are left as they are, and with --checkpoint an interrupted run resumes
+where it stopped.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("migrate called")
+
+		config, err := env.Get()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger := config.Logger()
+
+		ctx := context.Background()
+		st, err := openStore(ctx, config, args[0])
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		checkpoint, err := store.OpenCheckpoint(migrateCheckpoint)
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		defer checkpoint.Close()
+
+		m := &migrator{config: config, logger: logger, engines: newEngines(logger, config.KekAllowList)}
+		failures, err := eachObject(ctx, st, checkpoint, logger, func(name string) error {
+			return m.migrate(ctx, st, name)
+		})
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		if failures > 0 {
+			logger.Errorf("%d objects of %s could not be migrated", failures, st)
+			os.Exit(1)
+		}
+	},
+}
+
+// migrator re-encrypts version 1 objects
+type migrator struct {
+	config  env.Config
+	logger  *logrus.Logger
+	engines *engines
+}
+
+// migrate re-encrypts a version 1 object through a temporary file, which replaces the object once verified
+func (m *migrator) migrate(ctx context.Context, st store.Store, name string) error {
+	logger := m.logger.WithField("object", name)
+
+	src, err := st.Open(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "cannot read object")
+	}
+	defer src.Close()
+
+	br := bufio.NewReader(src)
+	b, _, err := data.ReadEnvelope(br)
+	if data.KindOf(err) == data.KindEnvelope {
+		logger.Info("skipping, not an envelope")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if b.Version != data.EnvelopeV1 {
+		logger.Debug("skipping, already migrated")
+		return nil
+	}
+
+	id := storeObjectID(m.config, st, name)
+	plaintext, err := m.reveal(b, br, id)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "tinkproxy-migrate")
+	if err != nil {
+		return errors.Wrap(err, "cannot create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum, err := m.seal(tmp, plaintext, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := m.verify(tmp, id, sum); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := st.Replace(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, tmp); err != nil {
+		dst.Abort()
+		return errors.Wrap(err, "cannot write migrated object")
+	}
+	if err := dst.Close(); err != nil {
+		return errors.Wrap(err, "cannot replace object")
+	}
+	logger.Info("migrated")
+	return nil
+}
+
+// reveal returns the plaintext of a version 1 object, with its ciphertext either in the envelope or following it
+func (m *migrator) reveal(b data.EncryptedData, ciphertext io.Reader, id data.ObjectID) (io.Reader, error) {
+	ee, err := m.engines.get(b.KekName)
+	if err != nil {
+		return nil, err
+	}
+	if err := bindAAD(ee, b, m.config, id); err != nil {
+		return nil, err
+	}
+
+	if b.IsStream() {
+		if err := ee.LoadStream(b); err != nil {
+			return nil, err
+		}
+		return ee.RevealStream(ciphertext)
+	}
+	if err := ee.Load(b); err != nil {
+		return nil, err
+	}
+	cipher, err := b.Ciphertext()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := ee.Reveal(cipher)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plaintext), nil
+}
+
+// seal encrypts the plaintext into a new envelope written to w, and returns the hash of the plaintext
+func (m *migrator) seal(w io.Writer, plaintext io.Reader, id data.ObjectID) ([]byte, error) {
+	ee, err := m.engines.get(m.config.KmsMkekURI)
+	if err != nil {
+		return nil, err
+	}
+	if err := ee.BindAAD(m.config.AADMode, m.config.AAD, id); err != nil {
+		return nil, err
+	}
+	envelope, err := ee.PackageStream()
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := data.WriteEnvelope(bw, envelope); err != nil {
+		return nil, err
+	}
+	ew, err := ee.ObfuscateStream(bw)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(ew, io.TeeReader(plaintext, h)); err != nil {
+		return nil, errors.Wrap(err, "cannot re-encrypt")
+	}
+	if err := ew.Close(); err != nil {
+		return nil, errors.Wrap(err, "cannot re-encrypt")
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, errors.Wrap(err, "check disk space")
+	}
+	return h.Sum(nil), nil
+}
+
+// verify decrypts the migrated object and compares the hash of its plaintext
+func (m *migrator) verify(r io.Reader, id data.ObjectID, sum []byte) error {
+	br := bufio.NewReader(r)
+	b, _, err := data.ReadEnvelope(br)
+	if err != nil {
+		return errors.Wrap(err, "cannot read migrated object")
+	}
+	plaintext, err := m.reveal(b, br, id)
+	if err != nil {
+		return errors.Wrap(err, "cannot decrypt migrated object")
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, plaintext); err != nil {
+		return errors.Wrap(err, "cannot decrypt migrated object")
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return errors.New("migrated object does not decrypt to the original plaintext")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().StringVar(&migrateCheckpoint, "checkpoint", "", "file recording the objects done, to resume an interrupted run")
+}
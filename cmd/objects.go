@@ -0,0 +1,119 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/store"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/tink/go/core/registry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// openStore opens the local directory or gs://<bucket>/<prefix> holding the objects to process
+func openStore(ctx context.Context, config env.Config, location string) (store.Store, error) {
+	var client *storage.Client
+	if strings.HasPrefix(location, "gs://") {
+		c, err := config.Client.StorageClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	}
+	return store.Open(location, client)
+}
+
+// eachObject calls process for every object of the store missing from the checkpoint, and records the objects it
+// succeeds for.  Failures are logged and counted, so one bad object does not stop the run.
+func eachObject(ctx context.Context, st store.Store, checkpoint *store.Checkpoint, logger *logrus.Logger,
+	process func(name string) error) (int, error) {
+	names, err := st.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	failures := 0
+	for _, name := range names {
+		if checkpoint.Done(name) {
+			logger.WithField("object", name).Debug("already processed")
+			continue
+		}
+		if err := process(name); err != nil {
+			logger.WithField("object", name).WithError(err).Errorf("%+v", err)
+			failures++
+			continue
+		}
+		if err := checkpoint.Mark(name); err != nil {
+			return failures, err
+		}
+	}
+	return failures, nil
+}
+
+// storeObjectID names an object of the store in its bucket, to bind its ciphertext to it.  Objects of a directory are
+// named by their path in it, in the configured bucket.
+func storeObjectID(config env.Config, st store.Store, name string) data.ObjectID {
+	bucket, object := st.ObjectName(name)
+	if bucket == "" {
+		bucket = config.BucketName
+	}
+	return data.ObjectID{Bucket: bucket, Object: object, Tag: config.AADTag}
+}
+
+// bindAAD binds the engine to the associated data of the envelope of the object id.  The scheme of the envelope must
+// be as strong as the configured AAD mode when TINKPROXY_AAD_ENFORCE is set.
+func bindAAD(ee *data.EncryptionEngine, b data.EncryptedData, config env.Config, id data.ObjectID) error {
+	if config.AADEnforce {
+		if err := data.CheckAADScheme(b.AADScheme, config.AADMode); err != nil {
+			return errors.Wrap(err, "unset TINKPROXY_AAD_ENFORCE to decrypt it")
+		}
+	}
+	return ee.BindAAD(b.AADScheme, config.AAD, id)
+}
+
+// engines keeps a KMS client per KEK, since the objects of a bucket mostly share a few.  Only KEKs of the allow-list
+// get one.
+type engines struct {
+	logger    *logrus.Logger
+	allowList kms.AllowList
+	clients   map[string]registry.KMSClient
+}
+
+func newEngines(logger *logrus.Logger, allowList kms.AllowList) *engines {
+	return &engines{logger: logger, allowList: allowList, clients: map[string]registry.KMSClient{}}
+}
+
+// get returns a new engine for the KEK, which must be in the allow-list
+func (e *engines) get(keyURI string) (*data.EncryptionEngine, error) {
+	client, ok := e.clients[keyURI]
+	if !ok {
+		c, err := e.allowList.NewClient(keyURI)
+		if err != nil {
+			return nil, err
+		}
+		client = c
+		e.clients[keyURI] = client
+	}
+	return data.NewEncryptionEngine(keyURI, "", client, e.logger), nil
+}
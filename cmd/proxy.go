@@ -20,8 +20,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"time"
 
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/decryptionproxy"
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
 
@@ -29,12 +29,17 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// s3API serves the S3 REST API instead of the GCS XML API
+var s3API bool
+
 // proxyCmd represents the proxy command
 var proxyCmd = &cobra.Command{
 	Use:   "proxy",
-	Short: "Starts a decrypting proxy server to GCS",
-	Long: `Supports a GET request to retrieve encrypted files using Tink to decrypt it.  
-	Defaults to localhost:8080 unless otherwise specified by environment variables`,
+	Short: "Starts an encrypting and decrypting proxy server to GCS",
+	Long: `Supports a GET request to retrieve encrypted files using Tink to decrypt it, and PUT or POST object
+	requests to encrypt files using Tink before storing them.
+	Defaults to localhost:8080 unless otherwise specified by environment variables.
+	With --s3, serves S3 clients instead, see README.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("proxy called")
 		config, err := env.Get()
@@ -49,28 +54,99 @@ var proxyCmd = &cobra.Command{
 			logger.Fatalf("%+v", errClient)
 		}
 
-		tinkProxyHandler := getHandler(config, hc)
+		var auditLog *audit.Log
+		if config.Proxy.AuditLogFile != "" {
+			if config.Proxy.AuditKeyFile == "" {
+				logger.Fatal("the audit log requires TINKPROXY_PROXY_AUDIT_KEY_FILE")
+			}
+			key, err := audit.ReadKey(config.Proxy.AuditKeyFile)
+			if err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			if auditLog, err = audit.Open(config.Proxy.AuditLogFile, key); err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			if n := auditLog.Dropped(); n > 0 {
+				logger.Warnf("Dropped a torn entry of %d bytes from the end of %s", n, config.Proxy.AuditLogFile)
+			}
+			defer auditLog.Close()
+			logger.Infof("Auditing to %s", config.Proxy.AuditLogFile)
+		}
+
+		tinkProxyHandler := getHandler(config, hc, auditLog)
+
+		tlsConfig, err := config.Proxy.ServerTLSConfig()
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+
+		authentication := []decryptionproxy.Decorator{decryptionproxy.MetricsHandler(), decryptionproxy.ClientCertHandler()}
+		if config.Proxy.JWKSFile != "" {
+			jwtHandler, err := decryptionproxy.JWTHandler(config.Proxy, logger)
+			if err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			authentication = append(authentication, jwtHandler)
+		}
+
+		var authorization []decryptionproxy.Decorator
+		if config.Policy != nil {
+			logger.Infof("Enforcing policy %s", config.PolicyFile)
+			authorization = append(authorization, decryptionproxy.PolicyHandler(config, logger))
+		}
 
-		middlewareHandlers := decryptionproxy.Decorate(tinkProxyHandler, decryptionproxy.LoggerHandler(logger),
-			decryptionproxy.RouteHandler(),
-			decryptionproxy.ConstraintHandler(logger),
-		)
+		decorators := append(authentication, decryptionproxy.LoggerHandler(logger), decryptionproxy.RouteHandler())
+		decorators = append(decorators, authorization...)
+		decorators = append(decorators, decryptionproxy.ConstraintHandler(logger))
+		middlewareHandlers := decryptionproxy.Decorate(tinkProxyHandler, decorators...)
+		if s3API {
+			if len(config.Proxy.S3Credentials) == 0 {
+				logger.Fatal("the S3 API requires TINKPROXY_PROXY_S3_CREDENTIALS")
+			}
+			if config.Proxy.JWKSFile != "" {
+				logger.Fatal("the S3 API authenticates clients with signatures, it cannot take bearer tokens")
+			}
+			decorators = append([]decryptionproxy.Decorator{decryptionproxy.MetricsHandler(), decryptionproxy.ClientCertHandler(),
+				decryptionproxy.LoggerHandler(logger)}, authorization...)
+			middlewareHandlers = decryptionproxy.Decorate(decryptionproxy.NewS3(config, hc, auditLog), decorators...)
+		}
 
 		s := &http.Server{
-			Addr:           config.Proxy.Listen,
-			Handler:        middlewareHandlers,
-			ReadTimeout:    2 * time.Second,           // handle slow clients
-			WriteTimeout:   2 * config.Client.Timeout, // give room for GCS request to complete
-			MaxHeaderBytes: 1 << 20,
+			Addr:      config.Proxy.Listen,
+			Handler:   middlewareHandlers,
+			TLSConfig: tlsConfig,
+			// handle slow clients.  Bodies are bound by their progress instead, as objects may be of any size
+			ReadHeaderTimeout: config.Proxy.Timeout,
+			ConnContext:       decryptionproxy.ConnContext,
+			MaxHeaderBytes:    1 << 20,
 		}
 
+		// metrics are served in the clear, on an address kept off the network of the clients
+		if config.Proxy.AdminListen != "" {
+			admin := http.NewServeMux()
+			admin.Handle("/metrics", decryptionproxy.Metrics)
+			adminServer := &http.Server{
+				Addr:         config.Proxy.AdminListen,
+				Handler:      admin,
+				ReadTimeout:  config.Proxy.Timeout,
+				WriteTimeout: config.Proxy.Timeout,
+			}
+			go func() {
+				logger.Infof("Serving metrics on %s/metrics", config.Proxy.AdminListen)
+				logger.Fatal(adminServer.ListenAndServe())
+			}()
+		}
+
+		if config.Proxy.ClientCAFile != "" {
+			logger.Infof("Requiring client certificates issued by %s", config.Proxy.ClientCAFile)
+		}
 		logger.Infof("Starting proxy %s", config.Proxy.Listen)
 		logger.Fatal(s.ListenAndServeTLS(config.Proxy.CertFilePath, config.Proxy.CertKeyFilePath))
 	},
 }
 
-func getHandler(c env.Config, hc *http.Client) http.HandlerFunc {
-	proxyHandler := decryptionproxy.New(c, hc)
+func getHandler(c env.Config, hc *http.Client, auditLog *audit.Log) http.HandlerFunc {
+	proxyHandler := decryptionproxy.New(c, hc, auditLog)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		proxyHandler.ServeHTTP(w, r)
@@ -79,4 +155,5 @@ func getHandler(c env.Config, hc *http.Client) http.HandlerFunc {
 
 func init() {
 	rootCmd.AddCommand(proxyCmd)
+	proxyCmd.Flags().BoolVar(&s3API, "s3", false, "serve the S3 REST API, signed with AWS signature version 4")
 }
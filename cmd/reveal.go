@@ -17,18 +17,22 @@
 package cmd
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
 
-	"github.com/google/tink/go/core/registry"
-	"github.com/google/tink/go/integration/gcpkms"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -37,7 +41,8 @@ var revealCmd = &cobra.Command{
 	Use:   "reveal",
 	Short: "Make encrypted data appear",
 	Long: `Using a Tink enabled KMS backend, decrypt the data. If the outputFile is provided,
-	the plaintext is saved there.`,
+	the plaintext is saved there, or in the directory it names under the original file name.
+	The mode and modification time recorded by vanish are restored, and the custom metadata printed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("reveal called")
 
@@ -47,38 +52,62 @@ var revealCmd = &cobra.Command{
 		}
 		logger := config.Logger()
 
-		keyURI := config.KmsMkekURI
-		gcpclient, err := gcpkms.NewClient(keyURI)
-		if err != nil {
-			err := errors.Wrap(err, "gcp client creation failed")
-			logger.Fatalf("%+v", err)
-		}
-
-		registry.RegisterKMSClient(gcpclient)
-
-		f, errRead := ioutil.ReadFile(args[0])
+		f, errRead := os.Open(args[0])
 		if errRead != nil {
 			errRead := errors.Wrap(errRead, "check file")
 			logger.Fatalf("%+v", errRead)
 		}
-		var b data.EncryptedData
-		if errUnmarshal := json.Unmarshal(f, &b); errUnmarshal != nil {
+		defer f.Close()
+
+		br := bufio.NewReader(f)
+		b, _, errUnmarshal := data.ReadEnvelope(br)
+		if errUnmarshal != nil {
 			errUnmarshal := errors.Wrap(errUnmarshal, "cannot unmarshal")
 			logger.Fatalf("%+v", errUnmarshal)
 		}
 
-		ee := data.NewEncryptionEngine(b.KekName, b.WdekName, gcpclient, logger)
-		ee.Load(b)
+		kmsClient, err := config.KekAllowList.NewClient(b.KekName)
+		if errors.Is(err, kms.ErrKekNotAllowed) {
+			logger.Fatalf("refusing to decrypt %s: %v", args[0], err)
+		}
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+
+		ee := data.NewEncryptionEngine(b.KekName, "", kmsClient, logger)
+		if err := bindAAD(ee, b, config, objectID(config, objectNameOf(args[0]))); err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		if b.IsStream() {
+			if err := ee.LoadStream(b); err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			// the file attributes, which name the file saved, are encrypted with the metadata
+			meta, err := ee.OpenMetadata(&b)
+			if err != nil {
+				logger.Fatalf("%+v", err)
+			}
+			printMetadata(meta)
+			out := revealedFile(b, args[0])
+			revealStream(ee, br, out, logger)
+			restoreAttributes(out, b.FileAttributes, logger)
+			return
+		}
+		if err := ee.Load(b); err != nil {
+			logger.Fatalf("%+v", err)
+		}
 
-		cipher, errDecode := base64.StdEncoding.DecodeString(b.EncryptedData)
+		cipher, errDecode := b.Ciphertext()
 		if errDecode != nil {
-			errDecode := errors.Wrap(errDecode, "unexpected wdek format. Use Tink")
 			logger.Fatalf("%+v", errDecode)
 		}
-		ciphertext := ee.Reveal(cipher)
+		ciphertext, errReveal := ee.Reveal(cipher)
+		if errReveal != nil {
+			logger.Fatalf("%+v", errReveal)
+		}
 
-		if outputFile != "" {
-			if err := ioutil.WriteFile(outputFile, ciphertext, 0644); err != nil {
+		if out := revealedFile(b, args[0]); out != "" {
+			if err := ioutil.WriteFile(out, ciphertext, 0644); err != nil {
 				err := errors.Wrap(err, "check file or disk space")
 				logger.Fatalf("%+v", err)
 			}
@@ -86,6 +115,73 @@ var revealCmd = &cobra.Command{
 	},
 }
 
+// revealedFile returns where the plaintext of the envelope read from src is saved: outputFile, or when it is a
+// directory, the file of the original name in it.  Nothing is saved when it is empty.
+func revealedFile(b data.EncryptedData, src string) string {
+	if fi, err := os.Stat(outputFile); outputFile == "" || err != nil || !fi.IsDir() {
+		return outputFile
+	}
+	name := b.BaseName()
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(src), ".enc")
+	}
+	return filepath.Join(outputFile, name)
+}
+
+// restoreAttributes sets the mode and modification time recorded in the envelope on the plaintext file.  Failures
+// are only logged, the plaintext has been saved.
+func restoreAttributes(path string, a data.FileAttributes, logger *logrus.Logger) {
+	if path == "" {
+		return
+	}
+	if mode := a.FileMode(); mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			logger.WithError(err).Warnf("cannot restore the mode of %s", path)
+		}
+	}
+	if mtime, ok := a.Time(); ok {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			logger.WithError(err).Warnf("cannot restore the modification time of %s", path)
+		}
+	}
+}
+
+// printMetadata prints the custom metadata of the envelope, as the proxy answers it
+func printMetadata(meta map[string]string) {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("x-goog-meta-%s: %s\n", k, meta[k])
+	}
+}
+
+// revealStream decrypts the ciphertext following a streaming envelope, loaded in ee, into out a segment at a time
+func revealStream(ee *data.EncryptionEngine, ciphertext io.Reader, out string, logger *logrus.Logger) {
+	plaintext, err := ee.RevealStream(ciphertext)
+	if err != nil {
+		logger.Fatalf("%+v", err)
+	}
+
+	var w io.Writer = ioutil.Discard
+	if out != "" {
+		f, errCreate := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if errCreate != nil {
+			errCreate := errors.Wrap(errCreate, "check file or disk space")
+			logger.Fatalf("%+v", errCreate)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if _, err := io.Copy(w, plaintext); err != nil {
+		err := errors.Wrap(err, "cannot decrypt data")
+		logger.Fatalf("%+v", err)
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(revealCmd)
 }
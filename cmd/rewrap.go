@@ -0,0 +1,172 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/store"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rewrapTo         string
+	rewrapFrom       string
+	rewrapDryRun     bool
+	rewrapCheckpoint string
+)
+
+// rewrapCmd represents the rewrap command
+var rewrapCmd = &cobra.Command{
+	Use:   "rewrap <directory or gs://bucket/prefix>",
+	Short: "Wrap the DEK of every object with a new KEK",
+	Long: `Unwraps the DEK of every object with the KEK it names and wraps it again with the --to KEK.  Only the
+envelope is rewritten, the ciphertext is copied untouched.  Objects already wrapped with the --to KEK are skipped, and
+with --checkpoint an interrupted run resumes where it stopped.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("rewrap called")
+
+		config, err := env.Get()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger := config.Logger()
+
+		// objects are only readable through the proxy with a KEK from the allow-list
+		if err := config.KekAllowList.Check(rewrapTo); err != nil {
+			logger.Fatalf("add the new KEK to the allow-list first: %v", err)
+		}
+
+		ctx := context.Background()
+		st, err := openStore(ctx, config, args[0])
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		checkpointPath := rewrapCheckpoint
+		if rewrapDryRun {
+			checkpointPath = ""
+		}
+		checkpoint, err := store.OpenCheckpoint(checkpointPath)
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		defer checkpoint.Close()
+
+		r := &rewrapper{config: config, logger: logger, engines: newEngines(logger, config.KekAllowList)}
+		to, err := r.engines.get(rewrapTo)
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+
+		failures, err := eachObject(ctx, st, checkpoint, logger, func(name string) error {
+			return r.rewrap(ctx, st, name, to)
+		})
+		if err != nil {
+			logger.Fatalf("%+v", err)
+		}
+		if failures > 0 {
+			logger.Errorf("%d objects of %s could not be rewrapped", failures, st)
+			os.Exit(1)
+		}
+	},
+}
+
+// rewrapper rewraps the DEKs of objects
+type rewrapper struct {
+	config  env.Config
+	logger  *logrus.Logger
+	engines *engines
+}
+
+// rewrap replaces the envelope of the object with one wrapping its DEK with to
+func (r *rewrapper) rewrap(ctx context.Context, st store.Store, name string, to *data.EncryptionEngine) error {
+	logger := r.logger.WithField("object", name)
+
+	src, err := st.Open(ctx, name)
+	if err != nil {
+		return errors.Wrap(err, "cannot read object")
+	}
+	defer src.Close()
+
+	br := bufio.NewReader(src)
+	b, _, err := data.ReadEnvelope(br)
+	if data.KindOf(err) == data.KindEnvelope {
+		logger.Info("skipping, not an envelope")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if b.KekName == rewrapTo {
+		logger.Debug("skipping, already wrapped with the new KEK")
+		return nil
+	}
+	if rewrapFrom != "" && b.KekName != rewrapFrom {
+		logger.WithField("kek", b.KekName).Info("skipping, wrapped with another KEK")
+		return nil
+	}
+	from, err := r.engines.get(b.KekName)
+	if err != nil {
+		return err
+	}
+	envelope, err := from.Rewrap(b, to)
+	if err != nil {
+		return err
+	}
+	if rewrapDryRun {
+		logger.WithField("kek", b.KekName).Info("would rewrap")
+		return nil
+	}
+
+	dst, err := st.Replace(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := data.WriteEnvelope(dst, envelope); err != nil {
+		dst.Abort()
+		return err
+	}
+	if _, err := io.Copy(dst, br); err != nil {
+		dst.Abort()
+		return errors.Wrap(err, "cannot copy ciphertext")
+	}
+	if err := dst.Close(); err != nil {
+		return errors.Wrap(err, "cannot replace object")
+	}
+	logger.WithField("kek", b.KekName).Info("rewrapped")
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(rewrapCmd)
+	rewrapCmd.Flags().StringVar(&rewrapTo, "to", "", "URI of the KEK to wrap DEKs with")
+	rewrapCmd.Flags().StringVar(&rewrapFrom, "from", "", "only rewrap objects wrapped with this KEK (default is any KEK in the allow-list)")
+	rewrapCmd.Flags().BoolVar(&rewrapDryRun, "dry-run", false, "unwrap and rewrap without replacing any object")
+	rewrapCmd.Flags().StringVar(&rewrapCheckpoint, "checkpoint", "", "file recording the objects done, to resume an interrupted run")
+	rewrapCmd.MarkFlagRequired("to")
+}
@@ -19,6 +19,10 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
 
 	"github.com/spf13/cobra"
 
@@ -29,6 +33,7 @@ import (
 var (
 	cfgFile    string
 	outputFile string
+	objectName string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -52,10 +57,24 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.mage.yaml)")
 	rootCmd.PersistentFlags().StringVarP(&outputFile, "outputFile", "o", "", "specify where to store the ciphertext")
+	rootCmd.PersistentFlags().StringVar(&objectName, "object", "", "name of the object in the bucket, which the object AAD modes bind to (default is the name of the encrypted file)")
 
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// objectID names the object an encrypted file is stored as in the bucket, to bind its ciphertext to it
+func objectID(config env.Config, object string) data.ObjectID {
+	return data.ObjectID{Bucket: config.BucketName, Object: object, Tag: config.AADTag}
+}
+
+// objectNameOf returns the --object flag, or the name of the encrypted file when it is not given
+func objectNameOf(encryptedFile string) string {
+	if objectName != "" {
+		return objectName
+	}
+	return filepath.Base(encryptedFile)
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -17,8 +17,9 @@
 package cmd
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -26,20 +27,27 @@ import (
 
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
 
-	"github.com/google/tink/go/core/registry"
-	"github.com/google/tink/go/integration/gcpkms"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// shareDek encrypts the files with the dek keyset of TINKPROXY_DEK_PATH_NAME, instead of a dek per file
+var shareDek bool
+
+// objectMeta is the custom metadata encrypted into the envelope of every file, as the proxy does with x-goog-meta-*
+var objectMeta map[string]string
+
 // vanishCmd represents the vanish command
 var vanishCmd = &cobra.Command{
 	Use:   "vanish",
 	Short: "make data vanish by encrypting the entire file or directory",
 	Long: `Using a Tink enabled KMS backend, encrypt the data. If the outputFile is provided,
-the ciphertext saved there.  outputFile is ignored, if  a directory is being encrypted.`,
+the ciphertext saved there.  outputFile is ignored, if  a directory is being encrypted.
+Each file is encrypted with its own DEK, unless --share-dek encrypts them with the DEK keyset of TINKPROXY_DEK_PATH_NAME.
+Custom metadata given with --meta is encrypted into the envelope.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("vanish called")
@@ -51,16 +59,14 @@ the ciphertext saved there.  outputFile is ignored, if  a directory is being enc
 		logger := config.Logger()
 
 		keyURI := config.KmsMkekURI
-		gcpclient, err := gcpkms.NewClient(keyURI)
+		kmsClient, err := kms.NewClient(keyURI)
 		if err != nil {
-			err := errors.Wrap(err, "gcp client creation failed")
 			logger.Fatalf("%+v", err)
 		}
 
 		wDekPathName := config.DekPathName
-		registry.RegisterKMSClient(gcpclient)
-
-		ee := data.NewEncryptionEngine(keyURI, wDekPathName, gcpclient, logger)
+		ee := data.NewEncryptionEngine(keyURI, wDekPathName, kmsClient, logger)
+		ee.ShareDek(shareDek)
 
 		// support both a file or directory
 		sourceItem := args[0]
@@ -71,9 +77,9 @@ the ciphertext saved there.  outputFile is ignored, if  a directory is being enc
 		}
 		switch mode := fi.Mode(); {
 		case mode.IsRegular():
-			handleFile(sourceItem, ee, logger)
+			handleFile(sourceItem, ee, config, logger)
 		case mode.IsDir():
-			handleDir(sourceItem, ee, logger)
+			handleDir(sourceItem, ee, config, logger)
 		case mode&os.ModeSymlink != 0:
 			logger.Fatalf("%+v", errors.New("cannot handle symLink"))
 		case mode&os.ModeNamedPipe != 0:
@@ -82,20 +88,17 @@ the ciphertext saved there.  outputFile is ignored, if  a directory is being enc
 	},
 }
 
-func handleDir(dir string, ee *data.EncryptionEngine, logger *logrus.Logger) {
+func handleDir(dir string, ee *data.EncryptionEngine, config env.Config, logger *logrus.Logger) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		err := errors.Wrap(err, "cannot read directory")
 		logger.Fatalf("%+v", err)
 	}
 
-	if outputFile != "" {
-		logger.Info("Ignoring output file name. Processing a directory.")
+	if outputFile != "" || objectName != "" {
+		logger.Info("Ignoring output file and object name. Processing a directory.")
 	}
 
-	// Create a wDEK
-	ee.WriteWdek()
-
 	for _, file := range files {
 		// Skip encrypted files
 		if strings.Contains(file.Name(), "enc") {
@@ -103,49 +106,85 @@ func handleDir(dir string, ee *data.EncryptionEngine, logger *logrus.Logger) {
 		}
 
 		fmt.Println(file.Name())
-		f, err := ioutil.ReadFile(dir + "/" + file.Name())
-		if err != nil {
-			err := errors.Wrap(err, "cannot read file")
-			logger.Fatalf("%+v", err)
-		}
+		sealFile(dir+"/"+file.Name(), dir+"/"+file.Name()+".enc", objectID(config, file.Name()+".enc"), ee, config, logger)
+	}
+}
 
-		ciphertext := ee.Obfuscate(f)
-		encryptedBlob := ee.Package(ciphertext)
-		b, errMarshal := json.Marshal(encryptedBlob)
-		if errMarshal != nil {
-			errMarshal := errors.Wrap(errMarshal, "marshal encrypted data to package for writing")
-			logger.Fatalf("%+v", errMarshal)
-		}
+func handleFile(file string, ee *data.EncryptionEngine, config env.Config, logger *logrus.Logger) {
+	encryptedFile := outputFile
+	if encryptedFile == "" {
+		encryptedFile = file + ".enc"
+	}
+	sealFile(file, outputFile, objectID(config, objectNameOf(encryptedFile)), ee, config, logger)
+}
+
+// sealFile streams the plaintext from src into an envelope written to dst, so memory use does not grow with the
+// file size.  Nothing is saved when dst is empty.  The ciphertext is bound to the object id when the AAD mode asks.
+// The envelope records the name, content type, mode and modification time of src, so reveal can restore them.
+func sealFile(src string, dst string, id data.ObjectID, ee *data.EncryptionEngine, config env.Config, logger *logrus.Logger) {
+	in, err := os.Open(src)
+	if err != nil {
+		err := errors.Wrap(err, "cannot read file")
+		logger.Fatalf("%+v", err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		err := errors.Wrap(err, "cannot read file")
+		logger.Fatalf("%+v", err)
+	}
 
-		if errWrite := ioutil.WriteFile(dir+"/"+file.Name()+".enc", b, 0644); err != nil {
-			errWrite := errors.Wrap(errWrite, "cannot write wdek")
-			logger.Fatalf("%+v", errWrite)
+	var out io.Writer = ioutil.Discard
+	if dst != "" {
+		f, errCreate := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if errCreate != nil {
+			errCreate := errors.Wrap(errCreate, "check specified output")
+			logger.Fatalf("%+v", errCreate)
 		}
+		defer f.Close()
+		out = f
 	}
-}
+	bw := bufio.NewWriter(out)
 
-func handleFile(file string, ee *data.EncryptionEngine, logger *logrus.Logger) {
-	f, err := ioutil.ReadFile(file)
+	if err := ee.BindAAD(config.AADMode, config.AAD, id); err != nil {
+		logger.Fatalf("%+v", err)
+	}
+	envelope, err := ee.PackageStream()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%+v", err)
+	}
+	envelope.FileAttributes = data.AttributesOf(src, fi)
+	meta := map[string]string{}
+	for k, v := range objectMeta {
+		meta[strings.ToLower(k)] = v
+	}
+	if err := ee.SealMetadata(&envelope, meta); err != nil {
+		logger.Fatalf("%+v", err)
+	}
+	if _, err := data.WriteEnvelope(bw, envelope); err != nil {
+		logger.Fatalf("%+v", err)
 	}
-	ee.WriteWdek()
-	ciphertext := ee.Obfuscate(f)
 
-	encryptedBlob := ee.Package(ciphertext)
-	b, errMarshal := json.Marshal(encryptedBlob)
-	if errMarshal != nil {
-		errMarshal := errors.Wrap(errMarshal, "marshal encrypted data to package for writing")
-		logger.Fatalf("%+v", errMarshal)
+	w, err := ee.ObfuscateStream(bw)
+	if err != nil {
+		logger.Fatalf("%+v", err)
 	}
-	if outputFile != "" {
-		if err := ioutil.WriteFile(outputFile, b, 0644); err != nil {
-			err := errors.Wrap(err, "check specified output")
-			logger.Fatalf("%+v", err)
-		}
+	if _, err := io.Copy(w, in); err != nil {
+		err := errors.Wrapf(err, "cannot encrypt %s", src)
+		logger.Fatalf("%+v", err)
+	}
+	if err := w.Close(); err != nil {
+		err := errors.Wrapf(err, "cannot encrypt %s", src)
+		logger.Fatalf("%+v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		err := errors.Wrap(err, "check file or disk space")
+		logger.Fatalf("%+v", err)
 	}
 }
 
 func init() {
 	rootCmd.AddCommand(vanishCmd)
+	vanishCmd.Flags().BoolVar(&shareDek, "share-dek", false, "encrypt the files with the primary of the DEK keyset at TINKPROXY_DEK_PATH_NAME")
+	vanishCmd.Flags().StringToStringVar(&objectMeta, "meta", nil, "custom metadata to encrypt into the envelope, as key=value")
 }
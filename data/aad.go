@@ -0,0 +1,94 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"github.com/pkg/errors"
+)
+
+// AAD schemes recorded in the envelope.  Envelopes without one were encrypted with no associated data.
+const (
+	// AADSchemeStatic authenticates the same configured value with every object
+	AADSchemeStatic = "static"
+	// AADSchemeObject binds the ciphertext to the bucket and object name, so it cannot be moved to another object
+	AADSchemeObject = "object"
+	// AADSchemeObjectTag binds the ciphertext to the bucket, object name and a configured version tag
+	AADSchemeObjectTag = "object-tag"
+)
+
+// aadStrength orders the schemes by what they bind a ciphertext to
+var aadStrength = map[string]int{"": 0, AADSchemeStatic: 1, AADSchemeObject: 2, AADSchemeObjectTag: 3}
+
+// ErrWeakAAD is returned for an envelope whose AAD scheme binds its ciphertext less than required, e.g a static
+// envelope which could have been copied from another object
+var ErrWeakAAD = errors.New("envelope aad scheme is weaker than required")
+
+// CheckAADScheme fails unless the scheme of an envelope binds its ciphertext at least as strongly as min.  Decrypting
+// with whatever scheme an envelope claims would let anyone able to write to the bucket downgrade the binding.
+func CheckAADScheme(scheme string, min string) error {
+	got, ok := aadStrength[scheme]
+	if !ok {
+		return &Error{Kind: KindEnvelope, Err: errors.Errorf("unknown aad scheme %q", scheme)}
+	}
+	if got < aadStrength[min] {
+		return &Error{Kind: KindIntegrity, Err: errors.Wrapf(ErrWeakAAD, "%q, want %q", scheme, min)}
+	}
+	return nil
+}
+
+// ObjectID names the object a ciphertext is bound to
+type ObjectID struct {
+	Bucket string
+	Object string
+	Tag    string
+}
+
+// AAD computes the associated data of scheme.  GCS object names cannot contain line feeds, so they separate the tag.
+func AAD(scheme string, static string, id ObjectID) ([]byte, error) {
+	switch scheme {
+	case "":
+		return nil, nil
+	case AADSchemeStatic:
+		return []byte(static), nil
+	case AADSchemeObject, AADSchemeObjectTag:
+		if id.Bucket == "" || id.Object == "" {
+			return nil, errors.Errorf("aad scheme %s needs a bucket and object name", scheme)
+		}
+		aad := "gs://" + id.Bucket + "/" + id.Object
+		if scheme == AADSchemeObjectTag {
+			if id.Tag == "" {
+				return nil, errors.Errorf("aad scheme %s needs a tag", scheme)
+			}
+			aad += "\n" + id.Tag
+		}
+		return []byte(aad), nil
+	default:
+		return nil, &Error{Kind: KindEnvelope, Err: errors.Errorf("unknown aad scheme %q", scheme)}
+	}
+}
+
+// BindAAD sets the associated data authenticated with everything this engine encrypts or decrypts, and the scheme
+// recorded in the envelopes it packages
+func (ee *EncryptionEngine) BindAAD(scheme string, static string, id ObjectID) error {
+	aad, err := AAD(scheme, static, id)
+	if err != nil {
+		return err
+	}
+	ee.aad = string(aad)
+	ee.aadScheme = scheme
+	return nil
+}
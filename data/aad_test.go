@@ -0,0 +1,128 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+)
+
+func TestAAD(t *testing.T) {
+	id := ObjectID{Bucket: "bucket", Object: "dir/file.enc", Tag: "v2"}
+	tests := []struct {
+		name    string
+		scheme  string
+		id      ObjectID
+		want    string
+		wantErr bool
+	}{
+		{"legacy", "", id, "", false},
+		{"static", AADSchemeStatic, id, "this aad", false},
+		{"object", AADSchemeObject, id, "gs://bucket/dir/file.enc", false},
+		{"object and tag", AADSchemeObjectTag, id, "gs://bucket/dir/file.enc\nv2", false},
+		{"object without name", AADSchemeObject, ObjectID{Bucket: "bucket"}, "", true},
+		{"object without tag", AADSchemeObjectTag, ObjectID{Bucket: "bucket", Object: "file"}, "", true},
+		{"unknown", "other", id, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AAD(tt.scheme, "this aad", tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AAD() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AAD() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAADScheme(t *testing.T) {
+	tests := []struct {
+		name    string
+		scheme  string
+		min     string
+		wantErr bool
+	}{
+		{"same", AADSchemeObject, AADSchemeObject, false},
+		{"stronger", AADSchemeObjectTag, AADSchemeObject, false},
+		{"static in object mode", AADSchemeStatic, AADSchemeObject, true},
+		{"legacy in static mode", "", AADSchemeStatic, true},
+		{"object in tag mode", AADSchemeObject, AADSchemeObjectTag, true},
+		{"unknown", "other", AADSchemeStatic, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAADScheme(tt.scheme, tt.min)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckAADScheme() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptionEngine_BindAAD(t *testing.T) {
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := &EncryptionEngine{streamHandle: kh, logger: testLogger()}
+	if err := seal.BindAAD(AADSchemeObject, "", ObjectID{Bucket: "bucket", Object: "a.enc"}); err != nil {
+		t.Fatal(err)
+	}
+	var ciphertext bytes.Buffer
+	w, err := seal.ObfuscateStream(&ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("bound to a.enc"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		object  string
+		wantErr bool
+	}{
+		{"same object", "a.enc", false},
+		{"moved to another object", "b.enc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open := &EncryptionEngine{streamHandle: kh, logger: testLogger()}
+			if err := open.BindAAD(AADSchemeObject, "", ObjectID{Bucket: "bucket", Object: tt.object}); err != nil {
+				t.Fatal(err)
+			}
+			r, err := open.RevealStream(bytes.NewReader(ciphertext.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ioutil.ReadAll(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncryptionEngine.RevealStream() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && KindOf(err) != KindIntegrity {
+				t.Errorf("EncryptionEngine.RevealStream() error = %v, want kind %v", err, KindIntegrity)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileAttributes describe the file the plaintext was read from, so it can be restored as it was.  They are encrypted
+// with the custom metadata of the object, see SealMetadata, and are all optional.
+type FileAttributes struct {
+	ContentType string `json:"contentType,omitempty"` // media type of the plaintext
+	FileName    string `json:"fileName,omitempty"`    // base name of the file
+	Mode        uint32 `json:"mode,omitempty"`        // permission bits
+	ModTime     string `json:"mtime,omitempty"`       // modification time, in RFC 3339
+	Disposition string `json:"disposition,omitempty"` // how the file is presented, attachment or inline
+}
+
+// AttributesOf returns the attributes of the file at path, with its content type guessed from the extension
+func AttributesOf(path string, fi os.FileInfo) FileAttributes {
+	return FileAttributes{
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		FileName:    filepath.Base(path),
+		Mode:        uint32(fi.Mode().Perm()),
+		ModTime:     fi.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// BaseName returns the file name when it is safe to create in a directory, empty otherwise
+func (a FileAttributes) BaseName() string {
+	name := a.FileName
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return ""
+	}
+	return name
+}
+
+// FileMode returns the permission bits recorded, or 0 when they were not
+func (a FileAttributes) FileMode() os.FileMode {
+	return os.FileMode(a.Mode) & os.ModePerm
+}
+
+// Time returns the modification time recorded, if any
+func (a FileAttributes) Time() (time.Time, bool) {
+	if a.ModTime == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, a.ModTime)
+	return t, err == nil
+}
@@ -0,0 +1,74 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAttributesOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attributes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.html")
+	if err := ioutil.WriteFile(path, []byte("<html></html>"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 6, 1, 12, 30, 0, 500, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := AttributesOf(path, fi)
+	if a.FileName != "report.html" || a.FileMode() != 0640 || a.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("AttributesOf() = %+v", a)
+	}
+	if got, ok := a.Time(); !ok || !got.Equal(mtime) {
+		t.Errorf("Time() = %v, %v, want %v", got, ok, mtime)
+	}
+}
+
+func TestFileAttributes_BaseName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		want     string
+	}{
+		{"notes.txt", "notes.txt"},
+		{"", ""},
+		{"..", ""},
+		{"../notes.txt", ""},
+		{"/etc/passwd", ""},
+		{`dir\notes.txt`, ""},
+		{"ünïcode.txt", "ünïcode.txt"},
+	}
+	for _, tt := range tests {
+		if got := (FileAttributes{FileName: tt.fileName}).BaseName(); got != tt.want {
+			t.Errorf("BaseName(%q) = %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
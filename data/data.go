@@ -34,162 +34,206 @@ type EncryptionEngine struct {
 	kekName      string
 	wDekPathName string // path name to file containing wdek
 	aad          string
+	aadScheme    string
 	dekHandle    *keyset.Handle // dek in memory (in clear)
-	gcpClient    registry.KMSClient
+	streamHandle *keyset.Handle // streaming dek in memory (in clear)
+	shareDek     bool           // encrypt every object packaged by this engine with the keyset of the wdek file
+	sharedHandle *keyset.Handle // streaming dek keyset read from the wdek file, when shared
+	sharedWdek   string         // wrapped streaming dek keyset, when shared
+	kmsClient    registry.KMSClient
 	logger       *logrus.Logger
 }
 
 // Encryptor defines methods to support data encryption
 type Encryptor interface {
-	Obfuscate(data io.Reader)
-	Reveal() io.Writer
+	Obfuscate(data []byte) ([]byte, error)
+	Reveal(data []byte) ([]byte, error)
 
-	ReadWdek()
-	WriteWdek()
+	ReadWdek() error
+	WriteWdek() error
 
-	Package(data []byte) EncryptedData
-	Load(data EncryptedData)
+	Package(data []byte) (EncryptedData, error)
+	Load(data EncryptedData) error
 }
 
 //NewEncryptionEngine creates engines with required parameters
-func NewEncryptionEngine(kekName string, wDekPathName string, gcpClient registry.KMSClient, logger *logrus.Logger) *EncryptionEngine {
+func NewEncryptionEngine(kekName string, wDekPathName string, kmsClient registry.KMSClient, logger *logrus.Logger) *EncryptionEngine {
 	return &EncryptionEngine{
 		kekName:      kekName,
 		wDekPathName: wDekPathName,
-		gcpClient:    gcpClient,
+		kmsClient:    kmsClient,
 		logger:       logger,
 	}
 }
 
+// ShareDek makes PackageStream encrypt every object with the primary of the streaming dek keyset kept at the wdek path
+// name, instead of generating a dek per object.  Fewer KMS calls are made, but a compromised dek exposes all the
+// objects sharing it.  RotateDek replaces the primary used for the objects packaged after it.
+func (ee *EncryptionEngine) ShareDek(share bool) {
+	ee.shareDek = share
+}
+
 // ReadWdek loads the wdek using KMS
-func (ee *EncryptionEngine) ReadWdek() {
+func (ee *EncryptionEngine) ReadWdek() error {
 	fo, err := os.Open(ee.wDekPathName)
 	if err != nil {
-		err := errors.Wrapf(err, "cannot read wdek to unmarshal it %s", ee.wDekPathName)
-		ee.logger.Fatalf("%+v", err)
+		return errors.Wrapf(err, "cannot read wdek to unmarshal it %s", ee.wDekPathName)
 	}
 	defer fo.Close()
 
-	backend, errClient := ee.gcpClient.GetAEAD(ee.kekName)
-	if errClient != nil {
-		errClient := errors.Wrap(errClient, "cannot retrieve dek from KMS")
-		ee.logger.Fatalf("%+v", errClient)
-	}
-
-	jreader := keyset.NewJSONReader(fo)
-	masterKey := aead.NewKMSEnvelopeAEAD(*aead.AES256GCMKeyTemplate(), backend)
-
-	// Read the encrypted keyset handle back from the io.Reader implementation
-	// and decrypt it using the master key.
-	ee.dekHandle, err = keyset.Read(jreader, masterKey)
+	kh, err := ee.readKeyset(fo)
 	if err != nil {
-		err := errors.Wrap(err, "cannot created wdek handle")
-		ee.logger.Fatalf("%+v", err)
+		return err
 	}
+	ee.dekHandle = kh
+	return nil
 }
 
 // WriteWdek outputs JSON file with wDEK (encrypted)
-func (ee *EncryptionEngine) WriteWdek() {
+func (ee *EncryptionEngine) WriteWdek() error {
 	if ee.dekHandle == nil {
 		ee.logger.Info("creating a new DEK, since none found")
 		dek := aead.AES256GCMKeyTemplate()
 		kh, err := keyset.NewHandle(dek)
 		if err != nil {
-			err := errors.Wrap(err, "creating dek key handle failed")
-			ee.logger.Fatalf("%+v", err)
+			return errors.Wrap(err, "creating dek key handle failed")
 		}
 		ee.dekHandle = kh
 	}
 
 	f, errCreate := os.Create(ee.wDekPathName)
 	if errCreate != nil {
-		errCreate := errors.Wrapf(errCreate, "writing wdek failed %s", ee.wDekPathName)
-		ee.logger.Fatalf("%+v", errCreate)
+		return errors.Wrapf(errCreate, "writing wdek failed %s", ee.wDekPathName)
 	}
 	defer f.Close()
 
-	jwriter := keyset.NewJSONWriter(f)
-
-	backend, errClient := ee.gcpClient.GetAEAD(ee.kekName)
-	if errClient != nil {
-		errClient := errors.Wrap(errClient, "cannot retrieve dek")
-		ee.logger.Fatalf("%+v", errClient)
-	}
-
-	wdek := aead.NewKMSEnvelopeAEAD(*aead.AES256GCMKeyTemplate(), backend)
-
-	// Write encrypts the keyset handle with the master key and writes to the
-	// io.Writer implementation (memKeyset).
-	if err := ee.dekHandle.Write(jwriter, wdek); err != nil {
-		err := errors.Wrap(err, "cannot write JSON marshalled wdek")
-		ee.logger.Fatalf("%+v", err)
-	}
+	return ee.writeKeyset(f, ee.dekHandle)
 }
 
 // Obfuscate encrypts data using the underlying encryption engine
-func (ee *EncryptionEngine) Obfuscate(dataPlain []byte) []byte {
+func (ee *EncryptionEngine) Obfuscate(dataPlain []byte) ([]byte, error) {
 	ee.logger.Infof("...encrypting using this master KEK %s\n", ee.kekName)
 
 	if ee.dekHandle == nil {
-		ee.ReadWdek()
+		if err := ee.ReadWdek(); err != nil {
+			return nil, err
+		}
 	}
 
 	a, err := aead.New(ee.dekHandle)
 	if err != nil {
-		err := errors.Wrap(err, "AEAD encryption object creation failed")
-		ee.logger.Fatalf("%+v", err)
+		return nil, errors.Wrap(err, "AEAD encryption object creation failed")
 	}
 
 	ct, err := a.Encrypt(dataPlain, []byte(ee.aad))
 	if err != nil {
-		err := errors.Wrap(err, "cannot encrypt")
-		ee.logger.Fatalf("%+v", err)
+		return nil, errors.Wrap(err, "cannot encrypt")
 	}
 
-	return ct
+	return ct, nil
 }
 
 // Reveal decrypts data using the underlying encryption engine
-func (ee *EncryptionEngine) Reveal(cipherData []byte) []byte {
+func (ee *EncryptionEngine) Reveal(cipherData []byte) ([]byte, error) {
 	ee.logger.Infof("...decrypting with this master KEK %s\n", ee.kekName)
 
 	if ee.dekHandle == nil {
-		ee.ReadWdek()
+		if ee.wDekPathName == "" {
+			return nil, errors.New("no dek. call Load first")
+		}
+		if err := ee.ReadWdek(); err != nil {
+			return nil, err
+		}
 	}
 
 	a, err := aead.New(ee.dekHandle)
 	if err != nil {
-		err := errors.Wrap(err, "cannot create AEAD object from wdek")
-		ee.logger.Fatalf("%+v", err)
+		return nil, errors.Wrap(err, "cannot create AEAD object from wdek")
 	}
 
 	pt, err := a.Decrypt(cipherData, []byte(ee.aad))
 	if err != nil {
-		err := errors.Wrap(err, "cannot decrypt data")
-		ee.logger.Fatalf("%+v", err)
+		return nil, newError(KindIntegrity, err, "cannot decrypt data")
 	}
 
-	return pt
+	return pt, nil
 }
 
-// Load grabs the wDek and reads it in.
-func (ee *EncryptionEngine) Load(data EncryptedData) {
-	if err := ioutil.WriteFile(ee.wDekPathName, []byte(data.Wdek), 0644); err != nil {
-		err := errors.Wrapf(err, "cannot create file for loading: %s", ee.wDekPathName)
-		ee.logger.Fatalf("%+v", err)
+// Load unwraps the wDek carried in the envelope.  Nothing is written to disk, and EncryptedData.WdekName is ignored.
+func (ee *EncryptionEngine) Load(data EncryptedData) error {
+	kh, err := ee.unwrapKeyset(data.Wdek)
+	if err != nil {
+		return err
 	}
-
-	ee.ReadWdek()
+	ee.dekHandle = kh
+	return nil
 }
 
 // Package marshalls the encrypted data with key hierarchy information to be stored as a blob of structured data
-func (ee *EncryptionEngine) Package(data []byte) EncryptedData {
-	ee.WriteWdek()
+func (ee *EncryptionEngine) Package(data []byte) (EncryptedData, error) {
+	if err := ee.WriteWdek(); err != nil {
+		return EncryptedData{}, err
+	}
 	wdek, err := ioutil.ReadFile(ee.wDekPathName)
 	if err != nil {
-		err := errors.Wrap(err, "cannot open wdek")
-		ee.logger.Fatalf("%+v", err)
+		return EncryptedData{}, errors.Wrap(err, "cannot open wdek")
+	}
+
+	ed := NewEncryptedData(ee.kekName, ee.wDekPathName, string(wdek), data)
+	ed.DekScope = DekScopeShared
+	ed.AADScheme = ee.aadScheme
+	return ed, nil
+}
+
+// masterKey returns the KEK in KMS which wraps deks
+func (ee *EncryptionEngine) masterKey() (*kekAEAD, error) {
+	backend, err := ee.kmsClient.GetAEAD(ee.kekName)
+	if err != nil {
+		return nil, newError(KindKMS, err, "cannot retrieve dek from KMS")
+	}
+	return &kekAEAD{AEAD: backend}, nil
+}
+
+// writeKeyset encrypts the keyset with the KEK and writes it in Tink's JSON format
+func (ee *EncryptionEngine) writeKeyset(w io.Writer, kh *keyset.Handle) error {
+	kek, err := ee.masterKey()
+	if err != nil {
+		return err
 	}
+	wdek := aead.NewKMSEnvelopeAEAD(*aead.AES256GCMKeyTemplate(), kek)
+
+	// Write encrypts the keyset handle with the master key and writes to the
+	// io.Writer implementation (memKeyset).
+	if err := kh.Write(keyset.NewJSONWriter(w), wdek); err != nil {
+		if kek.err != nil {
+			return newError(KindKMS, kek.err, "cannot wrap dek")
+		}
+		return errors.Wrap(err, "cannot write JSON marshalled wdek")
+	}
+	return nil
+}
 
-	return NewEncryptedData(ee.kekName, ee.wDekPathName, string(wdek), data)
+// readKeyset reads a keyset in Tink's JSON format and decrypts it with the KEK
+func (ee *EncryptionEngine) readKeyset(r io.Reader) (*keyset.Handle, error) {
+	encrypted, err := keyset.NewJSONReader(r).ReadEncrypted()
+	if err != nil {
+		return nil, newError(KindEnvelope, err, "unexpected wdek format. Use Tink")
+	}
+
+	kek, err := ee.masterKey()
+	if err != nil {
+		return nil, err
+	}
+	masterKey := aead.NewKMSEnvelopeAEAD(*aead.AES256GCMKeyTemplate(), kek)
+
+	// Read the encrypted keyset handle back from the io.Reader implementation
+	// and decrypt it using the master key.
+	kh, err := keyset.Read(&keyset.MemReaderWriter{EncryptedKeyset: encrypted}, masterKey)
+	if err != nil {
+		if kek.err != nil {
+			return nil, newError(KindKMS, kek.err, "cannot unwrap dek")
+		}
+		return nil, newError(KindIntegrity, err, "cannot created wdek handle")
+	}
+	return kh, nil
 }
@@ -17,33 +17,62 @@
 package data
 
 import (
+	"bufio"
+	"bytes"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
-	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
 
+	"github.com/google/tink/go/aead"
 	"github.com/google/tink/go/core/registry"
-	"github.com/google/tink/go/integration/gcpkms"
+	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
-	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
-func TestEncryptionEngine_WdekOps(t *testing.T) {
-	config, err := env.Get()
+// localKMS returns a temporary directory holding a local:// master key, so the tests run without a cloud KMS
+func localKMS(t *testing.T) (string, string, registry.KMSClient) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
 
-	keyURI := config.KmsMkekURI
-	gcpclient, err := gcpkms.NewClient(keyURI)
+	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
 	if err != nil {
-		err := errors.Wrap(err, "gcp client creation failed")
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "master.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(f)); err != nil {
+		t.Fatal(err)
+	}
+
+	keyURI := "local://" + path
+	client, err := kms.NewClient(keyURI)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return dir, keyURI, client
+}
 
-	registry.RegisterKMSClient(gcpclient)
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func TestEncryptionEngine_WdekOps(t *testing.T) {
+	dir, keyURI, kmsClient := localKMS(t)
 
 	type fields struct {
 		wDekPathName string
@@ -65,32 +94,23 @@ func TestEncryptionEngine_WdekOps(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			ee := &EncryptionEngine{
 				kekName:      keyURI,
-				wDekPathName: tt.fields.wDekPathName,
+				wDekPathName: filepath.Join(dir, tt.fields.wDekPathName),
 				dekHandle:    tt.fields.dekHandle,
-				gcpClient:    gcpclient,
-				logger:       config.Logger(),
+				kmsClient:    kmsClient,
+				logger:       testLogger(),
+			}
+			if err := ee.WriteWdek(); err != nil {
+				t.Fatal(err)
+			}
+			if err := ee.ReadWdek(); err != nil {
+				t.Fatal(err)
 			}
-			ee.WriteWdek()
-			ee.ReadWdek()
 		})
 	}
 }
 
 func TestEncryptionEngine_EncryptDecrypt(t *testing.T) {
-	config, err := env.Get()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	keyURI := config.KmsMkekURI
-
-	gcpclient, err := gcpkms.NewClient(keyURI)
-	if err != nil {
-		err := errors.Wrap(err, "gcp client creation failed")
-		log.Fatal(err)
-	}
-
-	registry.RegisterKMSClient(gcpclient)
+	dir, keyURI, kmsClient := localKMS(t)
 
 	gettysburgFile, err := ioutil.ReadFile("../samples/gettysburg.pdf")
 	if err != nil {
@@ -134,16 +154,220 @@ func TestEncryptionEngine_EncryptDecrypt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			ee := &EncryptionEngine{
 				kekName:      keyURI,
-				wDekPathName: tt.fields.wDekPathName,
+				wDekPathName: filepath.Join(dir, tt.fields.wDekPathName),
 				dekHandle:    tt.fields.dekHandle,
-				gcpClient:    gcpclient,
-				logger:       config.Logger(),
+				kmsClient:    kmsClient,
+				logger:       testLogger(),
+			}
+			if err := ee.WriteWdek(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ee.Obfuscate(tt.args.dataPlain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := ee.Reveal(got)
+			if err != nil {
+				t.Fatal(err)
 			}
-			got := ee.Obfuscate(tt.args.dataPlain)
-			plaintext := ee.Reveal(got)
 			if !reflect.DeepEqual(plaintext, tt.args.dataPlain) {
 				t.Errorf("EncryptionEngine.Reveal() = %v, want %v", plaintext, tt.args.dataPlain)
 			}
+			size, err := NewEncryptedData("kek", "", "", got).DataSize()
+			if err != nil || size != int64(len(tt.args.dataPlain)) {
+				t.Errorf("EncryptedData.DataSize() = %v, %v, want %v", size, err, len(tt.args.dataPlain))
+			}
+		})
+	}
+}
+
+func TestEncryptionEngine_Stream(t *testing.T) {
+	_, keyURI, kmsClient := localKMS(t)
+
+	gettysburgFile, err := ioutil.ReadFile("../samples/gettysburg.pdf")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		dataPlain []byte
+	}{
+		{"simpleTest", []byte("encrypt this")},
+		{"FileTest", gettysburgFile},
+		{"MultiSegmentTest", bytes.Repeat(gettysburgFile, 1+(3<<20)/len(gettysburgFile))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ee := NewEncryptionEngine(keyURI, "", kmsClient, testLogger())
+
+			var object bytes.Buffer
+			envelope, err := ee.PackageStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := WriteEnvelope(&object, envelope); err != nil {
+				t.Fatal(err)
+			}
+			w, err := ee.ObfuscateStream(&object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(tt.dataPlain); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			br := bufio.NewReader(&object)
+			b, _, err := ReadEnvelope(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := NewEncryptionEngine(b.KekName, "", kmsClient, testLogger())
+			if err := reader.LoadStream(b); err != nil {
+				t.Fatal(err)
+			}
+			r, err := reader.RevealStream(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, tt.dataPlain) {
+				t.Errorf("EncryptionEngine.RevealStream() returned %d bytes, want %d", len(plaintext), len(tt.dataPlain))
+			}
 		})
 	}
 }
+
+func TestEncryptionEngine_PackageStreamDekScope(t *testing.T) {
+	dir, keyURI, kmsClient := localKMS(t)
+
+	tests := []struct {
+		name      string
+		share     bool
+		wantScope string
+		wantSame  bool
+	}{
+		{"per object", false, DekScopeObject, false},
+		{"shared", true, DekScopeShared, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ee := NewEncryptionEngine(keyURI, filepath.Join(dir, tt.name+".json"), kmsClient, testLogger())
+			ee.ShareDek(tt.share)
+
+			first, err := ee.PackageStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := ee.PackageStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.DekScope != tt.wantScope || second.DekScope != tt.wantScope {
+				t.Errorf("EncryptionEngine.PackageStream() dekScope = %v, %v, want %v", first.DekScope, second.DekScope, tt.wantScope)
+			}
+			if same := first.Wdek == second.Wdek; same != tt.wantSame {
+				t.Errorf("EncryptionEngine.PackageStream() reused the dek = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestEncryptionEngine_Load(t *testing.T) {
+	dir, keyURI, kmsClient := localKMS(t)
+
+	writer := NewEncryptionEngine(keyURI, filepath.Join(dir, "wdek.json"), kmsClient, testLogger())
+	ct, err := writer.Obfuscate([]byte("encrypt this"))
+	if err == nil {
+		t.Fatal("EncryptionEngine.Obfuscate() succeeded without a wdek")
+	}
+	if err := writer.WriteWdek(); err != nil {
+		t.Fatal(err)
+	}
+	if ct, err = writer.Obfuscate([]byte("encrypt this")); err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := writer.Package(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the object names where its wdek should go, which must be ignored
+	planted := filepath.Join(dir, "planted.json")
+	envelope.WdekName = planted
+
+	reader := NewEncryptionEngine(envelope.KekName, "", kmsClient, testLogger())
+	if err := reader.Load(envelope); err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := envelope.Ciphertext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := reader.Reveal(cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "encrypt this" {
+		t.Errorf("EncryptionEngine.Reveal() = %q, want %q", plaintext, "encrypt this")
+	}
+	if _, err := os.Stat(planted); !os.IsNotExist(err) {
+		t.Errorf("EncryptionEngine.Load() wrote %s", planted)
+	}
+}
+
+func TestEncryptionEngine_Rewrap(t *testing.T) {
+	_, oldURI, oldClient := localKMS(t)
+	_, newURI, newClient := localKMS(t)
+
+	seal := NewEncryptionEngine(oldURI, "", oldClient, testLogger())
+	envelope, err := seal.PackageStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ciphertext bytes.Buffer
+	w, err := seal.ObfuscateStream(&ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("encrypt this"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := NewEncryptionEngine(envelope.KekName, "", oldClient, testLogger())
+	to := NewEncryptionEngine(newURI, "", newClient, testLogger())
+	rewrapped, err := from.Rewrap(envelope, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.KekName != newURI || rewrapped.Wdek == envelope.Wdek || rewrapped.DekScope != envelope.DekScope {
+		t.Errorf("EncryptionEngine.Rewrap() = %+v", rewrapped)
+	}
+
+	// the old KEK no longer opens the envelope, the new one decrypts the untouched ciphertext
+	if err := NewEncryptionEngine(oldURI, "", oldClient, testLogger()).LoadStream(rewrapped); err == nil {
+		t.Error("EncryptionEngine.LoadStream() unwrapped with the old KEK")
+	}
+	open := NewEncryptionEngine(rewrapped.KekName, "", newClient, testLogger())
+	if err := open.LoadStream(rewrapped); err != nil {
+		t.Fatal(err)
+	}
+	r, err := open.RevealStream(&ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "encrypt this" {
+		t.Errorf("EncryptionEngine.RevealStream() = %q, want %q", plaintext, "encrypt this")
+	}
+}
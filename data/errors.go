@@ -0,0 +1,144 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/tink"
+)
+
+// Kind classifies errors returned by the data package, so callers can react to the cause of a failure
+type Kind int
+
+const (
+	// KindInternal is any failure not covered by another kind
+	KindInternal Kind = iota
+	// KindKMS means the KEK could not be used, i.e KMS is unavailable or denied the request
+	KindKMS
+	// KindIntegrity means ciphertext or a wrapped key failed authentication
+	KindIntegrity
+	// KindEnvelope means the stored object is not a well formed envelope
+	KindEnvelope
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindKMS:
+		return "kms unavailable"
+	case KindIntegrity:
+		return "integrity failure"
+	case KindEnvelope:
+		return "malformed envelope"
+	default:
+		return "internal error"
+	}
+}
+
+// Error is the error returned by the data package
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Format keeps the stack trace of the underlying error for %+v
+func (e *Error) Format(s fmt.State, verb rune) {
+	if f, ok := e.Err.(fmt.Formatter); ok && verb == 'v' && s.Flag('+') {
+		fmt.Fprintf(s, "%s: ", e.Kind)
+		f.Format(s, verb)
+		return
+	}
+	io.WriteString(s, e.Error())
+}
+
+// KindOf returns the Kind of the first Error in err's chain, or KindInternal when there is none
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+func newError(kind Kind, err error, message string) error {
+	return &Error{Kind: kind, Err: errors.Wrap(err, message)}
+}
+
+// kekAEAD remembers failures of the KEK in KMS, which Tink does not preserve when unwrapping a keyset
+type kekAEAD struct {
+	tink.AEAD
+	err error
+}
+
+func (a *kekAEAD) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	ct, err := a.AEAD.Encrypt(plaintext, additionalData)
+	if err != nil {
+		a.err = err
+	}
+	return ct, err
+}
+
+func (a *kekAEAD) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	pt, err := a.AEAD.Decrypt(ciphertext, additionalData)
+	if err != nil {
+		a.err = err
+	}
+	return pt, err
+}
+
+// sourceReader remembers failures reading ciphertext, to tell them apart from failed authentication
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// integrityReader reports decryption failures that are not caused by reading the ciphertext as KindIntegrity
+type integrityReader struct {
+	plaintext io.Reader
+	src       *sourceReader
+}
+
+func (r *integrityReader) Read(p []byte) (int, error) {
+	n, err := r.plaintext.Read(p)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if r.src.err != nil {
+		return n, errors.Wrap(r.src.err, "cannot read ciphertext")
+	}
+	return n, newError(KindIntegrity, err, "cannot decrypt data")
+}
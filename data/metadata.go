@@ -0,0 +1,163 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/streamingaead"
+)
+
+// metadataAAD is appended to the associated data of the object for its metadata, so neither ciphertext can pass for
+// the other
+const metadataAAD = "\x00metadata"
+
+// digestAAD is appended to the associated data of the object for the digest of its plaintext
+const digestAAD = "\x00digest"
+
+// Digest is the size and checksums of a plaintext, which are only known once it is encrypted.  It is sealed with the
+// dek of the object to be stored apart from the envelope, see SealDigest.
+type Digest struct {
+	Size   int64  `json:"size"`
+	MD5    []byte `json:"md5,omitempty"`
+	CRC32C []byte `json:"crc32c,omitempty"`
+}
+
+// sealedMetadata is what SealMetadata encrypts
+type sealedMetadata struct {
+	Attributes FileAttributes    `json:"attributes"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// SealMetadata encrypts the custom metadata and the file attributes of the object with the streaming dek of the
+// envelope, see PackageStream, and records them in the envelope.  They are bound to the associated data of the object
+// like the ciphertext.
+func (ee *EncryptionEngine) SealMetadata(ed *EncryptedData, meta map[string]string) error {
+	if len(meta) == 0 && ed.FileAttributes == (FileAttributes{}) {
+		ed.Metadata = ""
+		return nil
+	}
+	plaintext, err := json.Marshal(sealedMetadata{Attributes: ed.FileAttributes, Metadata: meta})
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal metadata")
+	}
+	ed.Metadata, err = ee.seal(plaintext, metadataAAD)
+	if err != nil {
+		return errors.Wrap(err, "cannot encrypt metadata")
+	}
+	return nil
+}
+
+// OpenMetadata decrypts the custom metadata recorded in the envelope with the dek loaded by LoadStream, and sets the
+// file attributes of the envelope.  An envelope without metadata has none.
+func (ee *EncryptionEngine) OpenMetadata(ed *EncryptedData) (map[string]string, error) {
+	ed.FileAttributes = FileAttributes{}
+	if ed.Metadata == "" {
+		return nil, nil
+	}
+	plaintext, err := ee.open(ed.Metadata, metadataAAD, "metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed sealedMetadata
+	if err := json.Unmarshal(plaintext, &sealed); err != nil {
+		return nil, newError(KindEnvelope, err, "malformed metadata")
+	}
+	ed.FileAttributes = sealed.Attributes
+	return sealed.Metadata, nil
+}
+
+// SealDigest encrypts the digest of the plaintext with the streaming dek of the envelope, bound to the associated data
+// of the object, and returns it in base64
+func (ee *EncryptionEngine) SealDigest(d Digest) (string, error) {
+	plaintext, err := json.Marshal(d)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal digest")
+	}
+	sealed, err := ee.seal(plaintext, digestAAD)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encrypt digest")
+	}
+	return sealed, nil
+}
+
+// OpenDigest decrypts a digest sealed by SealDigest with the dek loaded by LoadStream
+func (ee *EncryptionEngine) OpenDigest(sealed string) (Digest, error) {
+	plaintext, err := ee.open(sealed, digestAAD, "digest")
+	if err != nil {
+		return Digest{}, err
+	}
+	var d Digest
+	if err := json.Unmarshal(plaintext, &d); err != nil {
+		return Digest{}, newError(KindEnvelope, err, "malformed digest")
+	}
+	return d, nil
+}
+
+// seal encrypts the plaintext with the streaming dek, bound to the associated data of the object followed by suffix
+func (ee *EncryptionEngine) seal(plaintext []byte, suffix string) (string, error) {
+	if ee.streamHandle == nil {
+		return "", errors.New("no streaming dek. call PackageStream first")
+	}
+	sa, err := streamingaead.New(ee.streamHandle)
+	if err != nil {
+		return "", errors.Wrap(err, "streaming AEAD encryption object creation failed")
+	}
+	var buf bytes.Buffer
+	w, err := sa.NewEncryptingWriter(&buf, []byte(ee.aad+suffix))
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// open decrypts what seal encrypted with the same suffix.  what names it in errors.
+func (ee *EncryptionEngine) open(sealed string, suffix string, what string) ([]byte, error) {
+	if ee.streamHandle == nil {
+		return nil, errors.New("no streaming dek. call LoadStream first")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, newError(KindEnvelope, err, "malformed "+what)
+	}
+
+	sa, err := streamingaead.New(ee.streamHandle)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create streaming AEAD object from wdek")
+	}
+	r, err := sa.NewDecryptingReader(bytes.NewReader(ciphertext), []byte(ee.aad+suffix))
+	if err != nil {
+		return nil, newError(KindIntegrity, err, "cannot decrypt "+what)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, newError(KindIntegrity, err, "cannot decrypt "+what)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,144 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+)
+
+func TestEncryptionEngine_SealMetadata(t *testing.T) {
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]string{"patient-id": "12345", "customer": "Jane Doe"}
+	attrs := FileAttributes{ContentType: "text/plain", FileName: "chart.txt", Mode: 0600}
+
+	seal := &EncryptionEngine{streamHandle: kh, logger: testLogger()}
+	if err := seal.BindAAD(AADSchemeObject, "", ObjectID{Bucket: "bucket", Object: "a.enc"}); err != nil {
+		t.Fatal(err)
+	}
+	envelope := EncryptedData{FileAttributes: attrs}
+	if err := seal.SealMetadata(&envelope, meta); err != nil {
+		t.Fatal(err)
+	}
+	envelope.FileAttributes = FileAttributes{}
+	// the body of the object is encrypted with the same dek and associated data
+	var ciphertext bytes.Buffer
+	w, err := seal.ObfuscateStream(&ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(`{"patient-id":"12345"}`))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	body := EncryptedData{Metadata: base64.StdEncoding.EncodeToString(ciphertext.Bytes())}
+
+	tests := []struct {
+		name      string
+		object    string
+		envelope  EncryptedData
+		want      map[string]string
+		wantAttrs FileAttributes
+		wantKind  Kind
+	}{
+		{"same object", "a.enc", envelope, meta, attrs, -1},
+		{"no metadata", "a.enc", EncryptedData{}, nil, FileAttributes{}, -1},
+		{"moved to another object", "b.enc", envelope, nil, FileAttributes{}, KindIntegrity},
+		{"body ciphertext", "a.enc", body, nil, FileAttributes{}, KindIntegrity},
+		{"not base64", "a.enc", EncryptedData{Metadata: "%%%"}, nil, FileAttributes{}, KindEnvelope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open := &EncryptionEngine{streamHandle: kh, logger: testLogger()}
+			if err := open.BindAAD(AADSchemeObject, "", ObjectID{Bucket: "bucket", Object: tt.object}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := open.OpenMetadata(&tt.envelope)
+			if tt.wantKind >= 0 {
+				if KindOf(err) != tt.wantKind {
+					t.Errorf("EncryptionEngine.OpenMetadata() error = %v, want kind %v", err, tt.wantKind)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EncryptionEngine.OpenMetadata() = %v, %v, want %v", got, err, tt.want)
+			}
+			if tt.envelope.FileAttributes != tt.wantAttrs {
+				t.Errorf("EncryptionEngine.OpenMetadata() attributes = %+v, want %+v", tt.envelope.FileAttributes, tt.wantAttrs)
+			}
+		})
+	}
+}
+
+func TestEncryptionEngine_SealDigest(t *testing.T) {
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := Digest{Size: 30, MD5: []byte("0123456789abcdef"), CRC32C: []byte{1, 2, 3, 4}}
+
+	seal := &EncryptionEngine{streamHandle: kh, logger: testLogger()}
+	if err := seal.BindAAD(AADSchemeObject, "", ObjectID{Bucket: "bucket", Object: "a.enc"}); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal.SealDigest(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope EncryptedData
+	if err := seal.SealMetadata(&envelope, map[string]string{"size": "30"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		object   string
+		sealed   string
+		wantKind Kind
+	}{
+		{"same object", "a.enc", sealed, -1},
+		{"moved to another object", "b.enc", sealed, KindIntegrity},
+		{"metadata ciphertext", "a.enc", envelope.Metadata, KindIntegrity},
+		{"not base64", "a.enc", "%%%", KindEnvelope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open := &EncryptionEngine{streamHandle: kh, logger: testLogger()}
+			if err := open.BindAAD(AADSchemeObject, "", ObjectID{Bucket: "bucket", Object: tt.object}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := open.OpenDigest(tt.sealed)
+			if tt.wantKind >= 0 {
+				if KindOf(err) != tt.wantKind {
+					t.Errorf("EncryptionEngine.OpenDigest() error = %v, want kind %v", err, tt.wantKind)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, digest) {
+				t.Errorf("EncryptionEngine.OpenDigest() = %v, %v, want %v", got, err, digest)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+// Rewrap unwraps the dek of the envelope with this engine's KEK and wraps it again with the KEK of to.  The returned
+// envelope differs from ed only in its KEK and wrapped dek, so the ciphertext following it is left untouched.
+func (ee *EncryptionEngine) Rewrap(ed EncryptedData, to *EncryptionEngine) (EncryptedData, error) {
+	kh, err := ee.unwrapKeyset(ed.Wdek)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+	wdek, err := to.wrapKeyset(kh)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+
+	ed.KekName = to.kekName
+	ed.Wdek = wdek
+	return ed, nil
+}
@@ -0,0 +1,106 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+	"github.com/google/tink/go/streamingaead"
+)
+
+const aesGCMKeyTypeURL = "type.googleapis.com/google.crypto.tink.AesGcmKey"
+
+// rotationTemplates gives the template of the new key for the type of the primary key
+var rotationTemplates = map[string]func() *tinkpb.KeyTemplate{
+	aesGCMKeyTypeURL:    aead.AES256GCMKeyTemplate,
+	streamingKeyTypeURL: streamingaead.AES256GCMHKDF1MBKeyTemplate,
+}
+
+// RotateDek adds a new key, of the type of the primary, to the dek keyset and makes it the primary.  The previous keys
+// stay enabled, so older ciphertexts remain decryptable.  Call WriteWdek to save the keyset.
+func (ee *EncryptionEngine) RotateDek() error {
+	if ee.dekHandle == nil {
+		return errors.New("no dek to rotate. call ReadWdek first")
+	}
+
+	// the manager changes the keyset it is given
+	ks := proto.Clone(insecurecleartextkeyset.KeysetMaterial(ee.dekHandle)).(*tinkpb.Keyset)
+	template, err := primaryTemplate(ks)
+	if err != nil {
+		return err
+	}
+	manager := keyset.NewManagerFromHandle(insecurecleartextkeyset.KeysetHandle(ks))
+	if err := manager.Rotate(template); err != nil {
+		return errors.Wrap(err, "cannot add a primary dek")
+	}
+	kh, err := manager.Handle()
+	if err != nil {
+		return errors.Wrap(err, "cannot add a primary dek")
+	}
+	ee.dekHandle = kh
+	return nil
+}
+
+// RetireDeks disables every key of the dek keyset but the primary, or destroys their key material.  Ciphertexts of the
+// retired keys can no longer be decrypted with the keyset.  It returns the number of keys retired.
+func (ee *EncryptionEngine) RetireDeks(destroy bool) (int, error) {
+	if ee.dekHandle == nil {
+		return 0, errors.New("no dek to retire. call ReadWdek first")
+	}
+
+	ks := proto.Clone(insecurecleartextkeyset.KeysetMaterial(ee.dekHandle)).(*tinkpb.Keyset)
+	retired := 0
+	for _, key := range ks.Key {
+		if key.KeyId == ks.PrimaryKeyId || key.Status == tinkpb.KeyStatusType_DESTROYED {
+			continue
+		}
+		if !destroy && key.Status == tinkpb.KeyStatusType_DISABLED {
+			continue
+		}
+		if destroy {
+			key.Status = tinkpb.KeyStatusType_DESTROYED
+			key.KeyData = &tinkpb.KeyData{TypeUrl: key.KeyData.TypeUrl, KeyMaterialType: key.KeyData.KeyMaterialType}
+		} else {
+			key.Status = tinkpb.KeyStatusType_DISABLED
+		}
+		retired++
+	}
+	if err := keyset.Validate(ks); err != nil {
+		return 0, errors.Wrap(err, "cannot retire deks")
+	}
+	ee.dekHandle = insecurecleartextkeyset.KeysetHandle(ks)
+	return retired, nil
+}
+
+func primaryTemplate(ks *tinkpb.Keyset) (*tinkpb.KeyTemplate, error) {
+	for _, key := range ks.Key {
+		if key.KeyId != ks.PrimaryKeyId {
+			continue
+		}
+		template, ok := rotationTemplates[key.KeyData.TypeUrl]
+		if !ok {
+			return nil, errors.Errorf("cannot rotate keys of type %s", key.KeyData.TypeUrl)
+		}
+		return template(), nil
+	}
+	return nil, errors.New("dek keyset has no primary key")
+}
@@ -0,0 +1,163 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+)
+
+func TestEncryptionEngine_RotateDek(t *testing.T) {
+	tests := []struct {
+		name       string
+		destroy    bool
+		wantStatus tinkpb.KeyStatusType
+	}{
+		{"disable", false, tinkpb.KeyStatusType_DISABLED},
+		{"destroy", true, tinkpb.KeyStatusType_DESTROYED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ee := &EncryptionEngine{dekHandle: kh, logger: testLogger()}
+			older, err := ee.Obfuscate([]byte("older"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ee.RotateDek(); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(insecurecleartextkeyset.KeysetMaterial(ee.dekHandle).Key); n != 2 {
+				t.Fatalf("EncryptionEngine.RotateDek() keyset has %d keys, want 2", n)
+			}
+			if len(insecurecleartextkeyset.KeysetMaterial(kh).Key) != 1 {
+				t.Error("EncryptionEngine.RotateDek() changed the previous keyset")
+			}
+			newer, err := ee.Obfuscate([]byte("newer"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ee.Reveal(older); err != nil {
+				t.Errorf("EncryptionEngine.Reveal() of older ciphertext after rotation: %v", err)
+			}
+
+			retired, err := ee.RetireDeks(tt.destroy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retired != 1 {
+				t.Errorf("EncryptionEngine.RetireDeks() = %d, want 1", retired)
+			}
+			for _, key := range insecurecleartextkeyset.KeysetMaterial(ee.dekHandle).Key {
+				primary := key.KeyId == insecurecleartextkeyset.KeysetMaterial(ee.dekHandle).PrimaryKeyId
+				if !primary && key.Status != tt.wantStatus {
+					t.Errorf("EncryptionEngine.RetireDeks() left key %d %v, want %v", key.KeyId, key.Status, tt.wantStatus)
+				}
+				if !primary && tt.destroy && len(key.KeyData.Value) != 0 {
+					t.Errorf("EncryptionEngine.RetireDeks() kept the material of key %d", key.KeyId)
+				}
+			}
+			if _, err := ee.Reveal(older); err == nil {
+				t.Error("EncryptionEngine.Reveal() decrypted with a retired key")
+			}
+			if pt, err := ee.Reveal(newer); err != nil || string(pt) != "newer" {
+				t.Errorf("EncryptionEngine.Reveal() = %q, %v, want %q", pt, err, "newer")
+			}
+		})
+	}
+}
+
+func TestEncryptionEngine_RotateSharedDek(t *testing.T) {
+	dir, keyURI, kmsClient := localKMS(t)
+	path := filepath.Join(dir, "wdek.json")
+
+	seal := func(plaintext string) (EncryptedData, []byte) {
+		ee := NewEncryptionEngine(keyURI, path, kmsClient, testLogger())
+		ee.ShareDek(true)
+		envelope, err := ee.PackageStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ct bytes.Buffer
+		w, err := ee.ObfuscateStream(&ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(plaintext)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return envelope, ct.Bytes()
+	}
+	primary := func(envelope EncryptedData) uint32 {
+		ee := NewEncryptionEngine(keyURI, "", kmsClient, testLogger())
+		kh, err := ee.unwrapKeyset(envelope.Wdek)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return insecurecleartextkeyset.KeysetMaterial(kh).PrimaryKeyId
+	}
+
+	older, olderCT := seal("older")
+
+	rotator := NewEncryptionEngine(keyURI, path, kmsClient, testLogger())
+	if err := rotator.ReadWdek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotator.RotateDek(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotator.RetireDeks(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotator.WriteWdek(); err != nil {
+		t.Fatal(err)
+	}
+
+	newer, _ := seal("newer")
+	if got, want := primary(newer), insecurecleartextkeyset.KeysetMaterial(rotator.dekHandle).PrimaryKeyId; got != want {
+		t.Errorf("EncryptionEngine.PackageStream() after rotation encrypts with key %d, want %d", got, want)
+	}
+	if primary(newer) == primary(older) {
+		t.Error("EncryptionEngine.PackageStream() kept the primary of before the rotation")
+	}
+
+	reader := NewEncryptionEngine(older.KekName, "", kmsClient, testLogger())
+	if err := reader.LoadStream(older); err != nil {
+		t.Fatal(err)
+	}
+	r, err := reader.RevealStream(bytes.NewReader(olderCT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := ioutil.ReadAll(r); err != nil || string(pt) != "older" {
+		t.Errorf("EncryptionEngine.RevealStream() of an object older than the rotation = %q, %v, want %q", pt, err, "older")
+	}
+}
@@ -0,0 +1,250 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	ghpb "github.com/google/tink/go/proto/aes_gcm_hkdf_streaming_go_proto"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+	"github.com/google/tink/go/subtle"
+)
+
+const (
+	streamingKeyTypeURL = "type.googleapis.com/google.crypto.tink.AesGcmHkdfStreamingKey"
+	noncePrefixSize     = 7
+)
+
+// Tink's streaming AEAD only decrypts from the start of the ciphertext. Segments are independently authenticated
+// with a nonce made of the prefix from the stream header, the segment number and a last segment flag, so any run of
+// segments can be decrypted on its own given the stream header.
+
+// StreamHeaderSize returns the size of the header at the start of the streaming ciphertext
+func (ed EncryptedData) StreamHeaderSize() (int64, error) {
+	seg, ok := segmentations[ed.Algorithm]
+	if !ok {
+		return 0, ed.unknownAlgorithm()
+	}
+	return seg.headerSize, nil
+}
+
+// SegmentSpan returns the offsets [from, to) within a streaming ciphertext of ciphertextSize bytes of the segments
+// holding plaintext bytes [start, start+length).
+func (ed EncryptedData) SegmentSpan(ciphertextSize int64, start int64, length int64) (int64, int64, error) {
+	seg, ok := segmentations[ed.Algorithm]
+	if !ok {
+		return 0, 0, ed.unknownAlgorithm()
+	}
+	plaintextSize, err := ed.PlaintextSize(ciphertextSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < 0 || length <= 0 || start+length > plaintextSize {
+		return 0, 0, errors.Errorf("range %d+%d outside plaintext of %d bytes", start, length, plaintextSize)
+	}
+
+	from := seg.segmentOffset(seg.segmentOf(start))
+	to := seg.segmentOffset(seg.segmentOf(start+length-1) + 1)
+	if to > ciphertextSize {
+		to = ciphertextSize
+	}
+	return from, to, nil
+}
+
+// RevealRange returns plaintext bytes [start, start+length) of a streaming ciphertext of ciphertextSize bytes.
+// header holds the stream header and segments the ciphertext from the offset returned by SegmentSpan.
+// LoadStream must be called first.
+func (ee *EncryptionEngine) RevealRange(data EncryptedData, header []byte, segments io.Reader, ciphertextSize int64, start int64, length int64) (io.Reader, error) {
+	ee.logger.Infof("...range decrypting with this master KEK %s\n", ee.kekName)
+
+	seg, ok := segmentations[data.Algorithm]
+	if !ok {
+		return nil, data.unknownAlgorithm()
+	}
+	if _, _, err := data.SegmentSpan(ciphertextSize, start, length); err != nil {
+		return nil, err
+	}
+	if int64(len(header)) != seg.headerSize || int64(header[0]) != seg.headerSize {
+		return nil, &Error{Kind: KindEnvelope, Err: errors.New("invalid stream header")}
+	}
+	if ee.streamHandle == nil {
+		return nil, errors.New("no streaming dek. call LoadStream first")
+	}
+
+	// derive the per object key with every enabled key of the keyset, primary first; the first segment tells which
+	salt := header[1 : seg.headerSize-noncePrefixSize]
+	ks := insecurecleartextkeyset.KeysetMaterial(ee.streamHandle)
+	var ciphers []cipher.AEAD
+	for _, pass := range []bool{true, false} {
+		for _, k := range ks.Key {
+			if (k.KeyId == ks.PrimaryKeyId) != pass || k.Status != tinkpb.KeyStatusType_ENABLED ||
+				k.KeyData.TypeUrl != streamingKeyTypeURL {
+				continue
+			}
+			key := &ghpb.AesGcmHkdfStreamingKey{}
+			if err := proto.Unmarshal(k.KeyData.Value, key); err != nil {
+				return nil, errors.Wrap(err, "cannot parse streaming dek")
+			}
+			if int64(key.Params.CiphertextSegmentSize) != seg.segmentSize {
+				continue
+			}
+			dkey, err := subtle.ComputeHKDF(key.Params.HkdfHashType.String(), key.KeyValue, salt, []byte(ee.aad), key.Params.DerivedKeySize)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot derive segment key")
+			}
+			block, err := aes.NewCipher(dkey)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot derive segment key")
+			}
+			c, err := cipher.NewGCMWithTagSize(block, int(seg.tagSize))
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot derive segment key")
+			}
+			ciphers = append(ciphers, c)
+		}
+	}
+	if len(ciphers) == 0 {
+		return nil, &Error{Kind: KindIntegrity, Err: errors.New("no streaming key in the wdek matches the object")}
+	}
+
+	first := seg.segmentOf(start)
+	r := &segmentReader{
+		seg:            seg,
+		ciphers:        ciphers,
+		noncePrefix:    header[seg.headerSize-noncePrefixSize:],
+		src:            segments,
+		next:           first,
+		last:           seg.segments(ciphertextSize) - 1,
+		ciphertextSize: ciphertextSize,
+	}
+
+	// the plaintext of the first segment starts before the requested range
+	skip := start - seg.plaintextOffset(first)
+	if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, length), nil
+}
+
+// segments returns the number of segments in a ciphertext of ciphertextSize bytes.  The first segment also holds
+// the stream header, the last may be partial.
+func (seg segmentation) segments(ciphertextSize int64) int64 {
+	segments := int64(1)
+	if rest := ciphertextSize - seg.segmentSize; rest > 0 {
+		segments += (rest + seg.segmentSize - 1) / seg.segmentSize
+	}
+	return segments
+}
+
+// segmentOf returns the number of the segment holding the plaintext byte at offset
+func (seg segmentation) segmentOf(offset int64) int64 {
+	first := seg.segmentSize - seg.headerSize - seg.tagSize
+	if offset < first {
+		return 0
+	}
+	return 1 + (offset-first)/(seg.segmentSize-seg.tagSize)
+}
+
+// segmentOffset returns the offset of the segment within the ciphertext
+func (seg segmentation) segmentOffset(segment int64) int64 {
+	if segment == 0 {
+		return seg.headerSize
+	}
+	return segment * seg.segmentSize
+}
+
+// plaintextOffset returns the offset within the plaintext of the first byte held by the segment
+func (seg segmentation) plaintextOffset(segment int64) int64 {
+	if segment == 0 {
+		return 0
+	}
+	return seg.segmentSize - seg.headerSize - seg.tagSize + (segment-1)*(seg.segmentSize-seg.tagSize)
+}
+
+// segmentReader decrypts consecutive segments, starting from any segment of the ciphertext
+type segmentReader struct {
+	seg            segmentation
+	ciphers        []cipher.AEAD
+	noncePrefix    []byte
+	src            io.Reader
+	next           int64 // number of the next segment to read from src
+	last           int64 // number of the final segment of the ciphertext
+	ciphertextSize int64
+
+	ct  []byte
+	buf []byte
+	pt  []byte // plaintext of the current segment not yet returned
+}
+
+// Read decrypts the next segment whenever the previous one has been consumed
+func (r *segmentReader) Read(p []byte) (int, error) {
+	if len(r.pt) == 0 {
+		if r.next > r.last {
+			return 0, io.EOF
+		}
+		if err := r.decryptNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pt)
+	r.pt = r.pt[n:]
+	return n, nil
+}
+
+func (r *segmentReader) decryptNext() error {
+	end := r.seg.segmentOffset(r.next + 1)
+	if end > r.ciphertextSize {
+		end = r.ciphertextSize
+	}
+	size := end - r.seg.segmentOffset(r.next)
+	if int64(cap(r.ct)) < size {
+		r.ct = make([]byte, size)
+	}
+	r.ct = r.ct[:size]
+	if _, err := io.ReadFull(r.src, r.ct); err != nil {
+		return errors.Wrapf(err, "cannot read segment %d", r.next)
+	}
+
+	nonce := make([]byte, len(r.noncePrefix)+5)
+	copy(nonce, r.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[len(r.noncePrefix):], uint32(r.next))
+	if r.next == r.last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	for i, c := range r.ciphers {
+		pt, err := c.Open(r.buf[:0], nonce, r.ct, nil)
+		if err != nil {
+			continue
+		}
+		// the key that opened one segment is the key for the object
+		r.ciphers = r.ciphers[i : i+1]
+		r.buf = pt
+		r.pt = pt
+		r.next++
+		return nil
+	}
+	return &Error{Kind: KindIntegrity, Err: errors.Errorf("cannot decrypt segment %d", r.next)}
+}
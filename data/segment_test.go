@@ -0,0 +1,99 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+	"github.com/sirupsen/logrus"
+)
+
+func TestEncryptionEngine_RevealRange(t *testing.T) {
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ee := &EncryptionEngine{streamHandle: kh, logger: logger}
+
+	plaintext := make([]byte, 3<<20+12345)
+	rand.New(rand.NewSource(1)).Read(plaintext)
+
+	var ciphertext bytes.Buffer
+	w, err := ee.ObfuscateStream(&ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ct := ciphertext.Bytes()
+	ed := NewEncryptedStream("fake/resource/keyring/key", "")
+
+	const segment = 1 << 20
+	tests := []struct {
+		name   string
+		start  int64
+		length int64
+	}{
+		{"first byte", 0, 1},
+		{"within first segment", 100, 1000},
+		{"across first segment", segment - 100, 200},
+		{"within middle segment", 2*segment + 5, 10},
+		{"last byte", int64(len(plaintext)) - 1, 1},
+		{"whole object", 0, int64(len(plaintext))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := ed.SegmentSpan(int64(len(ct)), tt.start, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := ct[:40]
+			r, err := ee.RevealRange(ed, header, bytes.NewReader(ct[from:to]), int64(len(ct)), tt.start, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := plaintext[tt.start : tt.start+tt.length]; !bytes.Equal(got, want) {
+				t.Errorf("EncryptionEngine.RevealRange() returned %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+
+	t.Run("tampered segment", func(t *testing.T) {
+		from, to, _ := ed.SegmentSpan(int64(len(ct)), 2*segment, 1)
+		segments := append([]byte{}, ct[from:to]...)
+		segments[10] ^= 1
+		_, err := ee.RevealRange(ed, ct[:40], bytes.NewReader(segments), int64(len(ct)), 2*segment, 1)
+		if KindOf(err) != KindIntegrity {
+			t.Errorf("EncryptionEngine.RevealRange() error = %v, want kind %v", err, KindIntegrity)
+		}
+	})
+}
@@ -17,7 +17,27 @@
 package data
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AlgorithmAESGCMHKDF1MB marks an envelope that is followed by Tink streaming AEAD ciphertext in 1MB segments.
+// Envelopes without an algorithm carry AES256-GCM ciphertext in EncryptedData.
+const AlgorithmAESGCMHKDF1MB = "AES256_GCM_HKDF_1MB"
+
+// DEK scopes recorded in the envelope
+const (
+	// DekScopeObject marks a DEK generated for this object only
+	DekScopeObject = "object"
+	// DekScopeShared marks a DEK shared with other objects, e.g all the files of a directory
+	DekScopeShared = "shared"
 )
 
 // EncryptedData is the object stored in the bucket.
@@ -25,11 +45,35 @@ import (
 //    Wdek from Tink is json and encrypted.
 //    WdekName is the primaryKeyID for the dek
 //    KekName is the key stored in GCP KMS
+//    Algorithm is set for streaming envelopes, which are written as a single JSON line followed by the ciphertext
+//    DekScope tells whether the dek protects only this object, empty for envelopes written before it was recorded
+//    AADScheme tells which associated data was authenticated with the ciphertext, see AAD
+//    FileAttributes describe the file the plaintext was read from, when known, and are encrypted into Metadata
+//    Metadata is the custom metadata of the object, encrypted with the dek, see SealMetadata
 type EncryptedData struct {
-	KekName       string `json:"kek"`
-	WdekName      string `json:"wdekName"`
-	Wdek          string `json:"wdek"`
-	EncryptedData string `json:"data"`
+	KekName        string `json:"kek"`
+	WdekName       string `json:"wdekName,omitempty"`
+	Wdek           string `json:"wdek"`
+	EncryptedData  string `json:"data,omitempty"`
+	Algorithm      string `json:"alg,omitempty"`
+	DekScope       string `json:"dekScope,omitempty"`
+	AADScheme      string `json:"aadScheme,omitempty"`
+	FileAttributes `json:"-"`
+	Metadata       string `json:"meta,omitempty"`
+
+	// Version of the envelope read, see ReadEnvelope
+	Version int `json:"-"`
+}
+
+// streaming AEAD ciphertext layout, see github.com/google/tink/go/streamingaead/subtle
+type segmentation struct {
+	headerSize  int64 // 1 byte header length, salt the size of the derived key and a 7 byte nonce prefix
+	segmentSize int64 // ciphertext segment size, including the tag
+	tagSize     int64
+}
+
+var segmentations = map[string]segmentation{
+	AlgorithmAESGCMHKDF1MB: {headerSize: 1 + 32 + 7, segmentSize: 1 << 20, tagSize: 16},
 }
 
 // NewEncryptedData constructs an object to send to GCS
@@ -41,3 +85,170 @@ func NewEncryptedData(kekName string, wdekName string, wdek string, data []byte)
 		EncryptedData: base64.StdEncoding.EncodeToString(data),
 	}
 }
+
+// NewEncryptedStream constructs the envelope written ahead of streaming ciphertext
+func NewEncryptedStream(kekName string, wdek string) EncryptedData {
+	return EncryptedData{
+		KekName:   kekName,
+		Wdek:      wdek,
+		Algorithm: AlgorithmAESGCMHKDF1MB,
+	}
+}
+
+// Ciphertext decodes the ciphertext carried in the envelope
+func (ed EncryptedData) Ciphertext() ([]byte, error) {
+	cipher, err := base64.StdEncoding.DecodeString(ed.EncryptedData)
+	if err != nil {
+		return nil, newError(KindEnvelope, err, "possible incomplete transfer")
+	}
+	return cipher, nil
+}
+
+// IsStream reports whether the ciphertext follows the envelope rather than being embedded in it
+func (ed EncryptedData) IsStream() bool {
+	return ed.Algorithm != ""
+}
+
+// CiphertextSize returns the length of the streaming ciphertext for plaintextSize bytes of plaintext
+func (ed EncryptedData) CiphertextSize(plaintextSize int64) (int64, error) {
+	seg, ok := segmentations[ed.Algorithm]
+	if !ok {
+		return 0, ed.unknownAlgorithm()
+	}
+
+	// the first segment also holds the stream header. the last segment may be partial, and is present even when empty
+	segments := int64(1)
+	firstPlaintext := seg.segmentSize - seg.headerSize - seg.tagSize
+	if rest := plaintextSize - firstPlaintext; rest > 0 {
+		plaintextSegment := seg.segmentSize - seg.tagSize
+		segments += (rest + plaintextSegment - 1) / plaintextSegment
+	}
+	return seg.headerSize + plaintextSize + segments*seg.tagSize, nil
+}
+
+// PlaintextSize returns the length of the plaintext held in ciphertextSize bytes of streaming ciphertext
+func (ed EncryptedData) PlaintextSize(ciphertextSize int64) (int64, error) {
+	seg, ok := segmentations[ed.Algorithm]
+	if !ok {
+		return 0, ed.unknownAlgorithm()
+	}
+
+	size := ciphertextSize - seg.headerSize - seg.segments(ciphertextSize)*seg.tagSize
+	if size < 0 {
+		return 0, &Error{Kind: KindEnvelope, Err: errors.Errorf("truncated ciphertext of %d bytes", ciphertextSize)}
+	}
+	return size, nil
+}
+
+// aesGCMOverhead is what Tink AES-GCM adds to the plaintext of envelopes carrying their ciphertext: the 5 byte key
+// prefix, the 12 byte IV and the 16 byte tag
+const aesGCMOverhead = 5 + 12 + 16
+
+// DataSize returns the length of the plaintext carried in an envelope which is not a stream
+func (ed EncryptedData) DataSize() (int64, error) {
+	n := int64(len(ed.EncryptedData)) / 4 * 3
+	n -= int64(len(ed.EncryptedData) - len(strings.TrimRight(ed.EncryptedData, "=")))
+	if n < aesGCMOverhead {
+		return 0, &Error{Kind: KindEnvelope, Err: errors.Errorf("truncated ciphertext of %d bytes", n)}
+	}
+	return n - aesGCMOverhead, nil
+}
+
+func (ed EncryptedData) unknownAlgorithm() error {
+	return &Error{Kind: KindEnvelope, Err: errors.Errorf("unknown streaming algorithm %q", ed.Algorithm)}
+}
+
+// Envelope versions.  Version 1 is JSON, carrying either base64 ciphertext or followed by a newline and streaming
+// ciphertext.  Version 2 is binary: the magic bytes, a version byte, the big endian uint32 length of the JSON header,
+// then the header, followed by streaming ciphertext.
+const (
+	EnvelopeV1 = 1
+	EnvelopeV2 = 2
+)
+
+// envelopeMagic starts version 2 envelopes.  Its first byte is not valid JSON, nor text.
+var envelopeMagic = []byte{0x89, 'T', 'P', 'X'}
+
+// maxHeaderSize bounds the header of version 2 envelopes, which is read into memory
+const maxHeaderSize = 1 << 20
+
+// WriteEnvelope writes the envelope and returns the number of bytes written.  Streaming envelopes are written in
+// version 2, followed by the ciphertext.  Envelopes carrying their ciphertext are written in version 1.
+func WriteEnvelope(w io.Writer, ed EncryptedData) (int, error) {
+	b, err := json.Marshal(ed)
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal encrypted data to package for writing")
+	}
+	if !ed.IsStream() || ed.EncryptedData != "" {
+		return w.Write(append(b, '\n'))
+	}
+	if len(b) > maxHeaderSize {
+		return 0, errors.Errorf("envelope header of %d bytes is too large", len(b))
+	}
+
+	prefix := make([]byte, len(envelopeMagic)+1+4)
+	copy(prefix, envelopeMagic)
+	prefix[len(envelopeMagic)] = EnvelopeV2
+	binary.BigEndian.PutUint32(prefix[len(envelopeMagic)+1:], uint32(len(b)))
+	return w.Write(append(prefix, b...))
+}
+
+// ReadEnvelope reads the envelope at the head of r, in either version, and returns the number of bytes it took.  For
+// streaming envelopes r is left positioned at the start of the ciphertext.  Envelopes that carry their ciphertext are
+// read in full.
+func ReadEnvelope(r *bufio.Reader) (EncryptedData, int, error) {
+	head, err := r.Peek(len(envelopeMagic))
+	if err != nil && err != io.EOF {
+		return EncryptedData{}, 0, errors.Wrap(err, "cannot read envelope")
+	}
+	switch {
+	case bytes.Equal(head, envelopeMagic):
+		return readEnvelopeV2(r)
+	case len(head) > 0 && head[0] == '{':
+		return readEnvelopeV1(r)
+	default:
+		return EncryptedData{}, 0, &Error{Kind: KindEnvelope, Err: errors.New("either bad object name or not an envelope")}
+	}
+}
+
+func readEnvelopeV1(r *bufio.Reader) (EncryptedData, int, error) {
+	ed := EncryptedData{Version: EnvelopeV1}
+
+	// JSON encoding escapes newlines within strings, so the first newline ends the envelope
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return ed, len(line), errors.Wrap(err, "cannot read envelope")
+	}
+	if errUnmarshal := json.Unmarshal(line, &ed); errUnmarshal != nil {
+		return ed, len(line), newError(KindEnvelope, errUnmarshal, "either bad object name or unexpected structure")
+	}
+	return ed, len(line), nil
+}
+
+func readEnvelopeV2(r *bufio.Reader) (EncryptedData, int, error) {
+	ed := EncryptedData{Version: EnvelopeV2}
+
+	prefix := make([]byte, len(envelopeMagic)+1+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return ed, 0, newError(KindEnvelope, err, "truncated envelope")
+	}
+	if version := prefix[len(envelopeMagic)]; version != EnvelopeV2 {
+		return ed, len(prefix), &Error{Kind: KindEnvelope, Err: errors.Errorf("unsupported envelope version %d", version)}
+	}
+	size := binary.BigEndian.Uint32(prefix[len(envelopeMagic)+1:])
+	if size > maxHeaderSize {
+		return ed, len(prefix), &Error{Kind: KindEnvelope, Err: errors.Errorf("envelope header of %d bytes is too large", size)}
+	}
+
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ed, len(prefix), newError(KindEnvelope, err, "truncated envelope header")
+	}
+	if err := json.Unmarshal(header, &ed); err != nil {
+		return ed, len(prefix) + len(header), newError(KindEnvelope, err, "unexpected envelope header")
+	}
+	if !ed.IsStream() {
+		return ed, len(prefix) + len(header), &Error{Kind: KindEnvelope, Err: errors.New("envelope header has no algorithm")}
+	}
+	return ed, len(prefix) + len(header), nil
+}
@@ -17,9 +17,16 @@
 package data
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"reflect"
 	"testing"
+
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
 )
 
 func TestNewEncryptedData(t *testing.T) {
@@ -62,3 +69,117 @@ func TestNewEncryptedData(t *testing.T) {
 		})
 	}
 }
+
+func TestEncryptedData_StreamSizes(t *testing.T) {
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := streamingaead.New(kh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ed := NewEncryptedStream("fake/resource/keyring/key", "12345678")
+	const segment = 1 << 20
+	tests := []struct {
+		name          string
+		plaintextSize int64
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"full first segment", segment - 40 - 16},
+		{"one past first segment", segment - 40 - 16 + 1},
+		{"two full segments", 2*segment - 40 - 2*16},
+		{"several segments", 3*segment + 12345},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := sa.NewEncryptingWriter(&buf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(make([]byte, tt.plaintextSize)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ed.CiphertextSize(tt.plaintextSize)
+			if err != nil || got != int64(buf.Len()) {
+				t.Errorf("EncryptedData.CiphertextSize() = %v, %v, want %v", got, err, buf.Len())
+			}
+			plain, err := ed.PlaintextSize(int64(buf.Len()))
+			if err != nil || plain != tt.plaintextSize {
+				t.Errorf("EncryptedData.PlaintextSize() = %v, %v, want %v", plain, err, tt.plaintextSize)
+			}
+		})
+	}
+}
+
+func TestReadEnvelope(t *testing.T) {
+	ciphertext := []byte{0, 10, 13, '\n', 255}
+	described := NewEncryptedStream("fake/resource/keyring/key", "{}")
+	described.FileAttributes = FileAttributes{ContentType: "text/plain", FileName: "notes.txt", Mode: 0600, ModTime: "2020-06-01T12:00:00Z"}
+	tests := []struct {
+		name        string
+		envelope    EncryptedData
+		jsonLine    bool // stream envelope written as JSON, before version 2
+		trailer     []byte
+		wantVersion int
+	}{
+		{"legacy", NewEncryptedData("fake/resource/keyring/key", "wdek.json", "{\"k\":\n1}", []byte{1, 2, 3, 4}), false, nil, EnvelopeV1},
+		{"stream json", NewEncryptedStream("fake/resource/keyring/key", "{\"k\":\n1}"), true, ciphertext, EnvelopeV1},
+		{"stream", NewEncryptedStream("fake/resource/keyring/key", "{\"k\":\n1}"), false, ciphertext, EnvelopeV2},
+		{"file attributes left out", described, false, ciphertext, EnvelopeV2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := WriteEnvelope(&buf, tt.envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.jsonLine {
+				line, _ := json.Marshal(tt.envelope)
+				buf.Reset()
+				n, _ = buf.Write(append(line, '\n'))
+			}
+			buf.Write(tt.trailer)
+
+			br := bufio.NewReader(&buf)
+			got, size, err := ReadEnvelope(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.envelope.Version = tt.wantVersion
+			// only written encrypted, see SealMetadata
+			tt.envelope.FileAttributes = FileAttributes{}
+			if !reflect.DeepEqual(got, tt.envelope) || size != n {
+				t.Errorf("ReadEnvelope() = %v, %v, want %v, %v", got, size, tt.envelope, n)
+			}
+			rest, _ := ioutil.ReadAll(br)
+			if !bytes.Equal(rest, tt.trailer) {
+				t.Errorf("ReadEnvelope() left %v, want %v", rest, tt.trailer)
+			}
+		})
+	}
+
+	t.Run("truncated header", func(t *testing.T) {
+		var buf bytes.Buffer
+		WriteEnvelope(&buf, NewEncryptedStream("fake/resource/keyring/key", "{}"))
+		_, _, err := ReadEnvelope(bufio.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2])))
+		if KindOf(err) != KindEnvelope {
+			t.Errorf("ReadEnvelope() error = %v, want kind %v", err, KindEnvelope)
+		}
+	})
+
+	t.Run("not an envelope", func(t *testing.T) {
+		_, _, err := ReadEnvelope(bufio.NewReader(bytes.NewReader([]byte("plain text object\n"))))
+		if KindOf(err) != KindEnvelope {
+			t.Errorf("ReadEnvelope() error = %v, want kind %v", err, KindEnvelope)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package data
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+)
+
+// PackageStream generates the streaming dek for the next object, wraps it and returns the envelope to write ahead of
+// the ciphertext produced by ObfuscateStream.  With ShareDek the keyset of the wdek file is read once and reused.
+func (ee *EncryptionEngine) PackageStream() (EncryptedData, error) {
+	if ee.shareDek {
+		if ee.sharedHandle == nil {
+			if err := ee.readSharedDek(); err != nil {
+				return EncryptedData{}, err
+			}
+		}
+		ee.streamHandle = ee.sharedHandle
+		envelope := NewEncryptedStream(ee.kekName, ee.sharedWdek)
+		envelope.DekScope = DekScopeShared
+		envelope.AADScheme = ee.aadScheme
+		return envelope, nil
+	}
+
+	ee.logger.Debug("creating a new streaming DEK")
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		return EncryptedData{}, errors.Wrap(err, "creating streaming dek key handle failed")
+	}
+
+	wdek, err := ee.wrapKeyset(kh)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+	ee.streamHandle = kh
+
+	envelope := NewEncryptedStream(ee.kekName, wdek)
+	envelope.DekScope = DekScopeObject
+	envelope.AADScheme = ee.aadScheme
+	return envelope, nil
+}
+
+// NewSharedDek writes a streaming dek keyset with a single key to the wdek path name, for ShareDek and RotateDek
+func (ee *EncryptionEngine) NewSharedDek() error {
+	kh, err := keyset.NewHandle(streamingaead.AES256GCMHKDF1MBKeyTemplate())
+	if err != nil {
+		return errors.Wrap(err, "creating streaming dek key handle failed")
+	}
+	ee.dekHandle = kh
+	return ee.WriteWdek()
+}
+
+// readSharedDek loads the streaming dek keyset of the wdek file, creating it when there is none.  The envelopes carry
+// the keyset as it is wrapped in the file, so objects packaged before a rotation keep decrypting with their own copy.
+func (ee *EncryptionEngine) readSharedDek() error {
+	if _, err := os.Stat(ee.wDekPathName); os.IsNotExist(err) {
+		ee.logger.Infof("creating the shared streaming DEK %s", ee.wDekPathName)
+		if err := ee.NewSharedDek(); err != nil {
+			return err
+		}
+	}
+	wdek, err := ioutil.ReadFile(ee.wDekPathName)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read the shared wdek %s", ee.wDekPathName)
+	}
+	kh, err := ee.unwrapKeyset(string(wdek))
+	if err != nil {
+		return err
+	}
+
+	ks := insecurecleartextkeyset.KeysetMaterial(kh)
+	for _, key := range ks.Key {
+		if key.KeyId == ks.PrimaryKeyId && key.KeyData.TypeUrl != streamingKeyTypeURL {
+			return errors.Errorf("%s is not a streaming dek keyset, its primary is a %s", ee.wDekPathName, key.KeyData.TypeUrl)
+		}
+	}
+	ee.sharedHandle = kh
+	ee.sharedWdek = string(wdek)
+	return nil
+}
+
+// LoadStream unwraps the streaming dek carried in the envelope.  Nothing is written to disk.
+func (ee *EncryptionEngine) LoadStream(data EncryptedData) error {
+	kh, err := ee.unwrapKeyset(data.Wdek)
+	if err != nil {
+		return err
+	}
+	ee.streamHandle = kh
+	return nil
+}
+
+// ObfuscateStream returns a writer that encrypts everything written to it into dst.  Close must be called to flush
+// the final segment.
+func (ee *EncryptionEngine) ObfuscateStream(dst io.Writer) (io.WriteCloser, error) {
+	ee.logger.Infof("...stream encrypting using this master KEK %s\n", ee.kekName)
+
+	if ee.streamHandle == nil {
+		return nil, errors.New("no streaming dek. call PackageStream or LoadStream first")
+	}
+
+	sa, err := streamingaead.New(ee.streamHandle)
+	if err != nil {
+		return nil, errors.Wrap(err, "streaming AEAD encryption object creation failed")
+	}
+
+	w, err := sa.NewEncryptingWriter(dst, []byte(ee.aad))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encrypt")
+	}
+	return w, nil
+}
+
+// RevealStream returns a reader that decrypts the ciphertext read from src.  Each segment is authenticated before
+// it is returned, so a read error means the remainder of the object cannot be trusted.
+func (ee *EncryptionEngine) RevealStream(src io.Reader) (io.Reader, error) {
+	ee.logger.Infof("...stream decrypting with this master KEK %s\n", ee.kekName)
+
+	if ee.streamHandle == nil {
+		return nil, errors.New("no streaming dek. call LoadStream first")
+	}
+
+	sa, err := streamingaead.New(ee.streamHandle)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create streaming AEAD object from wdek")
+	}
+
+	source := &sourceReader{Reader: src}
+	r, err := sa.NewDecryptingReader(source, []byte(ee.aad))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decrypt data")
+	}
+	return &integrityReader{plaintext: r, src: source}, nil
+}
+
+// wrapKeyset encrypts the keyset with the KEK and returns it in Tink's JSON format
+func (ee *EncryptionEngine) wrapKeyset(kh *keyset.Handle) (string, error) {
+	var buf bytes.Buffer
+	if err := ee.writeKeyset(&buf, kh); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// unwrapKeyset decrypts a keyset produced by wrapKeyset with the KEK
+func (ee *EncryptionEngine) unwrapKeyset(wdek string) (*keyset.Handle, error) {
+	return ee.readKeyset(bytes.NewBufferString(wdek))
+}
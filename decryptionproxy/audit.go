@@ -0,0 +1,97 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+)
+
+// auditRecord is the audit record of an operation in progress
+type auditRecord struct {
+	audit.Record
+
+	// released is set once the decryption is recorded, before anything decrypted was sent, see release
+	released bool
+}
+
+// newAuditRecord starts the audit record of an encryption or decryption of the target object by the client of ctx
+func newAuditRecord(ctx context.Context, action string, t target) *auditRecord {
+	rec := &auditRecord{Record: audit.Record{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Object: "gs://" + t.Bucket + "/" + t.Object,
+	}}
+	if id, ok := IdentityFrom(ctx); ok {
+		rec.Identity = id.Name()
+		rec.AuthMethod = id.Method
+	}
+	return rec
+}
+
+// release records the decryption of size bytes of plaintext as successful before any of it, or of the metadata
+// decrypted with it, is sent to the client.  The request must fail when the record cannot be written, so no plaintext
+// leaves the proxy unaudited.
+func (h *handler) release(rec *auditRecord, size int64) error {
+	if h.audit == nil {
+		return nil
+	}
+	released := rec.Record
+	released.Outcome, released.Bytes = audit.OutcomeOK, size
+	if err := h.audit.Write(released); err != nil {
+		h.logger.WithError(err).Errorf("cannot audit %s of %s", rec.Action, rec.Object)
+		return err
+	}
+	rec.released = true
+	return nil
+}
+
+// audited completes the record with the outcome of err, unless it already has one, and appends it to the audit log,
+// if the proxy keeps one.  A decryption released as successful is only recorded again when it failed after all, e.g
+// on a segment failing authentication.  A record which cannot be written is logged and returned, for the requests
+// which can still fail.
+func (h *handler) audited(rec *auditRecord, err error) error {
+	if h.audit == nil || rec == nil {
+		return nil
+	}
+	if rec.Outcome == "" {
+		rec.Outcome = outcome(err)
+	}
+	if rec.released && rec.Outcome == audit.OutcomeOK {
+		return nil
+	}
+	if errWrite := h.audit.Write(rec.Record); errWrite != nil {
+		h.logger.WithError(errWrite).Errorf("cannot audit %s of %s", rec.Action, rec.Object)
+		return errWrite
+	}
+	return nil
+}
+
+// outcome describes the result of an operation for the audit log
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return audit.OutcomeOK
+	case data.KindOf(err) != data.KindInternal:
+		return data.KindOf(err).String()
+	default:
+		return err.Error()
+	}
+}
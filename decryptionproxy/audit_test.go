@@ -0,0 +1,165 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+func TestHandler_audit(t *testing.T) {
+	dir := testDir(t)
+	auditFile, keyFile := filepath.Join(dir, "audit.log"), filepath.Join(dir, "audit.key")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var kek string
+	proxy, gcs := testProxy(t, func(c *env.Config) {
+		c.Proxy.AuditLogFile, c.Proxy.AuditKeyFile = auditFile, keyFile
+		kek = c.KmsMkekURI
+	})
+	plaintext := "four score and seven years ago"
+
+	if status := put(t, proxy.URL+"/speech.txt", plaintext); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	if status, _ := get(t, proxy.URL+"/speech.txt", nil); status != http.StatusOK {
+		t.Fatalf("GET status = %v", status)
+	}
+	if status, _ := get(t, proxy.URL+"/speech.txt", http.Header{"Range": {"bytes=0-3"}}); status != http.StatusPartialContent {
+		t.Fatalf("range GET status = %v", status)
+	}
+	// the metadata is decrypted
+	resp, err := http.Head(proxy.URL + "/speech.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD status = %v", resp.StatusCode)
+	}
+	// not decrypted, so not audited
+	if status, _ := get(t, proxy.URL+"/missing.txt", nil); status != http.StatusNotFound {
+		t.Fatalf("GET missing status = %v", status)
+	}
+	stored := gcs.objects["bucket/speech.txt"]
+	stored[len(stored)-1] ^= 1
+	// the response is aborted, on a new connection so the client does not retry
+	client := &http.Client{Transport: &http.Transport{}}
+	if resp, err := client.Get(proxy.URL + "/speech.txt"); err == nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	// wait for the handlers to complete their records
+	proxy.Close()
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if count, _, err := audit.Verify(f, key); err != nil || count != 6 {
+		t.Fatalf("Verify() = %d, %v, want 6 records", count, err)
+	}
+
+	content, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var e struct{ Record audit.Record }
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e.Record)
+	}
+
+	want := []audit.Record{
+		{Action: audit.ActionEncrypt, Outcome: audit.OutcomeOK, Bytes: int64(len(plaintext))},
+		{Action: audit.ActionDecrypt, Outcome: audit.OutcomeOK, Bytes: int64(len(plaintext))},
+		{Action: audit.ActionDecrypt, Outcome: audit.OutcomeOK, Bytes: 4},
+		{Action: audit.ActionDecrypt, Outcome: audit.OutcomeOK},
+		// recorded before the plaintext is released, then again once it fails
+		{Action: audit.ActionDecrypt, Outcome: audit.OutcomeOK, Bytes: int64(len(plaintext))},
+		{Action: audit.ActionDecrypt, Outcome: "integrity failure"},
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Action != w.Action || g.Outcome != w.Outcome || g.Bytes != w.Bytes {
+			t.Errorf("record %d = %s %s %d bytes, want %s %s %d bytes", i, g.Action, g.Outcome, g.Bytes, w.Action, w.Outcome, w.Bytes)
+		}
+		if g.Object != "gs://bucket/speech.txt" || g.KEK != kek {
+			t.Errorf("record %d = %s with %s, want gs://bucket/speech.txt with %s", i, g.Object, g.KEK, kek)
+		}
+	}
+}
+
+func TestHandler_auditFailure(t *testing.T) {
+	dir := testDir(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	c, client, _ := testGCS(t)
+	auditLog, err := audit.Open(filepath.Join(dir, "audit.log"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(Decorate(New(c, client, auditLog), RouteHandler(), ConstraintHandler(c.Logger())))
+	defer proxy.Close()
+	plaintext := "four score and seven years ago"
+	if status := put(t, proxy.URL+"/speech.txt", plaintext); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+
+	// nothing is decrypted or encrypted once the log cannot be written
+	auditLog.Close()
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"get", nil},
+		{"range", http.Header{"Range": {"bytes=5-9"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, proxy.URL+"/speech.txt", tt.header)
+			if status != http.StatusInternalServerError || strings.Contains(body, "score") {
+				t.Errorf("GET = %v %q, want %v without plaintext", status, body, http.StatusInternalServerError)
+			}
+		})
+	}
+	resp, err := http.Head(proxy.URL + "/speech.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("HEAD status = %v, want %v", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if status := put(t, proxy.URL+"/other.txt", plaintext); status != http.StatusInternalServerError {
+		t.Errorf("PUT status = %v, want %v", status, http.StatusInternalServerError)
+	}
+}
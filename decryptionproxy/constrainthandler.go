@@ -25,14 +25,17 @@ import (
 )
 
 // ConstraintHandler middleware enforces limitations that the proxy currently has
-// 1. proxy only supports GET
-// 2. must have at least a bucket name
+// 1. proxy only supports GET and HEAD to decrypt, PUT and POST to encrypt
+// 2. must have at least a bucket name.  POST object and listing, GET ?list-type=2, are the only requests made against
+// the bucket root
 func ConstraintHandler(logger *logrus.Logger) Decorator {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			///<1> supported methods
 			if r.Method != http.MethodGet &&
-				r.Method != http.MethodHead {
+				r.Method != http.MethodHead &&
+				r.Method != http.MethodPut &&
+				r.Method != http.MethodPost {
 				err := errors.New("method not yet supported")
 				logger.Errorf("%s: %+v", r.Method, err)
 				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
@@ -40,7 +43,7 @@ func ConstraintHandler(logger *logrus.Logger) Decorator {
 			}
 
 			///<2> valid objects
-			if r.URL.Path == "/" {
+			if r.URL.Path == "/" && r.Method != http.MethodPost && !(r.Method == http.MethodGet && isList(r)) {
 				err := errors.New("must specify a valid object, not root directory")
 				logger.Errorf("%+v", err)
 				http.Error(w, err.Error(), http.StatusBadRequest)
@@ -50,3 +53,8 @@ func ConstraintHandler(logger *logrus.Logger) Decorator {
 		})
 	}
 }
+
+// isList reports whether the request is a ListObjectsV2 request of the XML API
+func isList(r *http.Request) bool {
+	return r.URL.Query().Get("list-type") == "2"
+}
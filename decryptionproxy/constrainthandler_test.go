@@ -0,0 +1,62 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConstraintHandler(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	type args struct {
+		method string
+		path   string
+	}
+	tests := []struct {
+		name string
+		args args
+		want int
+	}{
+		{"get object", args{http.MethodGet, "/gettysburg.pdf.enc"}, http.StatusOK},
+		{"head object", args{http.MethodHead, "/gettysburg.pdf.enc"}, http.StatusOK},
+		{"put object", args{http.MethodPut, "/gettysburg.pdf.enc"}, http.StatusOK},
+		{"post object", args{http.MethodPost, "/"}, http.StatusOK},
+		{"get root", args{http.MethodGet, "/"}, http.StatusBadRequest},
+		{"list root", args{http.MethodGet, "/?list-type=2&prefix=a"}, http.StatusOK},
+		{"put root", args{http.MethodPut, "/"}, http.StatusBadRequest},
+		{"delete object", args{http.MethodDelete, "/gettysburg.pdf.enc"}, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.args.method, tt.args.path, nil)
+			ConstraintHandler(logger)(ok).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("ConstraintHandler() status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -17,38 +17,88 @@
 package decryptionproxy
 
 import (
+	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/json"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
 	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
 
 	"github.com/google/tink/go/core/registry"
-	"github.com/google/tink/go/integration/gcpkms"
 
 	"github.com/sirupsen/logrus"
 )
 
-// GcsEndpoint specifies REST base endpoint for GCS
-const GcsEndpoint = "storage.googleapis.com"
-
 type handler struct {
 	logger     *logrus.Logger
 	config     env.Config
+	router     *router
 	restClient *http.Client
+	audit      *audit.Log
 }
 
-//ServeHTTP overwrites behavior to handle GET and performs decryption through Tink
+//ServeHTTP overwrites behavior to decrypt on GET and encrypt on PUT and POST through Tink
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	if bucket, ok := jsonListBucket(r.URL.Path); ok && r.Method == http.MethodGet {
+		h.serveJSONList(w, r, bucket)
+		return
+	}
+
+	t, err := h.router.resolve(r)
+	if err != nil {
+		h.logger.WithError(err).Errorf("%s %s", r.Method, r.URL.Path)
+		status := http.StatusNotFound
+		if errors.Is(err, errObjectName) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if t.Object == "" && r.Method == http.MethodGet && isList(r) {
+		if err := authorize(r, methodList, listingTarget(t, r.URL.Query().Get("prefix"))); err != nil {
+			http.Error(w, errors.Cause(err).Error(), statusFor(err))
+			return
+		}
+		h.serveList(w, r, t)
+		return
+	}
+	if t.Object == "" && r.Method != http.MethodPost {
+		http.Error(w, "must specify a valid object, not a bucket", http.StatusBadRequest)
+		return
+	}
+	// the object of a POST is the key of its form, authorized once read
+	if r.Method != http.MethodPost {
+		if err := authorize(r, policyMethod(r), t); err != nil {
+			http.Error(w, errors.Cause(err).Error(), statusFor(err))
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		h.servePut(w, r, t)
+	case http.MethodPost:
+		h.servePost(w, r, t)
+	case http.MethodHead:
+		h.serveHead(w, r, t)
+	default:
+		h.serveGet(w, r, t)
+	}
+}
+
+// serveGet retrieves the encrypted object from GCS and returns the plaintext to the client
+func (h *handler) serveGet(w http.ResponseWriter, r *http.Request, t target) {
+
 	// err and wrapper variables are used to communicate errors from calling GCP APIs
 	var err error
 	resp := RespWrapper{
@@ -65,91 +115,264 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	ctx, cancel := context.WithTimeout(r.Context(), h.config.Proxy.Timeout)
-	defer cancel()
+	// ranges of the plaintext are translated into ranges of ciphertext segments
+	if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		var handled bool
+		if handled, err = h.serveRange(&resp, r, t); handled {
+			return
+		}
+	}
+
+	// objects may be of any size, so the transfer is only bound by its progress
+	ctx, transfer, stop := watchProgress(r.Context(), h.config.Proxy.Timeout)
+	defer stop()
+
+	gcsResp, err := h.fetchObject(&t, func(t target) (*http.Response, error) {
+		proxyToGCSReq, err := http.NewRequest(r.Method, h.objectURL(t, r.URL.RawQuery), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		proxyToGCSReq = proxyToGCSReq.WithContext(ctx)
 
-	bucketEndpoint := h.config.BucketName + "." + GcsEndpoint
-	url := url.URL{
-		Scheme: "https",
-		Host:   bucketEndpoint,
-		Path:   r.URL.RequestURI(),
+		copyReqHeader(proxyToGCSReq.Header, r.Header)
+
+		// a slice of the ciphertext cannot be decrypted, so the whole object is fetched and served
+		proxyToGCSReq.Header.Del("Range")
+		proxyToGCSReq.Header.Del("If-Range")
+
+		return h.restClient.Do(proxyToGCSReq)
+	})
+	if err != nil {
+		replyError(&resp, err, http.StatusInternalServerError)
+		return
+	}
+	defer gcsResp.Body.Close()
+
+	// pass failures from GCS (i.e object not found) through to the client untouched
+	if gcsResp.StatusCode != http.StatusOK {
+		copyRespHeader(resp, gcsResp)
+		if _, errCopy := io.Copy(resp, gcsResp.Body); errCopy != nil {
+			h.logger.WithError(errCopy).Warn("could not relay GCS response")
+		}
+		return
 	}
 
-	proxyToGCSReq, err := http.NewRequest(r.Method, url.String(), nil)
+	rec := newAuditRecord(r.Context(), audit.ActionDecrypt, t)
+	rec.Generation = gcsResp.Header.Get("X-Goog-Generation")
+	defer func() { h.audited(rec, err) }()
+
+	/// Decrypt response using Tink
+	// failures are reported to the client with a status matching their cause, see statusFor.
+	// client will timeout for long operations based on environment variables
+	br := bufio.NewReader(transfer.reader(gcsResp.Body))
+	b, envelopeSize, err := readEnvelope(br)
 	if err != nil {
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
-		resp.SaveStatus(http.StatusInternalServerError)
+		err = errors.Wrap(err, "from GCS")
+		replyError(&resp, err, statusFor(err))
 		return
 	}
+	rec.KEK = b.KekName
 
-	proxyToGCSReq = proxyToGCSReq.WithContext(ctx)
+	kmsClient, err := h.kmsClient(t, b.KekName)
+	if err != nil {
+		replyError(&resp, err, statusFor(err))
+		return
+	}
 
-	copyReqHeader(proxyToGCSReq.Header, r.Header)
+	ee := data.NewEncryptionEngine(b.KekName, "", kmsClient, h.logger)
+	if err = bindAAD(ee, b, t); err != nil {
+		replyError(&resp, err, statusFor(err))
+		return
+	}
+	if b.IsStream() {
+		err = h.serveStream(&resp, gcsResp, ee, b, int64(envelopeSize), br, rec)
+		return
+	}
 
-	gcsResp, err := h.restClient.Do(proxyToGCSReq)
+	if err = unwrapDEK(ee, b); err != nil {
+		replyError(&resp, err, statusFor(err))
+		return
+	}
+	cipher, err := b.Ciphertext()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		resp.SaveStatus(http.StatusInternalServerError)
+		replyError(&resp, err, statusFor(err))
+		return
+	}
+	decryptStart := time.Now()
+	plaintext, err := ee.Reveal(cipher)
+	observePhase(phaseDecrypt, decryptStart)
+	if err != nil {
+		replyError(&resp, err, statusFor(err))
 		return
 	}
-	defer gcsResp.Body.Close()
 
+	// the size of the file in the bucket is different due to encryption, so when decrypted, its size doesn't match what
+	// a client (i.e curl) might expect.  Avoids getting an error such as "(18) transfer closed with NN bytes remaining to read" where NN is the difference.
+	if err = h.release(rec, int64(len(plaintext))); err != nil {
+		replyError(&resp, err, statusFor(err))
+		return
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(len(plaintext)))
+	describePlaintext(gcsResp.Header, nil)
 	copyRespHeader(resp, gcsResp)
 
-	/// Decrypt response using Tink
-	// from this point forward, unless otherwise specified, kill the proxy for any decryption erreor, since something
-	// seriously wrong.
-	// client will timeout for long operations based on environment variables
-	keyURI := h.config.KmsMkekURI
-	kmsClient, err := gcpkms.NewClient(keyURI)
-	if err != nil {
-		err := errors.Wrap(err, "gcp client creation failed")
-		h.logger.Fatalf("%+v", err)
+	length, errRespWrite := resp.Write(plaintext)
+	rec.Bytes = int64(length)
+	if errRespWrite != nil {
+		err = errors.Wrap(errRespWrite, "could not write plaintext into client response")
+		return
+	}
+	h.logger.Debugf("writer length: %v", length)
+}
+
+// serveHead answers with the headers of the plaintext, without fetching the ciphertext.  Its size is read from the
+// envelope, and the file attributes, custom metadata and digest decrypted, which is audited, see openObject.
+func (h *handler) serveHead(w http.ResponseWriter, r *http.Request, t target) {
+	resp := RespWrapper{
+		Status:         http.StatusOK,
+		ResponseWriter: w,
 	}
 
-	registry.RegisterKMSClient(kmsClient)
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.Proxy.Timeout)
+	defer cancel()
 
-	bodyBytes, err := ioutil.ReadAll(gcsResp.Body)
+	gcsResp, err := h.fetchObject(&t, func(t target) (*http.Response, error) {
+		proxyToGCSReq, err := http.NewRequest(http.MethodHead, h.objectURL(t, r.URL.RawQuery), nil)
+		if err != nil {
+			return nil, err
+		}
+		proxyToGCSReq = proxyToGCSReq.WithContext(ctx)
+		copyReqHeader(proxyToGCSReq.Header, r.Header)
+		return h.restClient.Do(proxyToGCSReq)
+	})
 	if err != nil {
-		err := errors.Wrap(err, "cannot read ciphertext from GCS")
-		h.logger.Fatalf("%+v", err)
+		replyError(&resp, err, http.StatusInternalServerError)
+		return
+	}
+	defer gcsResp.Body.Close()
+	if gcsResp.StatusCode != http.StatusOK {
+		copyRespHeader(resp, gcsResp)
+		return
 	}
 
-	var b data.EncryptedData
-	if errUnmarshal := json.Unmarshal(bodyBytes, &b); errUnmarshal != nil {
-		err = errors.Wrap(errUnmarshal, "either bad object name or unexpected structure from GCS")
-		http.Error(resp, err.Error(), http.StatusBadRequest)
-		resp.SaveStatus(http.StatusBadRequest)
+	// the size is read from the envelope, and the digest and metadata decrypted, as GCS cannot be trusted with them
+	info, statResp, err := h.stat(ctx, r, t)
+	if err != nil {
+		h.logger.WithError(err).Errorf("failed while reading the envelope %+v", err)
+		replyError(&resp, err, statusFor(err))
+		return
+	}
+	if statResp != nil {
+		statResp.Body.Close()
+		copyRespHeader(resp, statResp)
+		return
+	}
+	meta, digest, err := h.openObject(r.Context(), t, &info.envelope, gcsResp.Header)
+	if err != nil {
+		h.logger.WithError(err).Errorf("failed while decrypting the metadata %+v", err)
+		replyError(&resp, err, statusFor(err))
 		return
 	}
+	describePlaintext(gcsResp.Header, digest)
+	describeFile(gcsResp.Header, info.envelope.FileAttributes)
+	describeMetadata(gcsResp.Header, meta)
 
-	ee := data.NewEncryptionEngine(b.KekName, b.WdekName, kmsClient, h.logger)
-	ee.Load(b)
+	resp.Header().Set("Content-Length", strconv.FormatInt(info.size, 10))
+	resp.Header().Set("Accept-Ranges", "bytes")
+	copyRespHeader(resp, gcsResp)
+}
 
-	cipher, errDecode := base64.StdEncoding.DecodeString(b.EncryptedData)
-	if errDecode != nil {
-		err := errors.Wrap(errDecode, "possible incomplete GCS transfer.")
-		h.logger.Fatalf("%+v", err)
+// serveStream decrypts the streaming ciphertext following the envelope a segment at a time, so memory use does not
+// grow with the object size.  The plaintext served is counted in the audit record.
+func (h *handler) serveStream(resp *RespWrapper, gcsResp *http.Response, ee *data.EncryptionEngine, b data.EncryptedData, envelopeSize int64, ciphertext io.Reader, rec *auditRecord) error {
+	if err := unwrapDEK(ee, b); err != nil {
+		replyError(resp, err, statusFor(err))
+		return err
+	}
+	meta, err := ee.OpenMetadata(&b)
+	if err != nil {
+		replyError(resp, err, statusFor(err))
+		return err
+	}
+	digest, err := sealedDigest(gcsResp.Header, ee)
+	if err != nil {
+		replyError(resp, err, statusFor(err))
+		return err
+	}
+	plaintext, err := ee.RevealStream(ciphertext)
+	if err != nil {
+		replyError(resp, err, statusFor(err))
+		return err
 	}
 
-	plaintext := ee.Reveal(cipher)
+	// the size recorded is unknown without the size of the object
+	var size int64
+	if gcsResp.ContentLength >= 0 {
+		if size, err = b.PlaintextSize(gcsResp.ContentLength - envelopeSize); err != nil {
+			err = errors.Wrap(err, "possible incomplete GCS transfer.")
+			replyError(resp, err, statusFor(err))
+			return err
+		}
+		resp.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if err := h.release(rec, size); err != nil {
+		replyError(resp, err, statusFor(err))
+		return err
+	}
+	describePlaintext(gcsResp.Header, digest)
+	describeFile(gcsResp.Header, b.FileAttributes)
+	describeMetadata(gcsResp.Header, meta)
+	copyRespHeader(*resp, gcsResp)
 
-	length, errRespWrite := resp.Write(plaintext)
-	if errRespWrite != nil {
-		err := errors.Wrap(errRespWrite, "could not write plaintext into client response")
-		h.logger.Fatalf("%+v", err)
+	decryptStart := time.Now()
+	length, err := io.Copy(resp, plaintext)
+	observePhase(phaseDecrypt, decryptStart)
+	rec.Bytes = length
+	if err != nil {
+		rec.Outcome = outcome(err)
+		abortResponse(h.logger, err, length)
 	}
 	h.logger.Debugf("writer length: %v", length)
+	return nil
+}
 
-	// the size of the file in the bucket is different due to encryption, so when decrypted, its size doesn't match what
-	// a client (i.e curl) might expect.  Avoids getting an error such as "(18) transfer closed with NN bytes remaining to read" where NN is the difference.
-	resp.Header().Add("Content-Length", string(length))
+// objectURL builds the storage XML API URL for the target object, with the query requested from the proxy
+func (h *handler) objectURL(t target, rawQuery string) string {
+	return h.config.Client.ObjectURL(t.Bucket, t.requestURI(rawQuery))
+}
+
+// kmsClient creates the client of the KMS backend holding keyURI, which must be in the KEK allow-list of the route
+func (h *handler) kmsClient(t target, keyURI string) (registry.KMSClient, error) {
+	kmsClient, err := t.KekAllowList.NewClient(keyURI)
+	if errors.Is(err, kms.ErrKekNotAllowed) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &data.Error{Kind: data.KindKMS, Err: err}
+	}
+	return kmsClient, nil
+}
+
+// bindAAD binds the engine to the associated data of the envelope of the target object.  The scheme of the envelope
+// must be as strong as the AAD mode of the route when the route enforces it.
+func bindAAD(ee *data.EncryptionEngine, b data.EncryptedData, t target) error {
+	if t.AADEnforce {
+		if err := data.CheckAADScheme(b.AADScheme, t.AADMode); err != nil {
+			return err
+		}
+	}
+	return ee.BindAAD(b.AADScheme, t.AAD, t.objectID())
+}
+
+// New returns a tink proxy handler.  Encryptions and decryptions are recorded in the audit log, when not nil.
+func New(c env.Config, client *http.Client, auditLog *audit.Log) http.Handler {
+	return newHandler(c, client, auditLog)
 }
 
-// New returns a tink proxy handler
-func New(c env.Config, client *http.Client) http.Handler {
+func newHandler(c env.Config, client *http.Client, auditLog *audit.Log) *handler {
 	logger := c.Logger()
-	return &handler{logger: logger, restClient: client, config: c}
+	return &handler{logger: logger, restClient: client, config: c, router: newRouter(c), audit: auditLog}
 }
 
 // from httputil
@@ -165,9 +388,9 @@ func copyReqHeader(dst, src http.Header) {
 func copyRespHeader(dst RespWrapper, src *http.Response) {
 	for k, vv := range src.Header {
 		for _, v := range vv {
-			// skip content length since encrypted and decrypted lengths will be different.
+			// skip content length and range since encrypted and decrypted lengths will be different.
 			// set it later after decryption
-			if strings.Contains(k, "Content-Length") {
+			if strings.Contains(k, "Content-Length") || k == "Content-Range" {
 				continue
 			}
 			dst.Header().Add(k, v)
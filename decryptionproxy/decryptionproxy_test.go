@@ -0,0 +1,781 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+)
+
+// fakeGCS keeps objects in memory, addressed path style as /<bucket>/<object>, with their x-goog-meta headers and
+// Content-Disposition
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]http.Header
+	reads    int // of objects, by GET or HEAD
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket, ok := jsonListBucket(r.URL.Path); ok {
+		f.jsonList(w, bucket, r.URL.Query().Get("prefix"))
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, strings.TrimSuffix(name, "/"), r.URL.Query().Get("prefix"))
+		return
+	}
+	if r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/storage/v1/b/") {
+		f.patch(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = b
+		f.metadata[name] = http.Header{}
+		for k, vv := range r.Header {
+			if strings.HasPrefix(k, "X-Goog-Meta-") || k == "Content-Disposition" {
+				f.metadata[name][k] = vv
+			}
+		}
+	case http.MethodGet, http.MethodHead:
+		f.reads++
+		b, ok := f.objects[name]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		for k, vv := range f.metadata[name] {
+			w.Header()[k] = vv
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Goog-Hash", "md5=ciphertext")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	case http.MethodDelete:
+		if _, ok := f.objects[name]; !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// patch updates the metadata of an object with the JSON API, /storage/v1/b/<bucket>/o/<object>
+func (f *fakeGCS) patch(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/")
+	i := strings.Index(path, "/o/")
+	if i < 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	name := path[:i] + "/" + path[i+len("/o/"):]
+	if _, ok := f.objects[name]; !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var patch struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for k, v := range patch.Metadata {
+		f.metadata[name].Set("X-Goog-Meta-"+k, v)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name})
+}
+
+// names returns the objects of the bucket under prefix, in name order
+func (f *fakeGCS) names(bucket string, prefix string) []string {
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, bucket+"/"+prefix) {
+			names = append(names, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// list answers ListObjectsV2 with the objects of the bucket under prefix
+func (f *fakeGCS) list(w http.ResponseWriter, bucket string, prefix string) {
+	names := f.names(bucket, prefix)
+	result := listBucketResult{Xmlns: "http://doc.s3.amazonaws.com/2006-03-01", Name: bucket, Prefix: prefix, KeyCount: len(names), MaxKeys: 1000}
+	for _, name := range names {
+		result.Contents = append(result.Contents, listEntry{Key: name, Size: int64(len(f.objects[bucket+"/"+name])), ETag: `"etag"`})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// jsonList answers objects.list with the objects of the bucket under prefix
+func (f *fakeGCS) jsonList(w http.ResponseWriter, bucket string, prefix string) {
+	list := objectsList{Kind: "storage#objects"}
+	for _, name := range f.names(bucket, prefix) {
+		item := map[string]interface{}{
+			"kind":    "storage#object",
+			"name":    name,
+			"bucket":  bucket,
+			"size":    strconv.Itoa(len(f.objects[bucket+"/"+name])),
+			"md5Hash": "ciphertext",
+		}
+		metadata := map[string]string{}
+		for k := range f.metadata[bucket+"/"+name] {
+			if strings.HasPrefix(k, "X-Goog-Meta-") {
+				metadata[strings.ToLower(strings.TrimPrefix(k, "X-Goog-Meta-"))] = f.metadata[bucket+"/"+name].Get(k)
+			}
+		}
+		if len(metadata) > 0 {
+			item["metadata"] = metadata
+		}
+		list.Items = append(list.Items, item)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// localKEK writes a master keyset in dir and returns its URI
+func localKEK(t *testing.T, dir string, name string) string {
+	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(f)); err != nil {
+		t.Fatal(err)
+	}
+	return "local://" + path
+}
+
+// testGCS starts a fake GCS, and returns the configuration of a proxy in front of it with a local KEK
+func testGCS(t *testing.T) (env.Config, *http.Client, *fakeGCS) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	gcs := &fakeGCS{objects: map[string][]byte{}, metadata: map[string]http.Header{}}
+	gcsServer := httptest.NewServer(gcs)
+	t.Cleanup(gcsServer.Close)
+	gcsURL, _ := url.Parse(gcsServer.URL)
+
+	kek := localKEK(t, dir, "master.json")
+	c := env.Config{
+		LogLevel:     "panic",
+		BucketName:   "bucket",
+		KmsMkekURI:   kek,
+		KekAllowList: kms.AllowList{kek},
+		AAD:          "aad",
+		AADMode:      "object",
+		Client:       env.ClientConfig{Endpoint: gcsURL.Host, Scheme: "http", PathStyle: true},
+		Proxy:        env.ProxyConfig{Timeout: 10 * time.Second},
+	}
+	return c, gcsServer.Client(), gcs
+}
+
+// testProxy starts the proxy in front of a fake GCS
+func testProxy(t *testing.T, configure func(c *env.Config)) (*httptest.Server, *fakeGCS) {
+	c, client, gcs := testGCS(t)
+	if configure != nil {
+		configure(&c)
+	}
+
+	var auditLog *audit.Log
+	if c.Proxy.AuditLogFile != "" {
+		key, err := audit.ReadKey(c.Proxy.AuditKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auditLog, err = audit.Open(c.Proxy.AuditLogFile, key); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { auditLog.Close() })
+	}
+
+	proxy := httptest.NewServer(Decorate(New(c, client, auditLog), RouteHandler(), ConstraintHandler(c.Logger())))
+	t.Cleanup(proxy.Close)
+	return proxy, gcs
+}
+
+func put(t *testing.T, rawurl string, body string, header ...string) int {
+	req, err := http.NewRequest(http.MethodPut, rawurl, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func get(t *testing.T, rawurl string, header http.Header) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestHandler_roundTrip(t *testing.T) {
+	proxy, gcs := testProxy(t, nil)
+
+	if status := put(t, proxy.URL+"/dir/four score.txt", "four score and seven years ago"); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	stored := gcs.objects["bucket/dir/four score.txt"]
+	if len(stored) == 0 || bytes.Contains(stored, []byte("four score")) {
+		t.Fatalf("object stored in the clear or not at all: %q", stored)
+	}
+	gcs.metadata["bucket/dir/four score.txt"].Set("ETag", `"v2"`)
+	gcs.metadata["bucket/dir/four score.txt"].Set("Last-Modified", "Mon, 01 Jun 2020 10:00:00 GMT")
+
+	tests := []struct {
+		name       string
+		path       string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+	}{
+		{"get", "/dir/four%20score.txt", nil, http.StatusOK, "four score and seven years ago"},
+		{"range", "/dir/four%20score.txt", http.Header{"Range": {"bytes=5-9"}}, http.StatusPartialContent, "score"},
+		{"resume", "/dir/four%20score.txt", http.Header{"Range": {"bytes=5-9"}, "If-Range": {`"v2"`}}, http.StatusPartialContent, "score"},
+		{"resume by date", "/dir/four%20score.txt", http.Header{"Range": {"bytes=5-9"}, "If-Range": {"Mon, 01 Jun 2020 10:00:00 GMT"}}, http.StatusPartialContent, "score"},
+		{"resume of a replaced object", "/dir/four%20score.txt", http.Header{"Range": {"bytes=5-9"}, "If-Range": {`"v1"`}}, http.StatusOK, "four score and seven years ago"},
+		{"resume of a modified object", "/dir/four%20score.txt", http.Header{"Range": {"bytes=5-9"}, "If-Range": {"Sun, 31 May 2020 10:00:00 GMT"}}, http.StatusOK, "four score and seven years ago"},
+		{"not found", "/dir/missing.txt", nil, http.StatusNotFound, "NoSuchKey\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, proxy.URL+tt.path, tt.header)
+			if status != tt.wantStatus || body != tt.wantBody {
+				t.Errorf("GET = %v %q, want %v %q", status, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+
+	// bound to its name, an object copied over another one does not decrypt.  Streams fail once the response started,
+	// so the connection is closed
+	gcs.objects["bucket/dir/copy.txt"] = stored
+	if resp, err := http.Get(proxy.URL + "/dir/copy.txt"); err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("GET copy status = %v, want an aborted response", resp.StatusCode)
+		}
+	}
+	gcs.objects["bucket/plain.txt"] = []byte("plaintext")
+	if status, _ := get(t, proxy.URL+"/plain.txt", nil); status != http.StatusBadRequest {
+		t.Errorf("GET plaintext status = %v, want %v", status, http.StatusBadRequest)
+	}
+}
+
+// sealObject encrypts plaintext into an envelope bound to the object with the AAD scheme given, describing the file
+// with attrs as vanish does
+func sealObject(t *testing.T, c env.Config, scheme string, object string, plaintext string, attrs data.FileAttributes) []byte {
+	kmsClient, err := kms.NewClient(c.KmsMkekURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ee := data.NewEncryptionEngine(c.KmsMkekURI, "", kmsClient, c.Logger())
+	if err := ee.BindAAD(scheme, c.AAD, data.ObjectID{Bucket: c.BucketName, Object: object}); err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := ee.PackageStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.FileAttributes = attrs
+	if err := ee.SealMetadata(&envelope, nil); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := data.WriteEnvelope(&buf, envelope); err != nil {
+		t.Fatal(err)
+	}
+	w, err := ee.ObfuscateStream(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(plaintext))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandler_aadDowngrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		scheme     string
+		enforce    bool
+		wantStatus int
+	}{
+		{"object written before aad modes", "", false, http.StatusOK},
+		{"static object", data.AADSchemeStatic, false, http.StatusOK},
+		{"object written before aad modes, enforced", "", true, http.StatusBadGateway},
+		{"static object, enforced", data.AADSchemeStatic, true, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config env.Config
+			proxy, gcs := testProxy(t, func(c *env.Config) {
+				c.AADEnforce = tt.enforce
+				config = *c
+			})
+
+			// an envelope not bound to its name decrypts wherever it is copied
+			gcs.objects["bucket/copy.txt"] = sealObject(t, config, tt.scheme, "original.txt", "swapped", data.FileAttributes{})
+			if status, _ := get(t, proxy.URL+"/copy.txt", nil); status != tt.wantStatus {
+				t.Errorf("GET copy status = %v, want %v", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandler_routes(t *testing.T) {
+	var financeKEK string
+	proxy, gcs := testProxy(t, func(c *env.Config) {
+		financeKEK = localKEK(t, filepath.Dir(strings.TrimPrefix(c.KmsMkekURI, "local://")), "finance.json")
+		c.BucketPaths = true
+		c.Routes = []env.Route{
+			{Prefix: "/finance/", Bucket: "fin", ObjectPrefix: "reports/", KmsMkekURI: financeKEK,
+				KekAllowList: kms.AllowList{financeKEK}, AAD: "finance", AADMode: "object"},
+			{Bucket: "logs", KmsMkekURI: c.KmsMkekURI, KekAllowList: c.KekAllowList, AAD: "logs", AADMode: "object"},
+		}
+	})
+
+	if status := put(t, proxy.URL+"/finance/q1.txt", "q1"); status != http.StatusOK {
+		t.Fatalf("PUT finance status = %v", status)
+	}
+	if status := put(t, proxy.URL+"/b/logs/01.log", "log"); status != http.StatusOK {
+		t.Fatalf("PUT logs status = %v", status)
+	}
+	if _, ok := gcs.objects["fin/reports/q1.txt"]; !ok {
+		t.Fatalf("finance object not in its bucket, have %v", gcs.objects)
+	}
+	if !bytes.Contains(gcs.objects["fin/reports/q1.txt"], []byte(financeKEK)) {
+		t.Errorf("finance object not wrapped with the finance KEK")
+	}
+
+	// the finance KEK is not allowed outside of its route
+	gcs.objects["bucket/q1.txt"] = gcs.objects["fin/reports/q1.txt"]
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"prefix", "/finance/q1.txt", http.StatusOK, "q1"},
+		{"bucket path", "/b/logs/01.log", http.StatusOK, "log"},
+		{"KEK of another route", "/q1.txt", http.StatusForbidden, ""},
+		{"unknown bucket", "/b/other/01.log", http.StatusNotFound, ""},
+		{"bucket root", "/b/logs/", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, proxy.URL+tt.path, nil)
+			if status != tt.wantStatus || (tt.wantBody != "" && body != tt.wantBody) {
+				t.Errorf("GET = %v %q, want %v %q", status, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandler_list(t *testing.T) {
+	proxy, gcs := testProxy(t, func(c *env.Config) {
+		c.Proxy.ListEnvelopesOnly = true
+	})
+
+	for name, plaintext := range map[string]string{"docs/a.txt.enc": "four score", "docs/b.txt": "and seven years ago"} {
+		if status := put(t, proxy.URL+"/"+name, plaintext); status != http.StatusOK {
+			t.Fatalf("PUT %s status = %v", name, status)
+		}
+	}
+	gcs.objects["bucket/docs/plain.txt"] = []byte("not an envelope")
+	want := map[string]int64{"docs/a.txt": 10, "docs/b.txt": 19}
+
+	t.Run("xml", func(t *testing.T) {
+		status, body := get(t, proxy.URL+"/?list-type=2&prefix=docs/", nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET status = %v: %s", status, body)
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]int64{}
+		for _, entry := range result.Contents {
+			got[entry.Key] = entry.Size
+		}
+		if !reflect.DeepEqual(got, want) || result.KeyCount != len(want) {
+			t.Errorf("ListObjectsV2 = %v, %d keys, want %v %s", got, result.KeyCount, want, body)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		status, body := get(t, proxy.URL+"/storage/v1/b/bucket/o?prefix=docs/", nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET status = %v: %s", status, body)
+		}
+		var list objectsList
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]int64{}
+		for _, item := range list.Items {
+			got[item["name"].(string)], _ = strconv.ParseInt(item["size"].(string), 10, 64)
+			if _, ok := item["md5Hash"]; ok {
+				t.Errorf("objects.list relayed the checksum of the ciphertext")
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("objects.list = %v, want %v", got, want)
+		}
+	})
+
+	// names are listed without the .enc suffix, and found without it
+	if status, body := get(t, proxy.URL+"/docs/a.txt", nil); status != http.StatusOK || body != "four score" {
+		t.Errorf("GET without suffix = %v %q", status, body)
+	}
+	if status, body := get(t, proxy.URL+"/docs/a.txt", http.Header{"Range": {"bytes=5-9"}}); status != http.StatusPartialContent || body != "score" {
+		t.Errorf("GET range without suffix = %v %q", status, body)
+	}
+}
+
+func TestHandler_listRecordedSizes(t *testing.T) {
+	tests := []struct {
+		name      string
+		probe     bool
+		wantSizes map[string]int64
+		wantReads int
+	}{
+		{"recorded", false, map[string]int64{"docs/a.txt": 10, "docs/copy.txt": -1}, 0},
+		{"probed", true, map[string]int64{"docs/a.txt": 10, "docs/copy.txt": 10}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, gcs := testProxy(t, func(c *env.Config) {
+				c.Proxy.ListProbeEnvelopes = tt.probe
+			})
+			if status := put(t, proxy.URL+"/docs/a.txt", "four score"); status != http.StatusOK {
+				t.Fatalf("PUT status = %v", status)
+			}
+			// stored without the metadata of the proxy, e.g by vanish
+			gcs.objects["bucket/docs/copy.txt"] = gcs.objects["bucket/docs/a.txt"]
+			gcs.metadata["bucket/docs/copy.txt"] = http.Header{}
+			if tt.wantSizes["docs/copy.txt"] < 0 {
+				tt.wantSizes["docs/copy.txt"] = int64(len(gcs.objects["bucket/docs/copy.txt"]))
+			}
+			gcs.reads = 0
+
+			status, body := get(t, proxy.URL+"/storage/v1/b/bucket/o?prefix=docs/", nil)
+			if status != http.StatusOK {
+				t.Fatalf("GET status = %v: %s", status, body)
+			}
+			var list objectsList
+			if err := json.Unmarshal([]byte(body), &list); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]int64{}
+			for _, item := range list.Items {
+				got[item["name"].(string)], _ = strconv.ParseInt(item["size"].(string), 10, 64)
+			}
+			if !reflect.DeepEqual(got, tt.wantSizes) {
+				t.Errorf("objects.list = %v, want %v", got, tt.wantSizes)
+			}
+			if gcs.reads != tt.wantReads {
+				t.Errorf("objects.list read %d objects, want %d", gcs.reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestHandler_head(t *testing.T) {
+	var config env.Config
+	proxy, gcs := testProxy(t, func(c *env.Config) { config = *c })
+	plaintext := "four score and seven years ago"
+	sum := md5.Sum([]byte(plaintext))
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	if status := put(t, proxy.URL+"/speech.txt", plaintext, "Content-Type", "text/plain", "Content-MD5", contentMD5); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	if status := put(t, proxy.URL+"/corrupted.txt", plaintext, "Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, 16))); status != http.StatusBadRequest {
+		t.Errorf("PUT with a bad Content-MD5 status = %v, want %v", status, http.StatusBadRequest)
+	}
+	if _, ok := gcs.objects["bucket/corrupted.txt"]; ok {
+		t.Errorf("PUT with a bad Content-MD5 was stored")
+	}
+
+	for k, vv := range gcs.metadata["bucket/speech.txt"] {
+		if strings.Contains(strings.Join(vv, ","), contentMD5) {
+			t.Errorf("the md5 of the plaintext is stored in the clear in %s", k)
+		}
+	}
+
+	// stored without the metadata of the proxy, e.g by vanish
+	gcs.objects["bucket/copy.txt"] = sealObject(t, config, config.AADMode, "copy.txt", plaintext, data.FileAttributes{ContentType: "text/plain"})
+	gcs.metadata["bucket/copy.txt"] = http.Header{}
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		wantLength      int64
+		wantContentType string
+		wantMD5         bool
+	}{
+		{"head", http.MethodHead, "/speech.txt", int64(len(plaintext)), "text/plain", true},
+		{"head from envelope", http.MethodHead, "/copy.txt", int64(len(plaintext)), "text/plain", false},
+		{"get", http.MethodGet, "/speech.txt", int64(len(plaintext)), "text/plain", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, proxy.URL+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ContentLength != tt.wantLength {
+				t.Errorf("status, Content-Length = %v, %v, want 200, %v", resp.StatusCode, resp.ContentLength, tt.wantLength)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %v, want %v", got, tt.wantContentType)
+			}
+			if got := strings.Contains(resp.Header.Get("X-Goog-Hash"), "md5="+contentMD5); got != tt.wantMD5 {
+				t.Errorf("X-Goog-Hash = %v, want the md5 of the plaintext %v", resp.Header.Get("X-Goog-Hash"), tt.wantMD5)
+			}
+			for k := range resp.Header {
+				if strings.HasPrefix(k, metaPrefix) {
+					t.Errorf("metadata of the proxy relayed: %s", k)
+				}
+			}
+		})
+	}
+
+	// the digest is sealed for its own object
+	if status := put(t, proxy.URL+"/other.txt", "other"); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	gcs.metadata["bucket/other.txt"].Set(metaDigest, gcs.metadata["bucket/speech.txt"].Get(metaDigest))
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, _ := http.NewRequest(method, proxy.URL+"/other.txt", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s with the digest of another object status = %v, want %v", method, resp.StatusCode, http.StatusBadGateway)
+		}
+	}
+}
+
+func TestHandler_fileAttributes(t *testing.T) {
+	var config env.Config
+	proxy, gcs := testProxy(t, func(c *env.Config) { config = *c })
+	plaintext := "# minutes"
+
+	if status := put(t, proxy.URL+"/notes", plaintext, "Content-Type", "text/markdown", "Content-Disposition", `attachment; filename="../notes.md"`); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	if status := put(t, proxy.URL+"/minutes.txt.enc", plaintext); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	if b, _, _ := data.ReadEnvelope(bufio.NewReader(bytes.NewReader(gcs.objects["bucket/notes"]))); b.Metadata == "" {
+		t.Errorf("envelope metadata empty, want the attributes sent encrypted")
+	}
+	if bytes.Contains(gcs.objects["bucket/notes"], []byte("notes.md")) || bytes.Contains(gcs.objects["bucket/notes"], []byte("text/markdown")) {
+		t.Errorf("the file attributes are stored in the clear")
+	}
+	for k, vv := range gcs.metadata["bucket/notes"] {
+		if v := strings.Join(vv, ","); strings.Contains(v, "notes.md") || strings.Contains(v, "text/markdown") {
+			t.Errorf("the file attributes are stored in the clear in %s: %s", k, v)
+		}
+	}
+
+	// as written by vanish: without the metadata of the proxy, the file described in the envelope
+	gcs.objects["bucket/minutes.txt.enc"] = sealObject(t, config, config.AADMode, "minutes.txt.enc", plaintext,
+		data.FileAttributes{ContentType: "text/plain", FileName: "minutes.txt", Mode: 0640, ModTime: "2020-06-01T12:00:00Z"})
+	gcs.metadata["bucket/minutes.txt.enc"] = http.Header{}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		want   http.Header
+	}{
+		{"get", http.MethodGet, "/notes", nil, http.Header{
+			"Content-Type":        {"text/markdown"},
+			"Content-Disposition": {"attachment; filename=notes.md"},
+		}},
+		{"head", http.MethodHead, "/notes", nil, http.Header{
+			"Content-Type":        {"text/markdown"},
+			"Content-Disposition": {"attachment; filename=notes.md"},
+		}},
+		{"get vanished", http.MethodGet, "/minutes.txt.enc", nil, http.Header{
+			"Content-Type":        {"text/plain"},
+			"Content-Disposition": {"inline; filename=minutes.txt"},
+			fileModeHeader:        {"0640"},
+			fileMtimeHeader:       {"2020-06-01T12:00:00Z"},
+		}},
+		{"head vanished", http.MethodHead, "/minutes.txt.enc", nil, http.Header{
+			"Content-Type":  {"text/plain"},
+			fileModeHeader:  {"0640"},
+			fileMtimeHeader: {"2020-06-01T12:00:00Z"},
+		}},
+		{"range vanished", http.MethodGet, "/minutes.txt.enc", http.Header{"Range": {"bytes=2-"}}, http.Header{
+			"Content-Type":  {"text/plain"},
+			fileModeHeader:  {"0640"},
+			fileMtimeHeader: {"2020-06-01T12:00:00Z"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, proxy.URL+tt.path, nil)
+			for k, vv := range tt.header {
+				req.Header[k] = vv
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				t.Fatalf("status = %v", resp.StatusCode)
+			}
+			for k := range tt.want {
+				if got := resp.Header.Get(k); got != tt.want.Get(k) {
+					t.Errorf("%s = %q, want %q", k, got, tt.want.Get(k))
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_sealedMetadata(t *testing.T) {
+	proxy, gcs := testProxy(t, nil)
+	plaintext := "blood type: O negative"
+
+	if status := put(t, proxy.URL+"/chart.txt", plaintext, "X-Goog-Meta-Patient-Id", "12345", "X-Goog-Meta-Ward", "B"); status != http.StatusOK {
+		t.Fatalf("PUT status = %v", status)
+	}
+	for k, vv := range gcs.metadata["bucket/chart.txt"] {
+		if !strings.HasPrefix(k, metaPrefix) {
+			t.Errorf("metadata stored in the clear: %s: %v", k, vv)
+		}
+	}
+	if b, _, _ := data.ReadEnvelope(bufio.NewReader(bytes.NewReader(gcs.objects["bucket/chart.txt"]))); b.Metadata == "" || strings.Contains(b.Metadata, "12345") {
+		t.Errorf("envelope metadata = %q, want it encrypted", b.Metadata)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+	}{
+		{"get", http.MethodGet, nil},
+		{"head", http.MethodHead, nil},
+		{"range", http.MethodGet, http.Header{"Range": {"bytes=0-4"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, proxy.URL+"/chart.txt", nil)
+			for k, vv := range tt.header {
+				req.Header[k] = vv
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				t.Fatalf("status = %v", resp.StatusCode)
+			}
+			if got := resp.Header.Get("X-Goog-Meta-Patient-Id"); got != "12345" {
+				t.Errorf("x-goog-meta-patient-id = %q, want %q", got, "12345")
+			}
+			if got := resp.Header.Get("X-Goog-Meta-Ward"); got != "B" {
+				t.Errorf("x-goog-meta-ward = %q, want %q", got, "B")
+			}
+		})
+	}
+}
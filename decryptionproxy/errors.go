@@ -0,0 +1,66 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusFor maps failures of the data package to the status reported to the client.  None of them stop the proxy.
+//   - KMS unavailable or denied is 503, the client may retry
+//   - an object failing authentication is 502, GCS returned something that cannot be trusted
+//   - an object that is not an envelope is 400, most likely a bad object name
+//   - an object naming a KEK missing from the allow-list is 403
+//   - a plaintext not matching the checksum sent with it is 400
+func statusFor(err error) int {
+	if errors.Is(err, kms.ErrKekNotAllowed) || errors.Is(err, errForbidden) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, errBadDigest) || errors.Is(err, errObjectName) {
+		return http.StatusBadRequest
+	}
+	switch data.KindOf(err) {
+	case data.KindKMS:
+		return http.StatusServiceUnavailable
+	case data.KindIntegrity:
+		return http.StatusBadGateway
+	case data.KindEnvelope:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// replyError reports the error to the client and records the status for logging
+func replyError(resp *RespWrapper, err error, status int) {
+	http.Error(resp, err.Error(), status)
+	resp.Status = status
+}
+
+// abortResponse ends a response whose status has already been sent.  The connection is cut so the client cannot
+// mistake the truncated body for the whole object.
+func abortResponse(logger *logrus.Logger, err error, written int64) {
+	logger.WithError(err).Errorf("response aborted after %d bytes %+v", written, err)
+	panic(http.ErrAbortHandler)
+}
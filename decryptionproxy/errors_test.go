@@ -0,0 +1,50 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+)
+
+func Test_statusFor(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"kms", &data.Error{Kind: data.KindKMS, Err: errors.New("unavailable")}, http.StatusServiceUnavailable},
+		{"integrity", &data.Error{Kind: data.KindIntegrity, Err: errors.New("bad tag")}, http.StatusBadGateway},
+		{"envelope", &data.Error{Kind: data.KindEnvelope, Err: errors.New("not json")}, http.StatusBadRequest},
+		{"wrapped", errors.Wrap(&data.Error{Kind: data.KindKMS, Err: errors.New("denied")}, "cannot unwrap"), http.StatusServiceUnavailable},
+		{"kek not allowed", kms.AllowList{}.Check("local://other.json"), http.StatusForbidden},
+		{"forbidden by policy", errors.Wrap(errForbidden, "GET bucket/a.txt"), http.StatusForbidden},
+		{"other", errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusFor(tt.err); got != tt.want {
+				t.Errorf("statusFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
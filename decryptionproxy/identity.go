@@ -0,0 +1,79 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	Method  string                 // how the client was authenticated, "mtls", "jwt" or "sigv4"
+	Subject string                 // distinguished name of the client certificate, subject of the token, or access key id
+	SANs    []string               // subject alternative names: DNS names, email addresses, URIs and IP addresses
+	Claims  map[string]interface{} // of the bearer token
+}
+
+// Name returns the first subject alternative name of the client, or its subject when it has none
+func (id Identity) Name() string {
+	if len(id.SANs) > 0 {
+		return id.SANs[0]
+	}
+	return id.Subject
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity of the client
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity of the client attached to the request context, if it was authenticated
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// ClientCertHandler middleware attaches the identity of the client certificate verified by the TLS handshake to the
+// request context, see env.ProxyConfig ClientCAFile.  Requests without one are passed on as they are.
+func ClientCertHandler() Decorator {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+				id := certIdentity(r.TLS.VerifiedChains[0][0])
+				r = r.WithContext(WithIdentity(r.Context(), id))
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+func certIdentity(cert *x509.Certificate) Identity {
+	id := Identity{Method: "mtls", Subject: cert.Subject.String()}
+	id.SANs = append(id.SANs, cert.DNSNames...)
+	id.SANs = append(id.SANs, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		id.SANs = append(id.SANs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, ip.String())
+	}
+	return id
+}
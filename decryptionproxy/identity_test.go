@@ -0,0 +1,161 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+// testDir creates a temporary directory removed at the end of the test
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// testCert issues a certificate for template, signed by parent, or self signed when parent is nil
+func testCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertHandler(t *testing.T) {
+	ca := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	spiffe, _ := url.Parse("spiffe://example.org/reporting")
+	client := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "reporting", Organization: []string{"Example"}},
+		URIs:        []*url.URL{spiffe},
+		DNSNames:    []string{"reporting.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	stranger := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "stranger"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	caFile := filepath.Join(testDir(t), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := env.ProxyConfig{ClientCAFile: caFile}.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(Decorate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := IdentityFrom(r.Context())
+		fmt.Fprintf(w, "%v %s %s %v", ok, id.Method, id.Subject, id.SANs)
+	}), ClientCertHandler()))
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		certs    []tls.Certificate
+		wantErr  bool
+		wantBody string
+	}{
+		{"client certificate", []tls.Certificate{client}, false,
+			"true mtls CN=reporting,O=Example [reporting.example.org spiffe://example.org/reporting]"},
+		{"no certificate", nil, true, ""},
+		{"untrusted certificate", []tls.Certificate{stranger}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := server.Client()
+			transport := c.Transport.(*http.Transport).Clone()
+			// sent even when not issued by a CA the proxy accepts
+			transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(tt.certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &tt.certs[0], nil
+			}
+			c.Transport = transport
+
+			resp, err := c.Get(server.URL + "/object")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GET error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("identity = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+
+	t.Run("without TLS", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		ClientCertHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := IdentityFrom(r.Context()); ok {
+				t.Errorf("identity attached to a request without a client certificate")
+			}
+		})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/object", nil))
+	})
+}
@@ -0,0 +1,310 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	// hashes of the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+// jwtLeeway is the clock skew allowed when checking the expiry and not before times of a token
+const jwtLeeway = time.Minute
+
+// jwtAlgorithm verifies the signatures of a JWS algorithm
+type jwtAlgorithm struct {
+	hash   crypto.Hash
+	curve  elliptic.Curve // for ECDSA
+	verify func(key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) bool
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256, verify: verifyPKCS1},
+	"RS384": {hash: crypto.SHA384, verify: verifyPKCS1},
+	"RS512": {hash: crypto.SHA512, verify: verifyPKCS1},
+	"PS256": {hash: crypto.SHA256, verify: verifyPSS},
+	"PS384": {hash: crypto.SHA384, verify: verifyPSS},
+	"PS512": {hash: crypto.SHA512, verify: verifyPSS},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256(), verify: verifyECDSA},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384(), verify: verifyECDSA},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521(), verify: verifyECDSA},
+}
+
+// jwk is a public key of a JSON Web Key Set, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// jwtVerifier checks bearer tokens offline, against the keys of the issuer
+type jwtVerifier struct {
+	keys     []jwk
+	audience string
+	issuer   string
+	now      func() time.Time
+}
+
+// errInvalidToken is returned for every token which cannot be trusted, the cause is only logged
+var errInvalidToken = errors.New("invalid bearer token")
+
+// JWTHandler middleware rejects requests without a valid bearer JWT, before anything is asked of GCS or KMS.  The
+// token must be signed by a key of the JWKS file, be current, name the audience and, when configured, the issuer of
+// the proxy.  The subject and claims of the token are attached to the request context, see IdentityFrom.
+func JWTHandler(c env.ProxyConfig, logger *logrus.Logger) (Decorator, error) {
+	v, err := newJWTVerifier(c)
+	if err != nil {
+		return nil, err
+	}
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := v.verify(r.Header.Get("Authorization"))
+			if err != nil {
+				logger.WithError(err).Errorf("%s %s: rejected bearer token", r.Method, r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, errInvalidToken.Error(), http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+		})
+	}, nil
+}
+
+func newJWTVerifier(c env.ProxyConfig) (*jwtVerifier, error) {
+	if c.JWTAudience == "" {
+		return nil, errors.New("bearer tokens require TINKPROXY_PROXY_JWT_AUDIENCE")
+	}
+	b, err := ioutil.ReadFile(c.JWKSFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read JWKS file")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.Wrap(err, "malformed JWKS file")
+	}
+
+	v := &jwtVerifier{audience: c.JWTAudience, issuer: c.JWTIssuer, now: time.Now}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.key, err = k.publicKey(); err != nil {
+			return nil, errors.Wrapf(err, "key %q of the JWKS file", k.Kid)
+		}
+		v.keys = append(v.keys, k)
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.Errorf("no signing key in JWKS file %s", c.JWKSFile)
+	}
+	return v, nil
+}
+
+// publicKey decodes the RSA or EC public key of the JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, errN := b64Int(k.N)
+		e, errE := b64Int(k.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return nil, errors.New("malformed RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := b64Int(k.X)
+		y, errY := b64Int(k.Y)
+		if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("malformed EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verify checks the bearer token of the Authorization header, and returns the identity it asserts
+func (v *jwtVerifier) verify(authorization string) (Identity, error) {
+	const prefix = "Bearer "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return Identity{}, errors.New("no bearer token")
+	}
+	parts := strings.Split(strings.TrimSpace(authorization[len(prefix):]), ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("not a signed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := b64JSON(parts[0], &header); err != nil {
+		return Identity{}, errors.Wrap(err, "malformed header")
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return Identity{}, errors.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "malformed signature")
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	verified := false
+	for _, k := range v.keys {
+		if (header.Kid != "" && k.Kid != header.Kid) || (k.Alg != "" && k.Alg != header.Alg) {
+			continue
+		}
+		if ec, ok := k.key.(*ecdsa.PublicKey); ok && ec.Curve != alg.curve {
+			continue
+		}
+		if alg.verify(k.key, alg.hash, digest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Identity{}, errors.Errorf("no key %q verifies the %s signature", header.Kid, header.Alg)
+	}
+
+	claims := map[string]interface{}{}
+	if err := b64JSON(parts[1], &claims); err != nil {
+		return Identity{}, errors.Wrap(err, "malformed claims")
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return Identity{}, err
+	}
+	sub, _ := claims["sub"].(string)
+	return Identity{Method: "jwt", Subject: sub, Claims: claims}, nil
+}
+
+// checkClaims checks the token is current and meant for the proxy
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}) error {
+	now := v.now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return errors.New("token without expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.Errorf("token expired at %v", exp)
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(jwtLeeway).Before(nbf) {
+		return errors.Errorf("token not valid before %v", nbf)
+	}
+
+	var audiences []interface{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []interface{}{aud}
+	case []interface{}:
+		audiences = aud
+	}
+	found := false
+	for _, aud := range audiences {
+		found = found || aud == v.audience
+	}
+	if !found {
+		return errors.Errorf("token for audience %v", claims["aud"])
+	}
+	if iss, _ := claims["iss"].(string); v.issuer != "" && iss != v.issuer {
+		return errors.Errorf("token issued by %q", iss)
+	}
+	return nil
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+func verifyPKCS1(key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) bool {
+	k, ok := key.(*rsa.PublicKey)
+	return ok && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+}
+
+func verifyPSS(key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) bool {
+	k, ok := key.(*rsa.PublicKey)
+	return ok && rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+}
+
+// verifyECDSA checks a JWS ECDSA signature, the big endian r and s each padded to the size of the curve
+func verifyECDSA(key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) bool {
+	k, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+	size := (k.Curve.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	return ecdsa.Verify(k, digest, r, s)
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("malformed integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func b64JSON(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -0,0 +1,200 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+
+	"github.com/sirupsen/logrus"
+)
+
+// signJWT signs the claims with the key, RS256 for RSA keys and ES256 for EC keys
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		copy(sig[32-len(r.Bytes()):32], r.Bytes())
+		copy(sig[64-len(s.Bytes()):], s.Bytes())
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logger
+}
+
+func b64(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func TestJWTHandler(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+	}})
+	jwksFile := filepath.Join(testDir(t), "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := env.ProxyConfig{JWKSFile: jwksFile, JWTAudience: "tinkproxy", JWTIssuer: "https://issuer.example.org"}
+	decorator, err := JWTHandler(c, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served *Identity
+	handler := decorator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := IdentityFrom(r.Context())
+		served = &id
+	}))
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "reporting", "aud": "tinkproxy", "iss": "https://issuer.example.org", "exp": now + 300, "team": "finance"}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"rsa", "Bearer " + signJWT(t, rsaKey, "rsa", claims(nil)), http.StatusOK},
+		{"ec", "Bearer " + signJWT(t, ecKey, "ec", claims(nil)), http.StatusOK},
+		{"without kid", "Bearer " + signJWT(t, ecKey, "", claims(nil)), http.StatusOK},
+		{"audience list", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": []string{"other", "tinkproxy"}})), http.StatusOK},
+		{"no token", "", http.StatusUnauthorized},
+		{"basic auth", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"not a JWT", "Bearer abc", http.StatusUnauthorized},
+		{"unknown key", "Bearer " + signJWT(t, otherKey, "ec", claims(nil)), http.StatusUnauthorized},
+		{"key of another kid", "Bearer " + signJWT(t, ecKey, "rsa", claims(nil)), http.StatusUnauthorized},
+		{"expired", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": now - 3600})), http.StatusUnauthorized},
+		{"no expiry", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": nil})), http.StatusUnauthorized},
+		{"not yet valid", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"nbf": now + 3600})), http.StatusUnauthorized},
+		{"other audience", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": "other"})), http.StatusUnauthorized},
+		{"no audience", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": nil})), http.StatusUnauthorized},
+		{"other issuer", "Bearer " + signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.example.org"})), http.StatusUnauthorized},
+		{"alg none", "Bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"reporting","aud":"tinkproxy","exp":9999999999}`)) + ".", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served = nil
+			req := httptest.NewRequest(http.MethodGet, "/object", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if served != nil {
+					t.Errorf("request with an invalid token reached the proxy")
+				}
+				if rec.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("no WWW-Authenticate challenge")
+				}
+				return
+			}
+			if served == nil || served.Method != "jwt" || served.Name() != "reporting" || served.Claims["team"] != "finance" {
+				t.Errorf("identity = %+v", served)
+			}
+		})
+	}
+}
+
+func TestJWTHandler_config(t *testing.T) {
+	dir := testDir(t)
+	empty := filepath.Join(dir, "empty.json")
+	ioutil.WriteFile(empty, []byte(`{"keys":[{"kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"}]}`), 0600)
+
+	tests := []struct {
+		name string
+		c    env.ProxyConfig
+	}{
+		{"no audience", env.ProxyConfig{JWKSFile: empty}},
+		{"missing JWKS", env.ProxyConfig{JWKSFile: filepath.Join(dir, "missing.json"), JWTAudience: "tinkproxy"}},
+		{"no signing key", env.ProxyConfig{JWKSFile: empty, JWTAudience: "tinkproxy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := JWTHandler(tt.c, quietLogger()); err == nil {
+				t.Errorf("JWTHandler() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+
+	"github.com/sirupsen/logrus"
+)
+
+// namespaces of the XML documents of S3, and of the GCS XML API which answers with the same documents
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	gcsNamespace = "http://doc.s3.amazonaws.com/2006-03-01"
+)
+
+// encSuffix ends the names of files encrypted by vanish.  Listings hide it, and objects are found with or without it.
+const encSuffix = ".enc"
+
+// statConcurrency bounds the envelopes read at once for a listing
+const statConcurrency = 8
+
+// listBucketResult answers a ListObjectsV2 request, list-type=2, in the XML API
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr,omitempty"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []listEntry    `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass,omitempty"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listParams are the parameters of ListObjectsV2 relayed to GCS.  Prefixes are relative to the route.
+var listParams = []string{"prefix", "delimiter", "max-keys", "continuation-token", "start-after"}
+
+// listObjects lists the objects of the route with ListObjectsV2, the names relative to the object prefix of the route.
+// When GCS fails, its response is returned to be relayed and must be closed.
+func (h *handler) listObjects(ctx context.Context, t target, query url.Values) (listBucketResult, *http.Response, error) {
+	gcsQuery := url.Values{"list-type": {"2"}}
+	for _, name := range listParams {
+		if v := query.Get(name); v != "" {
+			gcsQuery.Set(name, v)
+		}
+	}
+	if t.ObjectPrefix != "" {
+		gcsQuery.Set("prefix", t.ObjectPrefix+query.Get("prefix"))
+		if v := query.Get("start-after"); v != "" {
+			gcsQuery.Set("start-after", t.ObjectPrefix+v)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.config.Proxy.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, h.objectURL(target{Route: t.Route}, gcsQuery.Encode()), nil)
+	if err != nil {
+		return listBucketResult{}, nil, err
+	}
+	gcsResp, err := h.restClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return listBucketResult{}, nil, errors.Wrap(err, "cannot list objects in GCS")
+	}
+	if gcsResp.StatusCode != http.StatusOK {
+		gcsResp, err = buffered(gcsResp)
+		return listBucketResult{}, gcsResp, err
+	}
+	defer gcsResp.Body.Close()
+
+	var result listBucketResult
+	if err := xml.NewDecoder(gcsResp.Body).Decode(&result); err != nil {
+		return listBucketResult{}, nil, errors.Wrap(err, "unexpected listing from GCS")
+	}
+
+	result.Prefix = query.Get("prefix")
+	result.StartAfter = query.Get("start-after")
+	return result, nil, nil
+}
+
+// plaintextList shows the objects of a ListObjectsV2 result as their plaintext, named relative to the route.  See
+// plaintextListing.
+func (h *handler) plaintextList(ctx context.Context, r *http.Request, t target, result *listBucketResult) {
+	names := make([]string, len(result.Contents))
+	sizes := make([]int64, len(result.Contents))
+	for i, entry := range result.Contents {
+		names[i], sizes[i] = entry.Key, entry.Size
+	}
+	// ListObjectsV2 does not return the metadata of the objects
+	shown := h.plaintextListing(ctx, r, t.Route, names, sizes, make([]bool, len(names)))
+
+	contents := result.Contents[:0]
+	for i, entry := range result.Contents {
+		if !shown[i].keep {
+			continue
+		}
+		entry.Key, entry.Size = shown[i].name, shown[i].size
+		contents = append(contents, entry)
+	}
+	result.Contents = contents
+	for i := range result.CommonPrefixes {
+		result.CommonPrefixes[i].Prefix = strings.TrimPrefix(result.CommonPrefixes[i].Prefix, t.ObjectPrefix)
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+}
+
+// serveList answers ListObjectsV2 on the root of a route
+func (h *handler) serveList(w http.ResponseWriter, r *http.Request, t target) {
+	resp := RespWrapper{
+		Status:         http.StatusOK,
+		ResponseWriter: w,
+	}
+
+	result, gcsResp, err := h.listObjects(r.Context(), t, r.URL.Query())
+	if err != nil {
+		h.listFailed(&resp, err)
+		return
+	}
+	if gcsResp != nil {
+		h.relay(resp, gcsResp)
+		return
+	}
+
+	h.plaintextList(r.Context(), r, t, &result)
+	result.Xmlns = gcsNamespace
+	writeXML(w, http.StatusOK, result)
+}
+
+// objectsList answers objects.list in the JSON API.  Objects are kept as maps, to relay all their fields.
+type objectsList struct {
+	Kind          string                   `json:"kind"`
+	NextPageToken string                   `json:"nextPageToken,omitempty"`
+	Prefixes      []string                 `json:"prefixes,omitempty"`
+	Items         []map[string]interface{} `json:"items,omitempty"`
+}
+
+// jsonListParams are the parameters of objects.list relayed to GCS
+var jsonListParams = []string{"prefix", "delimiter", "pageToken", "maxResults", "startOffset", "endOffset", "includeTrailingDelimiter", "projection"}
+
+// jsonListBucket returns the bucket of an objects.list path, /storage/v1/b/<bucket>/o
+func jsonListBucket(path string) (string, bool) {
+	const prefix, suffix = "/storage/v1/b/", "/o"
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) || len(path) <= len(prefix)+len(suffix) {
+		return "", false
+	}
+	bucket := path[len(prefix) : len(path)-len(suffix)]
+	return bucket, !strings.Contains(bucket, "/")
+}
+
+// serveJSONList answers objects.list of the JSON API for one of the buckets served, see router.buckets
+func (h *handler) serveJSONList(w http.ResponseWriter, r *http.Request, bucket string) {
+	resp := RespWrapper{
+		Status:         http.StatusOK,
+		ResponseWriter: w,
+	}
+	rt, ok := h.router.buckets[bucket]
+	if !ok {
+		replyError(&resp, errors.Wrapf(errNoRoute, "bucket %s", bucket), http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if err := authorize(r, methodList, listingTarget(target{Route: rt}, query.Get("prefix"))); err != nil {
+		replyError(&resp, errors.Cause(err), statusFor(err))
+		return
+	}
+	gcsQuery := url.Values{}
+	for _, name := range jsonListParams {
+		if v := query.Get(name); v != "" {
+			gcsQuery.Set(name, v)
+		}
+	}
+	for _, name := range []string{"prefix", "startOffset", "endOffset"} {
+		if v := gcsQuery.Get(name); v != "" || (name == "prefix" && rt.ObjectPrefix != "") {
+			gcsQuery.Set(name, rt.ObjectPrefix+v)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.Proxy.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, h.config.Client.JSONURL("/b/"+url.PathEscape(rt.Bucket)+"/o?"+gcsQuery.Encode()), nil)
+	if err != nil {
+		h.listFailed(&resp, err)
+		return
+	}
+	gcsResp, err := h.restClient.Do(req.WithContext(ctx))
+	if err != nil {
+		h.listFailed(&resp, errors.Wrap(err, "cannot list objects in GCS"))
+		return
+	}
+	defer gcsResp.Body.Close()
+	if gcsResp.StatusCode != http.StatusOK {
+		h.relay(resp, gcsResp)
+		return
+	}
+
+	var list objectsList
+	if err := json.NewDecoder(gcsResp.Body).Decode(&list); err != nil {
+		h.listFailed(&resp, errors.Wrap(err, "unexpected listing from GCS"))
+		return
+	}
+
+	names := make([]string, len(list.Items))
+	sizes := make([]int64, len(list.Items))
+	recorded := make([]bool, len(list.Items))
+	for i, item := range list.Items {
+		names[i], _ = item["name"].(string)
+		size, _ := item["size"].(string)
+		sizes[i], _ = strconv.ParseInt(size, 10, 64)
+
+		// the size of the plaintext follows from that of the envelope, recorded when the proxy uploaded the object
+		metadata, _ := item["metadata"].(map[string]interface{})
+		if size, ok := metadata[jsonMetaEnvelopeSize].(string); ok {
+			envelopeSize, err := strconv.ParseInt(size, 10, 64)
+			if err == nil && envelopeSize >= 0 && envelopeSize <= sizes[i] {
+				// the proxy uploads streams of a single algorithm
+				stream := data.EncryptedData{Algorithm: data.AlgorithmAESGCMHKDF1MB}
+				if n, err := stream.PlaintextSize(sizes[i] - envelopeSize); err == nil {
+					sizes[i], recorded[i] = n, true
+				}
+			}
+		}
+	}
+	shown := h.plaintextListing(ctx, r, rt, names, sizes, recorded)
+
+	items := list.Items[:0]
+	for i, item := range list.Items {
+		if !shown[i].keep {
+			continue
+		}
+		item["name"], item["size"] = shown[i].name, strconv.FormatInt(shown[i].size, 10)
+
+		// checksums of the ciphertext, which the plaintext does not match
+		delete(item, "md5Hash")
+		delete(item, "crc32c")
+		items = append(items, item)
+	}
+	list.Items = items
+	for i := range list.Prefixes {
+		list.Prefixes[i] = strings.TrimPrefix(list.Prefixes[i], rt.ObjectPrefix)
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		h.listFailed(&resp, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	resp.SaveStatus(http.StatusOK)
+	w.Write(b)
+}
+
+// listed is an object of a listing, as shown to the client
+type listed struct {
+	name string // relative to the route, without the .enc suffix
+	size int64  // of the plaintext, or as stored when the object is not an envelope
+	keep bool   // false for objects left out of the listing
+}
+
+// plaintextListing shows the objects, named in the bucket of the route with their sizes, as their plaintext.  The sizes
+// are of the plaintext when recorded, else as stored.  With ListProbeEnvelopes or ListEnvelopesOnly the envelopes of the
+// other objects are read for the size of their plaintext, and objects which are not envelopes are left out with
+// ListEnvelopesOnly.  The .enc suffix is hidden, unless an object is also listed without it.
+func (h *handler) plaintextListing(ctx context.Context, r *http.Request, rt env.Route, names []string, sizes []int64, recorded []bool) []listed {
+	present := map[string]bool{}
+	for _, name := range names {
+		present[name] = true
+	}
+
+	// the envelopes are fetched with the headers of the listing request, but not its query
+	objectReq := r.Clone(ctx)
+	objectReq.URL.RawQuery = ""
+
+	shown := make([]listed, len(names))
+	sem := make(chan struct{}, statConcurrency)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		shown[i] = listed{name: strings.TrimPrefix(name, rt.ObjectPrefix), size: sizes[i], keep: true}
+		if strings.HasSuffix(name, encSuffix) && !present[strings.TrimSuffix(name, encSuffix)] {
+			shown[i].name = strings.TrimSuffix(shown[i].name, encSuffix)
+		}
+		if recorded[i] || !(h.config.Proxy.ListProbeEnvelopes || h.config.Proxy.ListEnvelopesOnly) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			info, gcsResp, err := h.stat(ctx, objectReq, target{Route: rt, Object: name, exact: true})
+			switch {
+			case gcsResp != nil:
+				// e.g deleted since it was listed
+				gcsResp.Body.Close()
+			case err == nil:
+				shown[i].size = info.size
+			case data.KindOf(err) == data.KindEnvelope:
+				shown[i].keep = !h.config.Proxy.ListEnvelopesOnly
+			default:
+				h.logger.WithError(err).Warnf("cannot read the envelope of %s", name)
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	return shown
+}
+
+// relay passes the response of GCS, e.g a failure, through to the client
+func (h *handler) relay(resp RespWrapper, gcsResp *http.Response) {
+	copyRespHeader(resp, gcsResp)
+	if _, errCopy := io.Copy(resp, gcsResp.Body); errCopy != nil {
+		h.logger.WithError(errCopy).Warn("could not relay GCS response")
+	}
+}
+
+// listFailed logs the error and reports the status to the client
+func (h *handler) listFailed(resp *RespWrapper, err error) {
+	status := statusFor(err)
+	h.logger.WithFields(logrus.Fields{
+		"response": status,
+	}).WithError(err).Errorf("failed while listing %+v", err)
+	replyError(resp, err, status)
+}
+
+// deleteObject deletes the object in GCS
+func (h *handler) deleteObject(ctx context.Context, t target) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Proxy.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodDelete, h.objectURL(t, ""), nil)
+	if err != nil {
+		return nil, err
+	}
+	gcsResp, err := h.restClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot delete object in GCS")
+	}
+	return buffered(gcsResp)
+}
@@ -23,7 +23,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// LoggerHandler middleware adds logging before and after the main handler is invoked
+// LoggerHandler middleware adds logging before and after the main handler is invoked, with the identity of the client
+// when ClientCertHandler runs before it
 func LoggerHandler(logger *logrus.Logger) Decorator {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -35,6 +36,9 @@ func LoggerHandler(logger *logrus.Logger) Decorator {
 						"rtt":    time.Since(start).String(),
 						"path":   r.URL.RequestURI(),
 					}
+					if id, ok := IdentityFrom(r.Context()); ok {
+						fields["client"] = id.Name()
+					}
 					entry := logger.WithFields(fields)
 					entry.Debug("finished logging middleware")
 				}
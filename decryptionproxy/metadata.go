@@ -0,0 +1,304 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+)
+
+// metadata the proxy keeps in the object, as x-goog-meta headers of the XML API.  None of it tells more of the
+// plaintext than the object does.
+const (
+	metaPrefix       = "X-Goog-Meta-Tinkproxy-"
+	metaEnvelopeSize = metaPrefix + "Envelope-Size" // of the envelope ahead of the ciphertext, for listings
+	metaDigest       = metaPrefix + "Digest"        // data.Digest of the plaintext, sealed with the dek of the object
+
+	// userMetaPrefix starts the custom metadata of the client, encrypted into the envelope rather than stored in GCS
+	userMetaPrefix = "X-Goog-Meta-"
+
+	// metaEnvelopeSize and metaDigest as keys of the metadata of the JSON API
+	jsonMetaEnvelopeSize = "tinkproxy-envelope-size"
+	jsonMetaDigest       = "tinkproxy-digest"
+)
+
+// headers describing the file the plaintext was read from, see data.FileAttributes
+const (
+	fileModeHeader  = "X-Tinkproxy-File-Mode"  // octal permission bits
+	fileMtimeHeader = "X-Tinkproxy-File-Mtime" // RFC 3339
+)
+
+// errBadDigest is returned for a plaintext which does not match the checksum sent with it
+var errBadDigest = errors.New("the plaintext does not match the checksum sent with it")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// plaintextDigest hashes the plaintext as it is read to be encrypted.  At the end of the plaintext, it fails with
+// errBadDigest unless the checksums sent by the client in Content-MD5 or X-Goog-Hash match.
+type plaintextDigest struct {
+	r    io.Reader
+	md5  hash.Hash
+	crc  hash.Hash32
+	size int64
+
+	wantMD5 []byte
+	wantCRC []byte
+}
+
+func newPlaintextDigest(r io.Reader, header http.Header) (*plaintextDigest, error) {
+	d := &plaintextDigest{r: r, md5: md5.New(), crc: crc32.New(castagnoli)}
+
+	checksums := map[string]string{}
+	if v := header.Get("Content-Md5"); v != "" {
+		checksums["md5"] = v
+	}
+	for _, v := range header["X-Goog-Hash"] {
+		for _, checksum := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(checksum), "=", 2)
+			if len(kv) == 2 {
+				checksums[kv[0]] = kv[1]
+			}
+		}
+	}
+	for name, v := range checksums {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.Wrapf(errBadDigest, "malformed %s checksum", name)
+		}
+		switch name {
+		case "md5":
+			d.wantMD5 = b
+		case "crc32c":
+			d.wantCRC = b
+		}
+	}
+	return d, nil
+}
+
+func (d *plaintextDigest) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.md5.Write(p[:n])
+	d.crc.Write(p[:n])
+	d.size += int64(n)
+	if err == io.EOF {
+		if (d.wantMD5 != nil && !bytes.Equal(d.wantMD5, d.md5.Sum(nil))) || (d.wantCRC != nil && !bytes.Equal(d.wantCRC, d.crc.Sum(nil))) {
+			return n, errBadDigest
+		}
+	}
+	return n, err
+}
+
+// digest returns the size and checksums of the plaintext read
+func (d *plaintextDigest) digest() data.Digest {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, d.crc.Sum32())
+	return data.Digest{Size: d.size, MD5: d.md5.Sum(nil), CRC32C: crc}
+}
+
+// googHash returns the checksums of the digest in the format of X-Goog-Hash
+func googHash(d data.Digest) string {
+	return "crc32c=" + base64.StdEncoding.EncodeToString(d.CRC32C) + ",md5=" + base64.StdEncoding.EncodeToString(d.MD5)
+}
+
+// describeObject records the size and checksums of the plaintext in the metadata of the object just uploaded, which
+// are only known once it is encrypted.  They are sealed with the dek, which ee encrypted the object with, so GCS can
+// neither confirm a guess of the plaintext nor change them.  The generation, when known, guards against a concurrent
+// upload.
+func (h *handler) describeObject(ctx context.Context, t target, generation string, ee *data.EncryptionEngine, d *plaintextDigest) error {
+	sealed, err := ee.SealDigest(d.digest())
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]map[string]string{
+		"metadata": {
+			jsonMetaDigest: sealed,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	objectURL := h.config.Client.JSONURL("/b/" + url.PathEscape(t.Bucket) + "/o/" + url.PathEscape(t.Object))
+	if generation != "" {
+		objectURL += "?ifGenerationMatch=" + url.QueryEscape(generation)
+	}
+	req, err := http.NewRequest(http.MethodPatch, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	gcsResp, err := h.restClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "cannot update object metadata")
+	}
+	defer gcsResp.Body.Close()
+	if gcsResp.StatusCode != http.StatusOK {
+		return errors.Errorf("cannot update object metadata: GCS answered %s", gcsResp.Status)
+	}
+	return nil
+}
+
+// describePlaintext rewrites the headers of a GCS response about an object to describe its plaintext: the checksums of
+// the digest, when given for the whole object.  Those of the ciphertext are dropped, see describeFile for the rest.
+func describePlaintext(header http.Header, digest *data.Digest) {
+	header.Del("X-Goog-Hash")
+	header.Del("X-Goog-Stored-Content-Length")
+	header.Del("Content-Md5")
+	if digest != nil && digest.MD5 != nil {
+		header.Set("X-Goog-Hash", googHash(*digest))
+	}
+	for k := range header {
+		if strings.HasPrefix(k, metaPrefix) {
+			header.Del(k)
+		}
+	}
+}
+
+// describeFile sets the headers describing the file the plaintext was read from, as decrypted from its envelope.  A
+// Content-Disposition stored with the object, e.g by another client, is kept.
+func describeFile(header http.Header, a data.FileAttributes) {
+	if a.ContentType != "" {
+		header.Set("Content-Type", a.ContentType)
+	}
+	if disposition := contentDisposition(a); disposition != "" && header.Get("Content-Disposition") == "" {
+		header.Set("Content-Disposition", disposition)
+	}
+	if mode := a.FileMode(); mode != 0 {
+		header.Set(fileModeHeader, fmt.Sprintf("%04o", uint32(mode)))
+	}
+	if mtime, ok := a.Time(); ok {
+		header.Set(fileMtimeHeader, mtime.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// fileAttributes returns the attributes of the plaintext sent by a client: its content type, and the disposition and
+// file name of its Content-Disposition
+func fileAttributes(header http.Header) data.FileAttributes {
+	a := data.FileAttributes{ContentType: header.Get("Content-Type")}
+	if disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if disposition == "attachment" || disposition == "inline" {
+			a.Disposition = disposition
+		}
+		a.FileName = path.Base(params["filename"])
+		a.FileName = a.BaseName()
+	}
+	return a
+}
+
+// userMetadata returns the custom metadata sent by the client, other than that of the proxy, keyed by the lower case
+// name following x-goog-meta-
+func userMetadata(header http.Header) map[string]string {
+	meta := map[string]string{}
+	for k := range header {
+		if strings.HasPrefix(k, userMetaPrefix) && !strings.HasPrefix(k, metaPrefix) {
+			meta[strings.ToLower(strings.TrimPrefix(k, userMetaPrefix))] = header.Get(k)
+		}
+	}
+	return meta
+}
+
+// describeMetadata sets the custom metadata decrypted from the envelope as x-goog-meta headers
+func describeMetadata(header http.Header, meta map[string]string) {
+	for k, v := range meta {
+		header.Set(userMetaPrefix+k, v)
+	}
+}
+
+// openObject decrypts the custom metadata and file attributes in the envelope of the target object, and the digest in
+// the headers of GCS about it.  The dek is only unwrapped for an object with either, which is audited as a decryption
+// of no bytes of content.
+func (h *handler) openObject(ctx context.Context, t target, b *data.EncryptedData, header http.Header) (meta map[string]string, digest *data.Digest, err error) {
+	if b.Metadata == "" && header.Get(metaDigest) == "" {
+		return nil, nil, nil
+	}
+	rec := newAuditRecord(ctx, audit.ActionDecrypt, t)
+	rec.Generation = header.Get("X-Goog-Generation")
+	rec.KEK = b.KekName
+	// the metadata is only sent once its decryption is recorded
+	defer func() {
+		if errAudit := h.audited(rec, err); errAudit != nil && err == nil {
+			meta, digest, err = nil, nil, errAudit
+		}
+	}()
+
+	kmsClient, err := h.kmsClient(t, b.KekName)
+	if err != nil {
+		return nil, nil, err
+	}
+	ee := data.NewEncryptionEngine(b.KekName, "", kmsClient, h.logger)
+	if err := bindAAD(ee, *b, t); err != nil {
+		return nil, nil, err
+	}
+	if err := unwrapDEK(ee, *b); err != nil {
+		return nil, nil, err
+	}
+	if meta, err = ee.OpenMetadata(b); err != nil {
+		return nil, nil, err
+	}
+	digest, err = sealedDigest(header, ee)
+	return meta, digest, err
+}
+
+// sealedDigest decrypts the digest recorded by describeObject with the dek loaded in ee.  Objects uploaded otherwise
+// have none.
+func sealedDigest(header http.Header, ee *data.EncryptionEngine) (*data.Digest, error) {
+	sealed := header.Get(metaDigest)
+	if sealed == "" {
+		return nil, nil
+	}
+	digest, err := ee.OpenDigest(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return &digest, nil
+}
+
+// contentDisposition returns the Content-Disposition of the file described, inline unless recorded otherwise
+func contentDisposition(a data.FileAttributes) string {
+	disposition := a.Disposition
+	if disposition == "" {
+		disposition = "inline"
+	}
+	name := a.BaseName()
+	if name == "" {
+		if a.Disposition == "" {
+			return ""
+		}
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": name})
+}
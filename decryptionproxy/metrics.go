@@ -0,0 +1,198 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+)
+
+// phases of serving an object, timed separately
+const (
+	phaseGCSFetch  = "gcs_fetch"
+	phaseKMSUnwrap = "kms_unwrap"
+	phaseDecrypt   = "decrypt"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tinkproxy_requests_total",
+		Help: "Requests answered, by method and status.  Responses aborted after they started have the status aborted.",
+	}, []string{"method", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tinkproxy_request_duration_seconds",
+		Help: "Time to answer requests, by method.",
+	}, []string{"method"})
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tinkproxy_phase_duration_seconds",
+		Help: "Time spent serving objects, by phase: gcs_fetch, kms_unwrap, or decrypt which includes sending the plaintext.",
+	}, []string{"phase"})
+	bytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tinkproxy_bytes_total",
+		Help: "Bytes of the bodies of requests (in) and responses (out).",
+	}, []string{"direction"})
+	envelopeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tinkproxy_envelope_parse_failures_total",
+		Help: "Objects read which are not well formed envelopes.",
+	})
+	kmsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tinkproxy_kms_errors_total",
+		Help: "Failures of KMS to wrap or unwrap a DEK, by operation.",
+	}, []string{"operation"})
+)
+
+// metricsRegistry holds the proxy metrics, apart from the default registry of the process
+var metricsRegistry = prometheus.NewRegistry()
+
+// Metrics serves the proxy metrics in the Prometheus text format, on the admin listener
+var Metrics = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+func init() {
+	metricsRegistry.MustRegister(requestsTotal, requestDuration, phaseDuration, bytesTotal, envelopeFailures, kmsErrors)
+}
+
+// methods are the values of the method label, others are counted as OTHER
+var methods = map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodPut: true, http.MethodPost: true,
+	http.MethodDelete: true, http.MethodOptions: true}
+
+// MetricsHandler middleware counts requests, their duration and the bytes of their bodies in Metrics
+func MetricsHandler() Decorator {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			method := r.Method
+			if !methods[method] {
+				method = "OTHER"
+			}
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			cw := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+
+			defer func() {
+				status := strconv.Itoa(cw.status)
+				p := recover()
+				if p != nil {
+					status = "aborted"
+				}
+				requestsTotal.WithLabelValues(method, status).Inc()
+				requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+				bytesTotal.WithLabelValues("in").Add(float64(body.n))
+				bytesTotal.WithLabelValues("out").Add(float64(cw.n))
+				if p != nil {
+					panic(p)
+				}
+			}()
+			handler.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter records the status of a response and counts the bytes of its body.  It flushes, hijacks and pushes
+// through to the writer it wraps, when that can.
+type countingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.status, c.wroteHeader = status, true
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.wroteHeader = true
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		c.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (c *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return h.Hijack()
+}
+
+func (c *countingWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := c.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// observePhase records the time spent in the phase since start, use as defer observePhase(phase, time.Now())
+func observePhase(phase string, start time.Time) {
+	phaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// readEnvelope reads the envelope at the start of an object, counting objects which are not envelopes
+func readEnvelope(r *bufio.Reader) (data.EncryptedData, int, error) {
+	b, envelopeSize, err := data.ReadEnvelope(r)
+	if err != nil {
+		envelopeFailures.Inc()
+	}
+	return b, envelopeSize, err
+}
+
+// unwrapDEK has KMS unwrap the DEK of the envelope into ee, timing it and counting its failures
+func unwrapDEK(ee *data.EncryptionEngine, b data.EncryptedData) error {
+	defer observePhase(phaseKMSUnwrap, time.Now())
+	var err error
+	if b.IsStream() {
+		err = ee.LoadStream(b)
+	} else {
+		err = ee.Load(b)
+	}
+	if data.KindOf(err) == data.KindKMS {
+		kmsErrors.WithLabelValues("unwrap").Inc()
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observations returns the number of observations of the histogram with the label value
+func observations(t *testing.T, h *prometheus.HistogramVec, value string) uint64 {
+	var m dto.Metric
+	if err := h.WithLabelValues(value).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	c, client, gcs := testGCS(t)
+	proxy := httptest.NewServer(Decorate(New(c, client, nil), MetricsHandler(), RouteHandler(), ConstraintHandler(c.Logger())))
+	t.Cleanup(proxy.Close)
+	plaintext := "four score and seven years ago"
+	gcs.objects["bucket/plain.txt"] = []byte("plaintext")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status string
+
+		wantIn, wantOut float64
+		wantPhases      []string
+		wantEnvelope    float64
+	}{
+		{"put", http.MethodPut, "/speech.txt", plaintext, "200", float64(len(plaintext)), 0, nil, 0},
+		{"get", http.MethodGet, "/speech.txt", "", "200", 0, float64(len(plaintext)),
+			[]string{phaseGCSFetch, phaseKMSUnwrap, phaseDecrypt}, 0},
+		{"not an envelope", http.MethodGet, "/plain.txt", "", "400", 0, -1, []string{phaseGCSFetch}, 1},
+		{"other method", "BREW", "/speech.txt", "", "405", 0, -1, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if !methods[method] {
+				method = "OTHER"
+			}
+			requests := testutil.ToFloat64(requestsTotal.WithLabelValues(method, tt.status))
+			durations := observations(t, requestDuration, method)
+			in, out := testutil.ToFloat64(bytesTotal.WithLabelValues("in")), testutil.ToFloat64(bytesTotal.WithLabelValues("out"))
+			envelopes := testutil.ToFloat64(envelopeFailures)
+			phases := map[string]uint64{}
+			for _, phase := range tt.wantPhases {
+				phases[phase] = observations(t, phaseDuration, phase)
+			}
+
+			req, _ := http.NewRequest(tt.method, proxy.URL+tt.path, strings.NewReader(tt.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if got := testutil.ToFloat64(requestsTotal.WithLabelValues(method, tt.status)) - requests; got != 1 {
+				t.Errorf("requests{%s,%s} increased by %v, want 1 (status %d)", method, tt.status, got, resp.StatusCode)
+			}
+			if got := observations(t, requestDuration, method) - durations; got != 1 {
+				t.Errorf("request durations{%s} increased by %v, want 1", method, got)
+			}
+			if got := testutil.ToFloat64(bytesTotal.WithLabelValues("in")) - in; got != tt.wantIn {
+				t.Errorf("bytes in increased by %v, want %v", got, tt.wantIn)
+			}
+			if got := testutil.ToFloat64(bytesTotal.WithLabelValues("out")) - out; tt.wantOut >= 0 && got != tt.wantOut {
+				t.Errorf("bytes out increased by %v, want %v", got, tt.wantOut)
+			}
+			if got := testutil.ToFloat64(envelopeFailures) - envelopes; got != tt.wantEnvelope {
+				t.Errorf("envelope failures increased by %v, want %v", got, tt.wantEnvelope)
+			}
+			for phase, before := range phases {
+				if got := observations(t, phaseDuration, phase) - before; got == 0 {
+					t.Errorf("phase %s was not timed", phase)
+				}
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	Metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{`tinkproxy_requests_total{method="GET",status="200"}`,
+		`tinkproxy_phase_duration_seconds_bucket{phase="kms_unwrap",le="+Inf"}`, "tinkproxy_envelope_parse_failures_total"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestMetricsHandler_flush(t *testing.T) {
+	handler := MetricsHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("the response writer cannot flush")
+		}
+		w.Write([]byte("partial"))
+		f.Flush()
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/speech.txt", nil))
+	if !rec.Flushed {
+		t.Error("the response was not flushed")
+	}
+}
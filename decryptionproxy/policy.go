@@ -0,0 +1,236 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+// policyPollInterval is how often the policy file is checked for changes
+const policyPollInterval = 5 * time.Second
+
+// methodList is the method of listing requests in policy rules
+const methodList = "LIST"
+
+// errForbidden is returned for requests the policy does not allow
+var errForbidden = errors.New("forbidden by policy")
+
+type policyKey struct{}
+
+// policyEnforcer decides requests with the policy of the configuration, replaced when the policy file changes
+type policyEnforcer struct {
+	path   string
+	logger *logrus.Logger
+
+	mu      sync.RWMutex
+	policy  env.Policy
+	modTime time.Time
+}
+
+// PolicyHandler middleware attaches the policy to the request context.  Handlers authorize the target of the request
+// once routed, its bucket and object, and answer 403 to requests the policy does not allow before anything is asked
+// of GCS or KMS, see authorize.  Clients are those authenticated by the middleware before it, see IdentityFrom.  The policy file is reloaded when it
+// changes, and a policy which fails to load leaves the previous one in force.
+func PolicyHandler(c env.Config, logger *logrus.Logger) Decorator {
+	e := newPolicyEnforcer(c, logger)
+	go e.watch(policyPollInterval)
+	return e.decorate
+}
+
+func newPolicyEnforcer(c env.Config, logger *logrus.Logger) *policyEnforcer {
+	e := &policyEnforcer{path: c.PolicyFile, logger: logger}
+	if c.Policy != nil {
+		e.policy = *c.Policy
+	} else {
+		e.policy = env.Policy{Default: env.PolicyDeny}
+	}
+	if fi, err := os.Stat(c.PolicyFile); err == nil {
+		e.modTime = fi.ModTime()
+	}
+	return e
+}
+
+func (e *policyEnforcer) decorate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), policyKey{}, e)))
+	})
+}
+
+// watch reloads the policy file each time its modification time changes
+func (e *policyEnforcer) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		fi, err := os.Stat(e.path)
+		if err != nil {
+			e.logger.WithError(err).Error("cannot check the policy file, keeping the policy in force")
+			continue
+		}
+		if !fi.ModTime().Equal(e.modTime) {
+			e.modTime = fi.ModTime()
+			e.reload()
+		}
+	}
+}
+
+// reload replaces the policy in force with the policy file, unless it fails to load
+func (e *policyEnforcer) reload() {
+	p, err := env.ReadPolicy(e.path)
+	if err != nil {
+		e.logger.WithError(err).Error("keeping the policy in force")
+		return
+	}
+	e.mu.Lock()
+	e.policy = p
+	e.mu.Unlock()
+	e.logger.Infof("reloaded policy %s", e.path)
+}
+
+// policyObject names the target in policy rules: its bucket, then the name of the object in the bucket
+func policyObject(t target) string {
+	return t.Bucket + "/" + t.Object
+}
+
+// policyMethod returns the method of the request as policy rules name it, with HEAD as GET
+func policyMethod(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return http.MethodGet
+	}
+	return r.Method
+}
+
+// listingTarget targets the objects of a listing of prefix, as named in the bucket of the route
+func listingTarget(t target, prefix string) target {
+	return target{Route: t.Route, Object: t.ObjectPrefix + prefix}
+}
+
+// authorize returns errForbidden unless the policy attached to the request, see PolicyHandler, allows method on the
+// target.  Requests are allowed when there is no policy, but never on an improper object name, see checkObjectName.
+func authorize(r *http.Request, method string, t target) error {
+	if err := checkObjectName(t.Object, method == methodList); err != nil {
+		return err
+	}
+	e, ok := r.Context().Value(policyKey{}).(*policyEnforcer)
+	if !ok {
+		return nil
+	}
+	id, authenticated := IdentityFrom(r.Context())
+	if object := policyObject(t); !e.allowed(id, authenticated, method, object) {
+		e.logger.WithFields(logrus.Fields{
+			"client": id.Name(),
+			"method": method,
+			"object": object,
+		}).Warn("denied by policy")
+		return errors.Wrapf(errForbidden, "%s %s", method, object)
+	}
+	return nil
+}
+
+// allowed returns the effect of the first rule matching the request, or the default of the policy
+func (e *policyEnforcer) allowed(id Identity, authenticated bool, method string, object string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	names, groups := identityNames(id, authenticated, e.policy.Groups)
+	for _, rule := range e.policy.Rules {
+		if matchIdentity(rule.Identities, names, groups) && matchMethod(rule.Methods, method) && matchObject(rule.Objects, object) {
+			return rule.Effect == env.PolicyAllow
+		}
+	}
+	return e.policy.Default == env.PolicyAllow
+}
+
+// identityNames returns the names the client is known by, and the groups it belongs to: those of the policy naming
+// it, and those of the groups claim of its token
+func identityNames(id Identity, authenticated bool, policyGroups map[string][]string) (map[string]bool, map[string]bool) {
+	names, groups := map[string]bool{}, map[string]bool{}
+	if !authenticated {
+		names["anonymous"] = true
+		return names, groups
+	}
+	names["*"] = true
+	if id.Subject != "" {
+		names[id.Subject] = true
+	}
+	for _, san := range id.SANs {
+		names[san] = true
+	}
+
+	for group, members := range policyGroups {
+		for _, member := range members {
+			if names[member] {
+				groups[group] = true
+			}
+		}
+	}
+	if claimed, ok := id.Claims["groups"].([]interface{}); ok {
+		for _, group := range claimed {
+			if g, ok := group.(string); ok {
+				groups[g] = true
+			}
+		}
+	}
+	return names, groups
+}
+
+func matchIdentity(identities []string, names map[string]bool, groups map[string]bool) bool {
+	for _, identity := range identities {
+		if names[identity] || (strings.HasPrefix(identity, "group:") && groups[strings.TrimPrefix(identity, "group:")]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == "*" || m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func matchObject(patterns []string, object string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(object, pattern) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, object); ok {
+			return true
+		}
+	}
+	return false
+}
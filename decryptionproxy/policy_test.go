@@ -0,0 +1,164 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+const testPolicy = `
+groups:
+  finance: [reporting.example.org]
+rules:
+  - effect: deny
+    identities: ["*"]
+    methods: [PUT, POST]
+    objects: [bucket/archive/]
+  - identities: [group:finance]
+    methods: [GET, LIST]
+    objects: [fin/reports/]
+  - identities: [group:auditors]
+    methods: [GET]
+    objects: ["bucket/*.log"]
+  - identities: ["*"]
+    methods: [PUT, POST]
+    objects: ["bucket/*"]
+  - identities: [anonymous]
+    methods: [GET]
+    objects: [bucket/public/]
+`
+
+// postForm returns a POST object form uploading a file under key, and its content type
+func postForm(t *testing.T, key string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	if err := mw.WriteField("key", key); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("file", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, mw.FormDataContentType()
+}
+
+func TestPolicyHandler(t *testing.T) {
+	path := filepath.Join(testDir(t), "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := env.ReadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, client, _ := testGCS(t)
+	c.Routes = []env.Route{{Host: "finance.example.org", Bucket: "fin", ObjectPrefix: "reports/", KmsMkekURI: c.KmsMkekURI,
+		KekAllowList: c.KekAllowList, AAD: c.AAD, AADMode: c.AADMode}}
+	e := newPolicyEnforcer(env.Config{PolicyFile: path, Policy: &policy}, quietLogger())
+	handler := Decorate(New(c, client, nil), RouteHandler(), e.decorate)
+
+	reporting := &Identity{Method: "mtls", Subject: "CN=reporting", SANs: []string{"reporting.example.org"}}
+	auditor := &Identity{Method: "jwt", Subject: "alice", Claims: map[string]interface{}{"groups": []interface{}{"auditors"}}}
+	tests := []struct {
+		name       string
+		id         *Identity
+		method     string
+		target     string
+		key        string // of the POST object form
+		wantStatus int    // of requests denied, 0 for those allowed
+	}{
+		{"group member reads", reporting, http.MethodGet, "http://finance.example.org/q1.pdf", "", 0},
+		{"same path in another bucket", reporting, http.MethodGet, "/q1.pdf", "", http.StatusForbidden},
+		{"head is get", reporting, http.MethodHead, "http://finance.example.org/q1.pdf", "", 0},
+		{"group member lists", reporting, http.MethodGet, "http://finance.example.org/?list-type=2&prefix=2020", "", 0},
+		{"json list", reporting, http.MethodGet, "/storage/v1/b/bucket/o?prefix=reports/", "", http.StatusForbidden},
+		{"outside the prefix", reporting, http.MethodGet, "/payroll/june.pdf", "", http.StatusForbidden},
+		{"out of the prefix by ..", reporting, http.MethodGet, "http://finance.example.org/../payroll/june.pdf", "", http.StatusBadRequest},
+		{"list out of the prefix by ..", reporting, http.MethodGet, "http://finance.example.org/?list-type=2&prefix=2020/../../payroll/", "", http.StatusBadRequest},
+		{"post to a key out of the prefix by ..", auditor, http.MethodPost, "/", "uploads/../archive/a.txt", http.StatusBadRequest},
+		{"list outside the prefix", reporting, http.MethodGet, "/?list-type=2&prefix=reports/", "", http.StatusForbidden},
+		{"claimed group", auditor, http.MethodGet, "/access.log", "", 0},
+		{"glob does not cross /", auditor, http.MethodGet, "/logs/access.log", "", http.StatusForbidden},
+		{"any client writes", auditor, http.MethodPut, "/a.txt", "", 0},
+		{"first rule decides", reporting, http.MethodPut, "/archive/a.txt", "", http.StatusForbidden},
+		{"post to the key of the form", auditor, http.MethodPost, "/", "a.txt", 0},
+		{"post to a forbidden key", auditor, http.MethodPost, "/a.txt", "archive/a.txt", http.StatusForbidden},
+		{"anonymous reads public", nil, http.MethodGet, "/public/index.html", "", 0},
+		{"anonymous cannot write", nil, http.MethodPut, "/a.txt", "", http.StatusForbidden},
+		{"deny by default", reporting, http.MethodDelete, "http://finance.example.org/q1.pdf", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader("a"))
+			if tt.method == http.MethodPost {
+				body, contentType := postForm(t, tt.key)
+				req = httptest.NewRequest(tt.method, tt.target, body)
+				req.Header.Set("Content-Type", contentType)
+			}
+			if tt.id != nil {
+				req = req.WithContext(WithIdentity(req.Context(), *tt.id))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			denied := rec.Code == http.StatusForbidden || rec.Code == http.StatusBadRequest
+			if (tt.wantStatus == 0 && denied) || (tt.wantStatus != 0 && rec.Code != tt.wantStatus) {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/payroll/june.pdf", nil)
+		req = req.WithContext(WithIdentity(req.Context(), *reporting))
+
+		// a broken policy leaves the one in force
+		if err := ioutil.WriteFile(path, []byte("rules: [{identities: ['*']}]"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		e.reload()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("status after a broken policy = %v, want %v", rec.Code, http.StatusForbidden)
+		}
+
+		if err := ioutil.WriteFile(path, []byte("default: allow\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		e.reload()
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusForbidden {
+			t.Errorf("status after reload = %v, want allowed", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connKey is the context key of the connection of the client, see ConnContext
+type connKey struct{}
+
+// ConnContext keeps the connection of the client in the context of its requests, so a stalled transfer can stop a
+// write to it blocked for good.  It is the ConnContext of the http.Server of the proxy.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// progress bounds a transfer by the time since it last moved bytes, rather than by a deadline on the whole transfer,
+// as objects may be of any size
+type progress struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+	done  bool
+}
+
+// watchProgress returns a context cancelled once no bytes went through the readers of the progress for timeout.  The
+// connection of the client is then expired as well, which fails a write to a client no longer reading, or a read of
+// an upload no longer sent.  The returned func ends the watch.
+func watchProgress(ctx context.Context, timeout time.Duration) (context.Context, *progress, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	conn, _ := ctx.Value(connKey{}).(net.Conn)
+	p := &progress{timeout: timeout}
+	p.timer = time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.done {
+			return
+		}
+		p.done = true
+		cancel()
+		if conn != nil {
+			conn.SetDeadline(time.Now())
+		}
+	})
+	return ctx, p, func() {
+		p.mu.Lock()
+		p.done = true
+		p.timer.Stop()
+		p.mu.Unlock()
+		cancel()
+	}
+}
+
+// reader returns r, whose reads keep the transfer alive
+func (p *progress) reader(r io.Reader) io.Reader {
+	return &progressReader{Reader: r, progress: p}
+}
+
+func (p *progress) moved() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.done {
+		p.timer.Reset(p.timeout)
+	}
+}
+
+type progressReader struct {
+	io.Reader
+	progress *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.progress.moved()
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tricklingReader returns a byte every interval
+type tricklingReader struct {
+	n        int
+	interval time.Duration
+}
+
+func (r *tricklingReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.interval)
+	r.n--
+	b[0] = 'x'
+	return 1, nil
+}
+
+func Test_watchProgress(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	t.Run("slow transfer", func(t *testing.T) {
+		ctx, transfer, stop := watchProgress(context.Background(), timeout)
+		defer stop()
+		// outlasts the timeout, but keeps moving
+		b, err := ioutil.ReadAll(transfer.reader(&tricklingReader{n: 10, interval: timeout / 5}))
+		if err != nil || len(b) != 10 {
+			t.Fatalf("ReadAll() = %q, %v", b, err)
+		}
+		if ctx.Err() != nil {
+			t.Errorf("watchProgress() cancelled a transfer making progress: %v", ctx.Err())
+		}
+	})
+
+	t.Run("stalled transfer", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		ctx, _, stop := watchProgress(context.WithValue(context.Background(), connKey{}, server), timeout)
+		defer stop()
+
+		// the client reads nothing, so the write blocks until the connection expires
+		if _, err := server.Write([]byte("plaintext")); err == nil {
+			t.Errorf("write to a stalled client did not fail")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("watchProgress() did not cancel a stalled transfer")
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		_, _, stop := watchProgress(context.WithValue(context.Background(), connKey{}, server), timeout)
+		stop()
+		time.Sleep(2 * timeout)
+
+		// the connection serves the next request
+		go client.Read(make([]byte, 1))
+		if _, err := server.Write([]byte("x")); err != nil {
+			t.Errorf("write after the transfer ended = %v", err)
+		}
+	})
+}
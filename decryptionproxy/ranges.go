@@ -0,0 +1,269 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+)
+
+// envelopeProbeSize is how much of the head of an object is fetched to find its envelope and stream header
+const envelopeProbeSize = 64 << 10
+
+var (
+	errRangeUnsupported   = errors.New("unsupported range, serving the whole object")
+	errRangeUnsatisfiable = errors.New("range not satisfiable")
+)
+
+// serveRange answers a single plaintext byte range of a streaming object by fetching and decrypting only the segments
+// holding it.  It returns false, without writing a response, when the whole object should be served instead.
+func (h *handler) serveRange(resp *RespWrapper, r *http.Request, t target) (handled bool, err error) {
+	ctx, transfer, stop := watchProgress(r.Context(), h.config.Proxy.Timeout)
+	defer stop()
+
+	// the envelope and the stream header are at the start of the object
+	probe, err := h.fetchObject(&t, func(t target) (*http.Response, error) {
+		return h.fetchRange(ctx, r, t, 0, envelopeProbeSize)
+	})
+	if err != nil {
+		h.logger.WithError(err).Warn("cannot probe object for range request")
+		return false, nil
+	}
+	defer probe.Body.Close()
+
+	objectSize, err := objectSize(probe)
+	if err != nil {
+		return false, nil
+	}
+	// a download resumed from a copy of another generation gets the whole object
+	if !ifRangeMatches(r.Header.Get("If-Range"), probe.Header) {
+		return false, nil
+	}
+	br := bufio.NewReader(probe.Body)
+	b, envelopeSize, err := data.ReadEnvelope(br)
+	if err != nil || !b.IsStream() {
+		return false, nil
+	}
+	headerSize, err := b.StreamHeaderSize()
+	if err != nil {
+		return false, nil
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return false, nil
+	}
+
+	ciphertextSize := objectSize - int64(envelopeSize)
+	plaintextSize, err := b.PlaintextSize(ciphertextSize)
+	if err != nil {
+		return false, nil
+	}
+	start, length, err := parseRange(r.Header.Get("Range"), plaintextSize)
+	if err == errRangeUnsupported {
+		return false, nil
+	}
+	if err != nil {
+		resp.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", plaintextSize))
+		replyError(resp, err, http.StatusRequestedRangeNotSatisfiable)
+		return true, nil
+	}
+
+	from, to, err := b.SegmentSpan(ciphertextSize, start, length)
+	if err != nil {
+		return false, nil
+	}
+
+	rec := newAuditRecord(r.Context(), audit.ActionDecrypt, t)
+	rec.Generation = probe.Header.Get("X-Goog-Generation")
+	rec.KEK = b.KekName
+	defer func() { h.audited(rec, err) }()
+	fetchStart := time.Now()
+	segResp, err := h.fetchRange(ctx, r, t, int64(envelopeSize)+from, to-from)
+	observePhase(phaseGCSFetch, fetchStart)
+	if err != nil {
+		replyError(resp, err, http.StatusBadGateway)
+		return true, err
+	}
+	defer segResp.Body.Close()
+	if segResp.StatusCode != http.StatusPartialContent {
+		err := errors.Errorf("GCS answered range request with %s", segResp.Status)
+		replyError(resp, err, http.StatusBadGateway)
+		return true, err
+	}
+
+	kmsClient, err := h.kmsClient(t, b.KekName)
+	if err != nil {
+		replyError(resp, err, statusFor(err))
+		return true, err
+	}
+	ee := data.NewEncryptionEngine(b.KekName, "", kmsClient, h.logger)
+	if err := bindAAD(ee, b, t); err != nil {
+		replyError(resp, err, statusFor(err))
+		return true, err
+	}
+	if err := unwrapDEK(ee, b); err != nil {
+		replyError(resp, err, statusFor(err))
+		return true, err
+	}
+	meta, err := ee.OpenMetadata(&b)
+	if err != nil {
+		replyError(resp, err, statusFor(err))
+		return true, err
+	}
+	decryptStart := time.Now()
+	defer func() { observePhase(phaseDecrypt, decryptStart) }()
+	plaintext, err := ee.RevealRange(b, header, transfer.reader(segResp.Body), ciphertextSize, start, length)
+	if err != nil {
+		replyError(resp, err, statusFor(err))
+		return true, err
+	}
+
+	if err := h.release(rec, length); err != nil {
+		replyError(resp, err, statusFor(err))
+		return true, err
+	}
+	resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, plaintextSize))
+	resp.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	describePlaintext(segResp.Header, nil)
+	describeFile(segResp.Header, b.FileAttributes)
+	describeMetadata(segResp.Header, meta)
+	copyRespHeader(*resp, segResp)
+
+	written, err := io.Copy(resp, plaintext)
+	rec.Bytes = written
+	if err != nil {
+		rec.Outcome = outcome(err)
+		abortResponse(h.logger, err, written)
+	}
+	return true, nil
+}
+
+// fetchRange gets length bytes of the object from offset
+func (h *handler) fetchRange(ctx context.Context, r *http.Request, t target, offset int64, length int64) (*http.Response, error) {
+	proxyToGCSReq, err := http.NewRequest(http.MethodGet, h.objectURL(t, r.URL.RawQuery), nil)
+	if err != nil {
+		return nil, err
+	}
+	proxyToGCSReq = proxyToGCSReq.WithContext(ctx)
+
+	copyReqHeader(proxyToGCSReq.Header, r.Header)
+	proxyToGCSReq.Header.Del("If-Range")
+	proxyToGCSReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	gcsResp, err := h.restClient.Do(proxyToGCSReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch range from GCS")
+	}
+	return gcsResp, nil
+}
+
+// ifRangeMatches tells whether the object described by header still is the one the If-Range validator was taken from:
+// a strong entity tag matches its ETag, and a date its Last-Modified.  No validator always matches.
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`):
+		return ifRange == header.Get("ETag")
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && t.Equal(lastModified)
+}
+
+// objectSize returns the full size of the object from a response to a range request
+func objectSize(gcsResp *http.Response) (int64, error) {
+	switch gcsResp.StatusCode {
+	case http.StatusOK:
+		return gcsResp.ContentLength, nil
+	case http.StatusPartialContent:
+		contentRange := gcsResp.Header.Get("Content-Range")
+		i := strings.LastIndex(contentRange, "/")
+		if i < 0 {
+			return 0, errors.Errorf("unexpected Content-Range %q", contentRange)
+		}
+		return strconv.ParseInt(contentRange[i+1:], 10, 64)
+	default:
+		return 0, errors.Errorf("GCS answered range request with %s", gcsResp.Status)
+	}
+}
+
+// parseRange returns the start and length of the single byte range in the Range header, for content of size bytes.
+// Multiple ranges, and anything but bytes, are served as the whole object.
+func parseRange(s string, size int64) (int64, int64, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) || strings.Contains(s, ",") {
+		return 0, 0, errRangeUnsupported
+	}
+	spec := strings.TrimSpace(s[len(prefix):])
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, errRangeUnsupported
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	// suffix range: the final N bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errRangeUnsupported
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errRangeUnsupported
+	}
+	if start >= size {
+		return 0, 0, errRangeUnsatisfiable
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errRangeUnsupported
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
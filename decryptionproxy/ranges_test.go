@@ -0,0 +1,57 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"testing"
+)
+
+func Test_parseRange(t *testing.T) {
+	type args struct {
+		s    string
+		size int64
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStart  int64
+		wantLength int64
+		wantErr    error
+	}{
+		{"closed range", args{"bytes=0-499", 1000}, 0, 500, nil},
+		{"open range", args{"bytes=900-", 1000}, 900, 100, nil},
+		{"suffix range", args{"bytes=-100", 1000}, 900, 100, nil},
+		{"suffix larger than content", args{"bytes=-2000", 1000}, 0, 1000, nil},
+		{"end past content", args{"bytes=500-5000", 1000}, 500, 500, nil},
+		{"start past content", args{"bytes=1000-", 1000}, 0, 0, errRangeUnsatisfiable},
+		{"empty suffix", args{"bytes=-0", 1000}, 0, 0, errRangeUnsatisfiable},
+		{"multiple ranges", args{"bytes=0-1,5-6", 1000}, 0, 0, errRangeUnsupported},
+		{"other unit", args{"items=0-1", 1000}, 0, 0, errRangeUnsupported},
+		{"reversed", args{"bytes=5-1", 1000}, 0, 0, errRangeUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, length, err := parseRange(tt.args.s, tt.args.size)
+			if err != tt.wantErr {
+				t.Fatalf("parseRange() error = %v, want %v", err, tt.wantErr)
+			}
+			if start != tt.wantStart || length != tt.wantLength {
+				t.Errorf("parseRange() = %v, %v, want %v, %v", start, length, tt.wantStart, tt.wantLength)
+			}
+		})
+	}
+}
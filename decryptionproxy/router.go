@@ -0,0 +1,175 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+// bucketPathPrefix starts the paths naming their bucket, /b/<bucket>/<object>
+const bucketPathPrefix = "/b/"
+
+var errNoRoute = errors.New("no route to a bucket")
+
+// errObjectName is returned for object names with empty, . or .. segments.  A hop normalizing paths would take them to
+// another object than the one authorized.
+var errObjectName = errors.New("object names cannot have empty, . or .. segments")
+
+// target is where a request goes: an object in the bucket of a route, encrypted with the settings of that route
+type target struct {
+	env.Route
+
+	// Object is the name of the object in the bucket, empty for the bucket itself
+	Object string
+	// exact is set for objects named as stored, e.g by a listing, which are not looked for with the .enc suffix
+	exact bool
+}
+
+// objectID names the object, to bind its ciphertext to it
+func (t target) objectID() data.ObjectID {
+	return data.ObjectID{
+		Bucket: t.Bucket,
+		Object: t.Object,
+		Tag:    t.AADTag,
+	}
+}
+
+// requestURI is the escaped path and query of the object in its bucket
+func (t target) requestURI(rawQuery string) string {
+	u := url.URL{Path: "/" + t.Object, RawQuery: rawQuery}
+	return u.RequestURI()
+}
+
+// router picks the route of a request.  Routes matching the host and a path prefix win over those matching one of
+// them, and longer prefixes over shorter ones.  Requests matching no route go to the default route, with their path
+// as object name.
+type router struct {
+	routes      []env.Route
+	buckets     map[string]env.Route // served at /b/<bucket>/ when bucketPaths is set
+	bucketPaths bool
+	fallback    env.Route
+}
+
+func newRouter(c env.Config) *router {
+	rr := &router{
+		routes:      c.Routes,
+		buckets:     map[string]env.Route{c.BucketName: c.DefaultRoute()},
+		bucketPaths: c.BucketPaths,
+		fallback:    c.DefaultRoute(),
+	}
+	for _, rt := range c.Routes {
+		if rt.Host == "" && rt.Prefix == "" {
+			rr.buckets[rt.Bucket] = rt
+		}
+	}
+	return rr
+}
+
+// resolve returns the target of the request, or errObjectName for a path naming an object improperly
+func (rr *router) resolve(r *http.Request) (target, error) {
+	t, err := rr.route(r)
+	if err != nil {
+		return target{}, err
+	}
+	if err := checkObjectName(t.Object, false); err != nil {
+		return target{}, err
+	}
+	return t, nil
+}
+
+func (rr *router) route(r *http.Request) (target, error) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var best *env.Route
+	for i := range rr.routes {
+		rt := &rr.routes[i]
+		if rt.Host == "" && rt.Prefix == "" {
+			continue
+		}
+		if rt.Host != "" && rt.Host != host {
+			continue
+		}
+		if rt.Prefix != "" && !strings.HasPrefix(r.URL.Path+"/", rt.Prefix) {
+			continue
+		}
+		if best == nil || moreSpecific(rt, best) {
+			best = rt
+		}
+	}
+	if best != nil {
+		return routeTo(*best, strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(best.Prefix, "/"))), nil
+	}
+
+	if rr.bucketPaths && strings.HasPrefix(r.URL.Path, bucketPathPrefix) {
+		rest := strings.TrimPrefix(r.URL.Path, bucketPathPrefix)
+		bucket, object := rest, ""
+		if i := strings.Index(rest, "/"); i >= 0 {
+			bucket, object = rest[:i], rest[i:]
+		}
+		rt, ok := rr.buckets[bucket]
+		if !ok {
+			return target{}, errors.Wrapf(errNoRoute, "bucket %s", bucket)
+		}
+		return routeTo(rt, object), nil
+	}
+	return routeTo(rr.fallback, r.URL.Path), nil
+}
+
+func moreSpecific(a *env.Route, b *env.Route) bool {
+	if (a.Host != "") != (b.Host != "") {
+		return a.Host != ""
+	}
+	return len(a.Prefix) > len(b.Prefix)
+}
+
+// checkObjectName returns errObjectName unless every segment of name is a proper name.  The prefixes of listings may
+// end with /.  Empty names are those of buckets.
+func checkObjectName(name string, prefix bool) error {
+	if name == "" {
+		return nil
+	}
+	segments := strings.Split(name, "/")
+	if prefix && segments[len(segments)-1] == "" {
+		segments = segments[:len(segments)-1]
+	}
+	for _, s := range segments {
+		if s == "" || s == "." || s == ".." {
+			return errors.Wrapf(errObjectName, "%q", name)
+		}
+	}
+	return nil
+}
+
+// routeTo targets the object at objectPath, relative to the route
+func routeTo(rt env.Route, objectPath string) target {
+	object := strings.TrimPrefix(objectPath, "/")
+	if object != "" {
+		object = rt.ObjectPrefix + object
+	}
+	return target{Route: rt, Object: object}
+}
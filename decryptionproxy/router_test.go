@@ -0,0 +1,83 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+)
+
+func Test_router_resolve(t *testing.T) {
+	c := env.Config{
+		BucketName:   "default",
+		KmsMkekURI:   "local:///kek",
+		KekAllowList: kms.AllowList{"local:///kek"},
+		AAD:          "aad",
+		BucketPaths:  true,
+		Routes: []env.Route{
+			{Prefix: "/finance/", Bucket: "fin", ObjectPrefix: "reports/", AAD: "finance"},
+			{Prefix: "/finance/archive/", Bucket: "archive"},
+			{Host: "media.example.com", Bucket: "media"},
+			{Host: "media.example.com", Prefix: "/raw/", Bucket: "raw"},
+			{Bucket: "logs", AAD: "logs"},
+		},
+	}
+	rr := newRouter(c)
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantBucket string
+		wantObject string
+		wantAAD    string
+		wantErr    bool
+	}{
+		{"default", "proxy:8080", "/a/b.enc", "default", "a/b.enc", "aad", false},
+		{"prefix", "proxy:8080", "/finance/q1.pdf", "fin", "reports/q1.pdf", "finance", false},
+		{"longest prefix", "proxy:8080", "/finance/archive/q1.pdf", "archive", "q1.pdf", "", false},
+		{"prefix root", "proxy:8080", "/finance/", "fin", "", "finance", false},
+		{"not a prefix", "proxy:8080", "/financed.pdf", "default", "financed.pdf", "aad", false},
+		{"host", "Media.Example.com:443", "/cat.png", "media", "cat.png", "", false},
+		{"host and prefix", "media.example.com", "/raw/cat.png", "raw", "cat.png", "", false},
+		{"bucket path", "proxy", "/b/logs/2020/01.log", "logs", "2020/01.log", "logs", false},
+		{"default bucket path", "proxy", "/b/default/a.enc", "default", "a.enc", "aad", false},
+		{"unknown bucket path", "proxy", "/b/other/a.enc", "", "", "", true},
+		{"dot dot segment", "proxy:8080", "/finance/../payroll/june.pdf", "", "", "", true},
+		{"escaped dot dot segment", "proxy:8080", "/finance/%2e%2e/june.pdf", "", "", "", true},
+		{"dot segment", "proxy", "/b/logs/./01.log", "", "", "", true},
+		{"empty segment", "proxy", "/b/logs//01.log", "", "", "", true},
+		{"trailing slash", "proxy", "/a/", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			got, err := rr.resolve(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("router.resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Bucket != tt.wantBucket || got.Object != tt.wantObject || got.AAD != tt.wantAAD {
+				t.Errorf("router.resolve() = %s/%s aad %q, want %s/%s aad %q", got.Bucket, got.Object, got.AAD,
+					tt.wantBucket, tt.wantObject, tt.wantAAD)
+			}
+		})
+	}
+}
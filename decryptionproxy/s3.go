@@ -0,0 +1,321 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+
+	"github.com/sirupsen/logrus"
+)
+
+// s3Handler answers the S3 REST API, addressed path style as /<bucket>/<key>, with the buckets the proxy serves: the
+// default bucket and routes naming only a bucket.  Objects are encrypted and decrypted as through the GCS proxy.
+// Supported are GetObject, HeadObject, PutObject, DeleteObject, ListObjectsV2 and GetBucketLocation, signed with AWS
+// signature version 4 by one of the configured credentials.
+type s3Handler struct {
+	*handler
+	sigV4 sigV4
+}
+
+// s3Unsupported are the query parameters of S3 operations which the proxy does not support, e.g multipart uploads
+var s3Unsupported = []string{"uploads", "uploadId", "partNumber", "versionId", "acl", "tagging", "torrent", "restore", "select"}
+
+// NewS3 returns a tink proxy handler for S3 clients, auditing to auditLog like New
+func NewS3(c env.Config, client *http.Client, auditLog *audit.Log) http.Handler {
+	return &s3Handler{
+		handler: newHandler(c, client, auditLog),
+		sigV4:   sigV4{credentials: c.Proxy.S3Credentials, region: c.Proxy.S3Region, now: time.Now},
+	}
+}
+
+// ServeHTTP checks the signature of the request, then serves the operation it names
+func (s *s3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	sig, err := s.sigV4.verify(r)
+	if err != nil {
+		s.replyS3Error(w, r, err)
+		return
+	}
+	// the access key identifies the client to the policy and the audit log, over any client certificate
+	r = r.WithContext(WithIdentity(r.Context(), Identity{Method: "sigv4", Subject: sig.accessKeyID}))
+
+	bucket, key := strings.TrimPrefix(r.URL.Path, "/"), ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		s.replyS3Error(w, r, &s3Error{"NotImplemented", "ListBuckets is not supported", http.StatusNotImplemented})
+		return
+	}
+	rt, ok := s.router.buckets[bucket]
+	if !ok {
+		s.replyS3Error(w, r, &s3Error{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound})
+		return
+	}
+	query := r.URL.Query()
+	for _, name := range s3Unsupported {
+		if _, ok := query[name]; ok {
+			s.replyS3Error(w, r, &s3Error{"NotImplemented", "?" + name + " is not supported", http.StatusNotImplemented})
+			return
+		}
+	}
+	t := routeTo(rt, key)
+
+	if t.Object == "" {
+		switch _, location := query["location"]; {
+		case r.Method == http.MethodGet && location:
+			s.getBucketLocation(w)
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			if err := authorize(r, methodList, listingTarget(t, query.Get("prefix"))); err != nil {
+				s.replyS3Error(w, r, err)
+				return
+			}
+			s.listObjectsV2(w, r, t, bucket)
+		default:
+			s.replyS3Error(w, r, &s3Error{"NotImplemented", r.Method + " on a bucket is not supported", http.StatusNotImplemented})
+		}
+		return
+	}
+
+	if err := authorize(r, policyMethod(r), t); err != nil {
+		s.replyS3Error(w, r, err)
+		return
+	}
+
+	gcsReq := gcsRequest(r)
+	switch r.Method {
+	case http.MethodGet:
+		s.serveGet(&s3ResponseWriter{ResponseWriter: w, r: r}, gcsReq, t)
+	case http.MethodHead:
+		s.serveHead(&s3ResponseWriter{ResponseWriter: w, r: r}, gcsReq, t)
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			s.replyS3Error(w, r, &s3Error{"NotImplemented", "CopyObject is not supported", http.StatusNotImplemented})
+			return
+		}
+		body, size, err := sig.body(r)
+		if err != nil {
+			s.replyS3Error(w, r, err)
+			return
+		}
+		s.putObject(w, gcsReq, t, body, size)
+	case http.MethodDelete:
+		s.deleteS3Object(w, gcsReq, t)
+	default:
+		s.replyS3Error(w, r, &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource.", http.StatusMethodNotAllowed})
+	}
+}
+
+// gcsRequest strips the request of what only concerns S3: the signature, the query and the x-amz headers.  Metadata
+// is renamed for GCS.
+func gcsRequest(r *http.Request) *http.Request {
+	gcsReq := r.Clone(r.Context())
+	gcsReq.URL.RawQuery = ""
+	gcsReq.Header.Del("Authorization")
+	gcsReq.Header.Del("Content-Encoding")
+	for k, vv := range r.Header {
+		if !strings.HasPrefix(k, "X-Amz-") {
+			continue
+		}
+		gcsReq.Header.Del(k)
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			gcsReq.Header["X-Goog-Meta-"+strings.TrimPrefix(k, "X-Amz-Meta-")] = vv
+		}
+	}
+	return gcsReq
+}
+
+// s3ResponseWriter renames the metadata of GCS responses for S3 clients.  Failures are replaced by the S3 error document
+// of their status, the GCS proxy having logged their cause.
+type s3ResponseWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	failed bool
+}
+
+func (w *s3ResponseWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest {
+		w.failed = true
+		code, ok := s3StatusCodes[status]
+		if !ok {
+			code = "InternalError"
+		}
+		for _, k := range []string{"Content-Type", "Content-Length", "X-Content-Type-Options"} {
+			w.Header().Del(k)
+		}
+		writeS3Error(w.ResponseWriter, w.r, &s3Error{Code: code, Message: s3Messages[code], Status: status})
+		return
+	}
+
+	header := w.Header()
+	for k, vv := range header {
+		if strings.HasPrefix(k, "X-Goog-Meta-") {
+			header["X-Amz-Meta-"+strings.TrimPrefix(k, "X-Goog-Meta-")] = vv
+			delete(header, k)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *s3ResponseWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// putObject encrypts the payload into the object
+func (s *s3Handler) putObject(w http.ResponseWriter, r *http.Request, t target, body io.Reader, size int64) {
+	gcsResp, err := s.upload(r.Context(), t, body, size, r.Header, fileAttributes(r.Header))
+	if err != nil {
+		s.replyS3Error(w, r, err)
+		return
+	}
+	defer gcsResp.Body.Close()
+
+	s.relay(RespWrapper{Status: http.StatusOK, ResponseWriter: w}, gcsResp)
+}
+
+// deleteS3Object deletes the object.  As in S3, deleting a missing object succeeds.
+func (s *s3Handler) deleteS3Object(w http.ResponseWriter, r *http.Request, t target) {
+	gcsResp, err := s.deleteObject(r.Context(), t)
+	if err != nil {
+		s.replyS3Error(w, r, err)
+		return
+	}
+	defer gcsResp.Body.Close()
+
+	if gcsResp.StatusCode == http.StatusNotFound || gcsResp.StatusCode == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s.relay(RespWrapper{Status: http.StatusOK, ResponseWriter: w}, gcsResp)
+}
+
+func (s *s3Handler) listObjectsV2(w http.ResponseWriter, r *http.Request, t target, bucket string) {
+	result, gcsResp, err := s.listObjects(r.Context(), t, r.URL.Query())
+	if err != nil {
+		s.replyS3Error(w, r, err)
+		return
+	}
+	if gcsResp != nil {
+		defer gcsResp.Body.Close()
+		s.relay(RespWrapper{Status: http.StatusOK, ResponseWriter: w}, gcsResp)
+		return
+	}
+
+	s.plaintextList(r.Context(), gcsRequest(r), t, &result)
+	result.Xmlns = s3Namespace
+	result.Name = bucket
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *s3Handler) getBucketLocation(w http.ResponseWriter) {
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"LocationConstraint"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:",chardata"`
+	}{Xmlns: s3Namespace, Location: s.sigV4.region})
+}
+
+// s3Messages are the messages of the S3 error codes reported for failures which are not S3 errors.  The cause is
+// logged, never sent to the client.
+var s3Messages = map[string]string{
+	"InternalError":      "We encountered an internal error. Please try again.",
+	"AccessDenied":       "Access Denied",
+	"ServiceUnavailable": "Please reduce your request rate.",
+	"InvalidObjectState": "The operation is not valid for the current state of the object.",
+	"InvalidRequest":     "Invalid Request",
+	"NoSuchKey":          "The specified key does not exist.",
+	"PreconditionFailed": "At least one of the pre-conditions you specified did not hold",
+	"InvalidRange":       "The requested range is not satisfiable",
+}
+
+// s3StatusCodes are the S3 error codes of the statuses of failed GetObject and HeadObject requests
+var s3StatusCodes = map[int]string{
+	http.StatusBadRequest:                   "InvalidRequest",
+	http.StatusForbidden:                    "AccessDenied",
+	http.StatusNotFound:                     "NoSuchKey",
+	http.StatusPreconditionFailed:           "PreconditionFailed",
+	http.StatusRequestedRangeNotSatisfiable: "InvalidRange",
+	http.StatusServiceUnavailable:           "ServiceUnavailable",
+}
+
+// replyS3Error reports the error as an S3 error document.  Failures of the data package are reported with the status
+// of the GCS proxy, see statusFor.
+func (s *s3Handler) replyS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		code := "InternalError"
+		switch {
+		case errors.Is(err, kms.ErrKekNotAllowed), errors.Is(err, errForbidden):
+			code = "AccessDenied"
+		case errors.Is(err, errObjectName):
+			code = "InvalidRequest"
+		case data.KindOf(err) == data.KindKMS:
+			code = "ServiceUnavailable"
+		case data.KindOf(err) == data.KindEnvelope:
+			code = "InvalidObjectState"
+		}
+		s3Err = &s3Error{Code: code, Message: s3Messages[code], Status: statusFor(err)}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"response": s3Err.Status,
+		"code":     s3Err.Code,
+	}).Errorf("S3 %s %s failed %+v", r.Method, r.URL.Path, err)
+	writeS3Error(w, r, s3Err)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, s3Err *s3Error) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.Status)
+		return
+	}
+	writeXML(w, s3Err.Status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string   `xml:"Code"`
+		Message  string   `xml:"Message"`
+		Resource string   `xml:"Resource"`
+	}{Code: s3Err.Code, Message: s3Err.Message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(b)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
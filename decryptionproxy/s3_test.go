@@ -0,0 +1,266 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/env"
+)
+
+const (
+	testAccessKey    = "AKIDTEST"
+	testSecret       = "secret"
+	testReaderKey    = "AKIDREADER"
+	testReaderSecret = "reader secret"
+)
+
+// signS3 signs the request as S3 clients do, with the payload hash in payloadHash
+func signS3(t *testing.T, r *http.Request, payloadHash string) {
+	signS3As(t, r, payloadHash, testAccessKey, testSecret)
+}
+
+// signS3As signs the request with the credentials of another client
+func signS3As(t *testing.T, r *http.Request, payloadHash string, accessKey string, secret string) {
+	now := time.Now().UTC()
+	r.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	sig := signature{
+		date:  now.Format(sigV4TimeFormat),
+		scope: now.Format("20060102") + "/us-east-1/s3/aws4_request",
+		key:   signingKey(secret, now.Format("20060102"), "us-east-1"),
+	}
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s", sigV4Algorithm,
+		accessKey, sig.scope, strings.Join(signedHeaders, ";"), sig.sign(sigV4Algorithm, hashHex([]byte(canonicalRequest)))))
+}
+
+func testS3Proxy(t *testing.T, decorators ...Decorator) (*httptest.Server, *fakeGCS) {
+	c, client, gcs := testGCS(t)
+	c.Proxy.S3Credentials = map[string]string{testAccessKey: testSecret, testReaderKey: testReaderSecret}
+	c.Proxy.S3Region = "us-east-1"
+	c.Routes = []env.Route{{Bucket: "archive", ObjectPrefix: "s3/", KmsMkekURI: c.KmsMkekURI, KekAllowList: c.KekAllowList,
+		AAD: c.AAD, AADMode: c.AADMode}}
+
+	s3 := httptest.NewServer(Decorate(NewS3(c, client, nil), decorators...))
+	t.Cleanup(s3.Close)
+	return s3, gcs
+}
+
+func s3Do(t *testing.T, method string, rawurl string, body string, header http.Header) (*http.Response, string) {
+	r, err := http.NewRequest(method, rawurl, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	if r.Header.Get("Authorization") == "" {
+		signS3(t, r, hashHex([]byte(body)))
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestS3Handler(t *testing.T) {
+	s3, gcs := testS3Proxy(t)
+	plaintext := "four score and seven years ago"
+
+	resp, _ := s3Do(t, http.MethodPut, s3.URL+"/archive/speech/gettysburg.txt", plaintext, http.Header{"X-Amz-Meta-Author": {"lincoln"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PutObject status = %v", resp.StatusCode)
+	}
+	if _, ok := gcs.objects["archive/s3/speech/gettysburg.txt"]; !ok {
+		t.Fatalf("PutObject did not store under the object prefix, have %v", gcs.objects)
+	}
+	if got := gcs.metadata["archive/s3/speech/gettysburg.txt"].Get("X-Goog-Meta-Author"); got != "" {
+		t.Errorf("PutObject stored the metadata in the clear: %q", got)
+	}
+
+	// bound to another name, so it fails to decrypt
+	gcs.objects["archive/s3/copied.txt"] = gcs.objects["archive/s3/speech/gettysburg.txt"]
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     http.Header
+		wantStatus int
+		check      func(t *testing.T, resp *http.Response, body string)
+	}{
+		{"GetObject", http.MethodGet, "/archive/speech/gettysburg.txt", nil, http.StatusOK, func(t *testing.T, resp *http.Response, body string) {
+			if body != plaintext {
+				t.Errorf("GetObject body = %q, want %q", body, plaintext)
+			}
+			if got := resp.Header.Get("X-Amz-Meta-Author"); got != "lincoln" {
+				t.Errorf("GetObject x-amz-meta-author = %q, want %q", got, "lincoln")
+			}
+		}},
+		{"GetObject range", http.MethodGet, "/archive/speech/gettysburg.txt", http.Header{"Range": {"bytes=5-9"}}, http.StatusPartialContent, func(t *testing.T, resp *http.Response, body string) {
+			if body != "score" {
+				t.Errorf("GetObject body = %q, want %q", body, "score")
+			}
+		}},
+		{"HeadObject", http.MethodHead, "/archive/speech/gettysburg.txt", nil, http.StatusOK, func(t *testing.T, resp *http.Response, body string) {
+			if resp.ContentLength != int64(len(plaintext)) {
+				t.Errorf("HeadObject Content-Length = %v, want %v", resp.ContentLength, len(plaintext))
+			}
+			if got := resp.Header.Get("X-Amz-Meta-Author"); got != "lincoln" {
+				t.Errorf("HeadObject x-amz-meta-author = %q, want %q", got, "lincoln")
+			}
+		}},
+		{"HeadObject missing", http.MethodHead, "/archive/missing.txt", nil, http.StatusNotFound, nil},
+		{"GetObject missing", http.MethodGet, "/archive/missing.txt", nil, http.StatusNotFound, func(t *testing.T, resp *http.Response, body string) {
+			if !strings.Contains(body, "<Code>NoSuchKey</Code>") {
+				t.Errorf("error = %s", body)
+			}
+		}},
+		{"ListObjectsV2", http.MethodGet, "/archive?list-type=2&prefix=speech/", nil, http.StatusOK, func(t *testing.T, resp *http.Response, body string) {
+			var result listBucketResult
+			if err := xml.Unmarshal([]byte(body), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Name != "archive" || len(result.Contents) != 1 || result.Contents[0].Key != "speech/gettysburg.txt" {
+				t.Errorf("ListObjectsV2 = %+v", result)
+			}
+		}},
+		{"GetBucketLocation", http.MethodGet, "/archive?location", nil, http.StatusOK, func(t *testing.T, resp *http.Response, body string) {
+			if !strings.Contains(body, ">us-east-1<") {
+				t.Errorf("GetBucketLocation = %s", body)
+			}
+		}},
+		{"unknown bucket", http.MethodGet, "/other/gettysburg.txt", nil, http.StatusNotFound, func(t *testing.T, resp *http.Response, body string) {
+			if !strings.Contains(body, "<Code>NoSuchBucket</Code>") {
+				t.Errorf("error = %s", body)
+			}
+		}},
+		{"GetObject undecryptable", http.MethodGet, "/archive/copied.txt", nil, http.StatusBadGateway, func(t *testing.T, resp *http.Response, body string) {
+			want := "<Code>InternalError</Code><Message>" + s3Messages["InternalError"] + "</Message>"
+			if !strings.Contains(body, want) {
+				t.Errorf("error = %s, want the fixed message %s", body, want)
+			}
+		}},
+		{"multipart upload", http.MethodPost, "/archive/big.bin?uploads", nil, http.StatusNotImplemented, nil},
+		{"bad signature", http.MethodGet, "/archive/speech/gettysburg.txt", http.Header{"Authorization": {"AWS4-HMAC-SHA256 Credential=" + testAccessKey +
+			"/20200101/us-east-1/s3/aws4_request,SignedHeaders=host,Signature=00"}, "X-Amz-Date": {"20200101T000000Z"}}, http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s3Do(t, tt.method, s3.URL+tt.path, "", tt.header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.check != nil {
+				tt.check(t, resp, body)
+			}
+		})
+	}
+
+	resp, _ = s3Do(t, http.MethodDelete, s3.URL+"/archive/speech/gettysburg.txt", "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DeleteObject status = %v, want %v", resp.StatusCode, http.StatusNoContent)
+	}
+	if _, ok := gcs.objects["archive/s3/speech/gettysburg.txt"]; ok {
+		t.Errorf("DeleteObject left the object in GCS")
+	}
+}
+
+func TestS3Handler_putTamperedPayload(t *testing.T) {
+	s3, gcs := testS3Proxy(t)
+
+	r, err := http.NewRequest(http.MethodPut, s3.URL+"/archive/tampered.txt", strings.NewReader("tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signS3(t, r, hashHex([]byte("original")))
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("PutObject of a tampered payload succeeded")
+	}
+	if _, ok := gcs.objects["archive/s3/tampered.txt"]; ok {
+		t.Errorf("PutObject of a tampered payload was stored")
+	}
+}
+
+func TestS3Handler_policy(t *testing.T) {
+	policy := env.Policy{Default: env.PolicyDeny, Rules: []env.PolicyRule{
+		{Effect: env.PolicyAllow, Identities: []string{testAccessKey}, Objects: []string{"archive/"}},
+		{Effect: env.PolicyAllow, Identities: []string{testReaderKey}, Methods: []string{http.MethodGet, methodList}, Objects: []string{"archive/s3/public/"}},
+	}}
+	e := newPolicyEnforcer(env.Config{Policy: &policy}, quietLogger())
+	s3, _ := testS3Proxy(t, e.decorate)
+
+	if resp, _ := s3Do(t, http.MethodPut, s3.URL+"/archive/public/a.txt", "a", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PutObject status = %v", resp.StatusCode)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		accessKey  string
+		secret     string
+		wantStatus int
+	}{
+		{"writer reads", http.MethodGet, "/archive/public/a.txt", testAccessKey, testSecret, http.StatusOK},
+		{"reader reads", http.MethodGet, "/archive/public/a.txt", testReaderKey, testReaderSecret, http.StatusOK},
+		{"reader lists", http.MethodGet, "/archive?list-type=2&prefix=public/", testReaderKey, testReaderSecret, http.StatusOK},
+		{"reader cannot write", http.MethodPut, "/archive/public/b.txt", testReaderKey, testReaderSecret, http.StatusForbidden},
+		{"reader outside the prefix", http.MethodGet, "/archive/private/a.txt", testReaderKey, testReaderSecret, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(tt.method, s3.URL+tt.path, strings.NewReader(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			signS3As(t, r, hashHex(nil), tt.accessKey, tt.secret)
+			resp, body := s3Do(t, tt.method, s3.URL+tt.path, "", r.Header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %v, want %v: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS signature version 4, as S3 clients sign requests, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4MaxSkew        = 15 * time.Minute
+	unsignedPayload     = "UNSIGNED-PAYLOAD"
+	streamingPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer    = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	chunkSigV4Algorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+
+	// maxChunkSize bounds the chunks of aws-chunked bodies, which are read into memory to check their signature
+	maxChunkSize = 16 << 20
+)
+
+// emptySHA256 is the hex SHA256 of no bytes
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// s3Error is reported to S3 clients as an XML error document
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied       = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errInvalidAccessKeyID = &s3Error{"InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records.", http.StatusForbidden}
+	errSignatureMismatch  = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	errTimeTooSkewed      = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	errContentSHA256      = &s3Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	errIncompleteBody     = &s3Error{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", http.StatusBadRequest}
+)
+
+// sigV4 checks requests signed with the secret of one of credentials, an access key id to secret map, for region
+type sigV4 struct {
+	credentials map[string]string
+	region      string
+	now         func() time.Time
+}
+
+// signature is what a verified request was signed with, to check the chunks of a streaming body
+type signature struct {
+	accessKeyID string // of the credentials of the client
+	date        string // of the request, in sigV4TimeFormat
+	scope       string // date/region/s3/aws4_request
+	key         []byte
+	seed        string // signature of the request, which chains the chunk signatures
+}
+
+// verify checks the signature in the Authorization header of the request.  The payload is not read, see body.
+func (v sigV4) verify(r *http.Request) (signature, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return signature{}, errAccessDenied
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	// Credential=<access key id>/<date>/<region>/s3/aws4_request
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return signature{}, errAccessDenied
+	}
+	secret, ok := v.credentials[credential[0]]
+	if !ok {
+		return signature{}, errInvalidAccessKeyID
+	}
+	if credential[2] != v.region {
+		return signature{}, &s3Error{"AuthorizationHeaderMalformed", "the region '" + credential[2] + "' is wrong; expecting '" + v.region + "'", http.StatusBadRequest}
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(sigV4TimeFormat, date)
+	if err != nil || !strings.HasPrefix(date, credential[1]) {
+		return signature{}, errAccessDenied
+	}
+	if skew := v.now().Sub(t); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return signature{}, errTimeTooSkewed
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return signature{}, &s3Error{"InvalidRequest", "Missing required header for this request: x-amz-content-sha256", http.StatusBadRequest}
+	}
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !contains(signedHeaders, "host") {
+		return signature{}, errAccessDenied
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, signedHeaders),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+
+	sig := signature{
+		accessKeyID: credential[0],
+		date:        date,
+		scope:       strings.Join(credential[1:], "/"),
+		key:         signingKey(secret, credential[1], credential[2]),
+	}
+	sig.seed = sig.sign(sigV4Algorithm, hashHex([]byte(canonicalRequest)))
+	if !hmac.Equal([]byte(sig.seed), []byte(fields["Signature"])) {
+		return signature{}, errSignatureMismatch
+	}
+	return sig, nil
+}
+
+// sign returns the hex signature of the string to sign made of the algorithm, the request date and scope, and lines
+func (s signature) sign(algorithm string, lines ...string) string {
+	stringToSign := strings.Join(append([]string{algorithm, s.date, s.scope}, lines...), "\n")
+	return hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+}
+
+// body returns the payload of the verified request, decoding aws-chunked bodies and checking their chunk signatures.
+// The payload hash is checked as it is read, the reader fails at the end of a body which does not match.
+func (s signature) body(r *http.Request) (io.Reader, int64, error) {
+	switch payloadHash := r.Header.Get("X-Amz-Content-Sha256"); payloadHash {
+	case unsignedPayload:
+		return r.Body, r.ContentLength, nil
+	case streamingPayload, streamingTrailer:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return nil, 0, &s3Error{"MissingContentLength", "You must provide the x-amz-decoded-content-length HTTP header.", http.StatusLengthRequired}
+		}
+		return &chunkReader{r: bufio.NewReader(r.Body), sig: s, signed: payloadHash == streamingPayload, prev: s.seed}, size, nil
+	default:
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return nil, 0, errContentSHA256
+		}
+		return &hashReader{r: r.Body, h: sha256.New(), want: want}, r.ContentLength, nil
+	}
+}
+
+// hashReader fails at the end of a payload whose SHA256 is not the one signed
+type hashReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(hr.h.Sum(nil), hr.want) {
+		return n, errContentSHA256
+	}
+	return n, err
+}
+
+// chunkReader decodes an aws-chunked body: chunks of <hex size>[;chunk-signature=<signature>]\r\n<data>\r\n ending
+// with an empty chunk, optionally followed by trailing headers.  Signed chunks chain their signatures from the one of
+// the request.
+type chunkReader struct {
+	r      *bufio.Reader
+	sig    signature
+	signed bool
+	prev   string // signature of the previous chunk
+	chunk  []byte
+	done   bool
+	err    error
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 && cr.err == nil {
+		if cr.done {
+			cr.err = io.EOF
+			break
+		}
+		cr.err = cr.next()
+	}
+	if len(cr.chunk) == 0 {
+		return 0, cr.err
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) next() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, chunkSignature := line, ""
+	if i := strings.Index(line, ";"); i >= 0 {
+		sizeField, chunkSignature = line[:i], strings.TrimPrefix(line[i+1:], "chunk-signature=")
+	}
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return &s3Error{"InvalidChunkSizeError", fmt.Sprintf("The chunk size is invalid or exceeds %d bytes", maxChunkSize), http.StatusBadRequest}
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, chunk); err != nil {
+		return errIncompleteBody
+	}
+	if cr.signed {
+		want := cr.sig.sign(chunkSigV4Algorithm, cr.prev, emptySHA256, hashHex(chunk))
+		if !hmac.Equal([]byte(want), []byte(chunkSignature)) {
+			return errSignatureMismatch
+		}
+		cr.prev = want
+	}
+
+	if size == 0 {
+		// the empty chunk is followed by trailing headers, if any, and an empty line
+		cr.done = true
+		for {
+			trailer, err := cr.readLine()
+			if err != nil || trailer == "" {
+				return err
+			}
+		}
+	}
+	if line, err := cr.readLine(); err != nil || line != "" {
+		return errIncompleteBody
+	}
+	cr.chunk = chunk
+	return nil
+}
+
+func (cr *chunkReader) readLine() (string, error) {
+	line, err := cr.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errIncompleteBody
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// canonicalQuery sorts the parameters by encoded name, then encoded value
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for k, vv := range query {
+		for _, v := range vv {
+			params = append(params, [2]string{uriEncode(k, true), uriEncode(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	joined := make([]string, len(params))
+	for i, p := range params {
+		joined[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(joined, "&")
+}
+
+// canonicalHeaders lists the signed headers, each on a line, with their values trimmed
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			var values []string
+			for _, v := range r.Header[http.CanonicalHeaderKey(name)] {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	return b.String()
+}
+
+// uriEncode escapes all but the unreserved characters, and slashes unless encodeSlash
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret string, date string, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
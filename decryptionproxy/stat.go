@@ -0,0 +1,148 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+)
+
+// objectInfo describes the plaintext of an object
+type objectInfo struct {
+	envelope data.EncryptedData
+	size     int64       // of the plaintext
+	header   http.Header // of the GCS response, describing the stored object
+}
+
+// statProbeSize is how much of the head of an object is fetched to find its envelope, which is usually much smaller
+const statProbeSize = 4 << 10
+
+// stat reads the envelope at the head of the object to find the size of its plaintext.  When GCS does not answer with
+// the object, e.g it is not found, its response is returned to be relayed and must be closed.
+func (h *handler) stat(ctx context.Context, r *http.Request, t target) (objectInfo, *http.Response, error) {
+	probe, err := h.fetchObject(&t, func(t target) (*http.Response, error) {
+		return h.fetchRange(ctx, r, t, 0, statProbeSize)
+	})
+	if err != nil {
+		return objectInfo{}, nil, err
+	}
+	if probe.StatusCode != http.StatusOK && probe.StatusCode != http.StatusPartialContent {
+		probe, err = buffered(probe)
+		return objectInfo{}, probe, err
+	}
+	defer probe.Body.Close()
+
+	objectSize, err := objectSize(probe)
+	if err != nil {
+		return objectInfo{}, nil, err
+	}
+	b, envelopeSize, err := data.ReadEnvelope(bufio.NewReader(probe.Body))
+
+	// the envelope may be larger than the probe, e.g when it carries the ciphertext
+	if err != nil && objectSize > statProbeSize && b.Version != 0 {
+		return h.statWhole(ctx, r, t)
+	}
+	if err != nil {
+		envelopeFailures.Inc()
+		return objectInfo{}, nil, err
+	}
+	return plaintextInfo(b, objectSize, envelopeSize, probe.Header)
+}
+
+// statWhole reads the envelope from the start of the whole object
+func (h *handler) statWhole(ctx context.Context, r *http.Request, t target) (objectInfo, *http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, h.objectURL(t, ""), nil)
+	if err != nil {
+		return objectInfo{}, nil, err
+	}
+	req = req.WithContext(ctx)
+	copyReqHeader(req.Header, r.Header)
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+
+	gcsResp, err := h.restClient.Do(req)
+	if err != nil {
+		return objectInfo{}, nil, errors.Wrap(err, "cannot fetch object from GCS")
+	}
+	if gcsResp.StatusCode != http.StatusOK {
+		gcsResp, err = buffered(gcsResp)
+		return objectInfo{}, gcsResp, err
+	}
+
+	// the ciphertext of streams is not needed, the body is closed once the envelope is read
+	defer gcsResp.Body.Close()
+	b, envelopeSize, err := readEnvelope(bufio.NewReader(gcsResp.Body))
+	if err != nil {
+		return objectInfo{}, nil, err
+	}
+	return plaintextInfo(b, gcsResp.ContentLength, envelopeSize, gcsResp.Header)
+}
+
+func plaintextInfo(b data.EncryptedData, objectSize int64, envelopeSize int, header http.Header) (objectInfo, *http.Response, error) {
+	info := objectInfo{envelope: b, header: header}
+	var err error
+	if b.IsStream() {
+		info.size, err = b.PlaintextSize(objectSize - int64(envelopeSize))
+	} else {
+		info.size, err = b.DataSize()
+	}
+	return info, nil, err
+}
+
+// fetchObject fetches the object of t.  An object missing from GCS is looked for again with the .enc suffix, which
+// listings hide, and t is updated to the object found.
+func (h *handler) fetchObject(t *target, fetch func(t target) (*http.Response, error)) (*http.Response, error) {
+	defer observePhase(phaseGCSFetch, time.Now())
+	gcsResp, err := fetch(*t)
+	if err != nil || gcsResp.StatusCode != http.StatusNotFound || t.exact || strings.HasSuffix(t.Object, encSuffix) {
+		return gcsResp, err
+	}
+
+	encrypted := *t
+	encrypted.Object += encSuffix
+	encResp, err := fetch(encrypted)
+	if err != nil {
+		return gcsResp, nil
+	}
+	if encResp.StatusCode == http.StatusNotFound {
+		encResp.Body.Close()
+		return gcsResp, nil
+	}
+	gcsResp.Body.Close()
+	*t = encrypted
+	return encResp, nil
+}
+
+// buffered reads the body of a GCS response, which is relayed to the client after its request context is gone
+func buffered(gcsResp *http.Response) (*http.Response, error) {
+	body, err := ioutil.ReadAll(gcsResp.Body)
+	gcsResp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read GCS response")
+	}
+	gcsResp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return gcsResp, nil
+}
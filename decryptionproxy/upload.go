@@ -0,0 +1,277 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package decryptionproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/audit"
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/data"
+
+	"github.com/sirupsen/logrus"
+)
+
+// form fields other than the file are small, bound what is read for them
+const maxFormFieldSize = 64 << 10
+
+// headers describing the client's plaintext body, which do not apply to the envelope stored in GCS
+var plaintextHeaders = []string{"Content-Length", "Content-Type", "Content-Disposition", "Content-MD5", "X-Goog-Hash", "Expect"}
+
+// servePut encrypts the request body and stores the envelope in GCS under the requested object name
+func (h *handler) servePut(w http.ResponseWriter, r *http.Request, t target) {
+	resp := RespWrapper{
+		Status:         http.StatusOK,
+		ResponseWriter: w,
+	}
+
+	gcsResp, err := h.upload(r.Context(), t, r.Body, r.ContentLength, r.Header, fileAttributes(r.Header))
+	if err != nil {
+		h.uploadFailed(&resp, err, statusFor(err))
+		return
+	}
+	defer gcsResp.Body.Close()
+
+	copyRespHeader(resp, gcsResp)
+	if _, errCopy := io.Copy(resp, gcsResp.Body); errCopy != nil {
+		h.logger.WithError(errCopy).Warn("could not relay GCS response")
+	}
+}
+
+// servePost supports the XML API POST object: a multipart form carrying the object name in the "key" field
+// followed by the content in the "file" field.  The content is encrypted and stored with a PUT to GCS.
+func (h *handler) servePost(w http.ResponseWriter, r *http.Request, t target) {
+	resp := RespWrapper{
+		Status:         http.StatusOK,
+		ResponseWriter: w,
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		err = errors.Wrap(err, "POST object requires a multipart/form-data body")
+		h.uploadFailed(&resp, err, http.StatusBadRequest)
+		return
+	}
+
+	// GCS requires the file to be the last field of the form, so every other field is known by the time it is read
+	fields := map[string]string{}
+	var file *multipart.Part
+	for file == nil {
+		part, errPart := mr.NextPart()
+		if errPart == io.EOF {
+			break
+		}
+		if errPart != nil {
+			err = errors.Wrap(errPart, "malformed multipart form")
+			h.uploadFailed(&resp, err, http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == "file" {
+			file = part
+			continue
+		}
+		value, errRead := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		if errRead != nil {
+			err = errors.Wrapf(errRead, "cannot read form field %s", part.FormName())
+			h.uploadFailed(&resp, err, http.StatusBadRequest)
+			return
+		}
+		fields[strings.ToLower(part.FormName())] = string(value)
+	}
+
+	if file == nil || fields["key"] == "" {
+		err = errors.New("POST object requires both key and file fields")
+		h.uploadFailed(&resp, err, http.StatusBadRequest)
+		return
+	}
+
+	key := strings.Replace(fields["key"], "${filename}", file.FileName(), -1)
+	t = routeTo(t.Route, key)
+	if err = authorize(r, http.MethodPost, t); err != nil {
+		replyError(&resp, errors.Cause(err), statusFor(err))
+		return
+	}
+
+	header := http.Header{}
+	if contentType := file.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	for name, value := range fields {
+		if strings.HasPrefix(name, "x-goog-meta-") || name == "content-type" || name == "content-disposition" {
+			header.Set(name, value)
+		}
+	}
+	attrs := fileAttributes(header)
+	if attrs.FileName == "" {
+		attrs.FileName = file.FileName()
+	}
+
+	gcsResp, err := h.upload(r.Context(), t, file, -1, header, attrs)
+	if err != nil {
+		h.uploadFailed(&resp, err, statusFor(err))
+		return
+	}
+	defer gcsResp.Body.Close()
+
+	if gcsResp.StatusCode != http.StatusOK {
+		copyRespHeader(resp, gcsResp)
+		if _, errCopy := io.Copy(resp, gcsResp.Body); errCopy != nil {
+			h.logger.WithError(errCopy).Warn("could not relay GCS response")
+		}
+		return
+	}
+
+	// same as GCS: 204 unless the form asks for 200 or 201
+	switch fields["success_action_status"] {
+	case "200":
+		resp.SaveStatus(http.StatusOK)
+	case "201":
+		resp.SaveStatus(http.StatusCreated)
+	default:
+		resp.SaveStatus(http.StatusNoContent)
+	}
+}
+
+// upload streams the plaintext through Tink streaming AEAD with a new DEK and PUTs the envelope followed by the
+// ciphertext to GCS.  When the plaintext size is known (not negative), so is the size of the upload.  The envelope
+// records the attributes of the file sent and the custom metadata of the client encrypted, so GCS never stores them.
+// Every upload is audited, failed or not, and one which cannot be fails.
+func (h *handler) upload(ctx context.Context, t target, plaintext io.Reader, plaintextSize int64, clientHeader http.Header, attrs data.FileAttributes) (gcsResp *http.Response, err error) {
+	rec := newAuditRecord(ctx, audit.ActionEncrypt, t)
+	rec.KEK = t.KmsMkekURI
+	defer func() {
+		if errAudit := h.audited(rec, err); errAudit != nil && err == nil {
+			gcsResp, err = nil, errAudit
+		}
+	}()
+
+	kmsClient, err := h.kmsClient(t, t.KmsMkekURI)
+	if err != nil {
+		return nil, err
+	}
+
+	ee := data.NewEncryptionEngine(t.KmsMkekURI, "", kmsClient, h.logger)
+	if err := ee.BindAAD(t.AADMode, t.AAD, t.objectID()); err != nil {
+		return nil, err
+	}
+	envelope, err := ee.PackageStream()
+	if err != nil {
+		if data.KindOf(err) == data.KindKMS {
+			kmsErrors.WithLabelValues("wrap").Inc()
+		}
+		return nil, err
+	}
+	envelope.FileAttributes = attrs
+	meta := userMetadata(clientHeader)
+	if err := ee.SealMetadata(&envelope, meta); err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	if _, err := data.WriteEnvelope(&header, envelope); err != nil {
+		return nil, err
+	}
+	contentLength := int64(-1)
+	if plaintextSize >= 0 {
+		ciphertextSize, err := envelope.CiphertextSize(plaintextSize)
+		if err != nil {
+			return nil, err
+		}
+		contentLength = int64(header.Len()) + ciphertextSize
+	}
+
+	// objects may be of any size, so the transfer is only bound by its progress
+	transferCtx, transfer, stop := watchProgress(ctx, h.config.Proxy.Timeout)
+	defer stop()
+	digest, err := newPlaintextDigest(transfer.reader(plaintext), clientHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypt into a pipe read by the GCS request, so the object never sits in memory
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := ee.ObfuscateStream(pw)
+		if err == nil {
+			_, err = io.Copy(w, digest)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	body := io.MultiReader(&header, pr)
+
+	proxyToGCSReq, err := http.NewRequest(http.MethodPut, h.objectURL(t, ""), ioutil.NopCloser(body))
+	if err != nil {
+		return nil, err
+	}
+	proxyToGCSReq = proxyToGCSReq.WithContext(transferCtx)
+
+	copyReqHeader(proxyToGCSReq.Header, clientHeader)
+	for _, k := range plaintextHeaders {
+		proxyToGCSReq.Header.Del(k)
+	}
+	for k := range proxyToGCSReq.Header {
+		if strings.HasPrefix(k, userMetaPrefix) {
+			proxyToGCSReq.Header.Del(k)
+		}
+	}
+	proxyToGCSReq.Header.Set(metaEnvelopeSize, strconv.Itoa(header.Len()))
+	proxyToGCSReq.Header.Set("Content-Type", "application/octet-stream")
+	proxyToGCSReq.ContentLength = contentLength
+
+	gcsResp, err = h.restClient.Do(proxyToGCSReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot upload envelope to GCS")
+	}
+	if gcsResp, err = buffered(gcsResp); err != nil {
+		return nil, err
+	}
+	stop()
+
+	if gcsResp.StatusCode != http.StatusOK {
+		rec.Outcome = "gcs: " + gcsResp.Status
+	} else {
+		rec.Generation = gcsResp.Header.Get("X-Goog-Generation")
+		rec.Bytes = digest.size
+		ctx, cancel := context.WithTimeout(ctx, h.config.Proxy.Timeout)
+		defer cancel()
+		if err := h.describeObject(ctx, t, gcsResp.Header.Get("X-Goog-Generation"), ee, digest); err != nil {
+			h.logger.WithError(err).Warnf("%s is stored without the size and checksums of its plaintext", t.Object)
+		}
+	}
+	return gcsResp, nil
+}
+
+// uploadFailed logs the error and reports the status to the client
+func (h *handler) uploadFailed(resp *RespWrapper, err error, status int) {
+	h.logger.WithFields(logrus.Fields{
+		"response": status,
+	}).WithError(err).Errorf("failed while encrypting %+v", err)
+	replyError(resp, err, status)
+}
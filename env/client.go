@@ -19,7 +19,10 @@ package env
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -29,9 +32,50 @@ import (
 
 // ClientConfig for Google Cloud Storage
 type ClientConfig struct {
+	// Timeout bounds connecting to GCS, the TLS handshake and waiting for the headers of a response, but not the
+	// transfer of bodies, which objects of any size would outlast
 	Timeout         time.Duration `split_words:"true" default:"3s"`
 	IdleConnTimeout time.Duration `split_words:"true" default:"60s"`
 	MaxIdleConns    int           `split_words:"true" default:"30"`
+
+	// Endpoint is the host, and optional port, of the storage XML API.  Scheme is http or https.  With PathStyle,
+	// objects are addressed as <endpoint>/<bucket>/<object> rather than <bucket>.<endpoint>/<object>.
+	// STORAGE_EMULATOR_HOST overrides them, for a local stand-in such as fake-gcs-server.
+	Endpoint  string `default:"storage.googleapis.com"`
+	Scheme    string `default:"https"`
+	PathStyle bool   `split_words:"true"`
+
+	// Emulator is set from STORAGE_EMULATOR_HOST.  Requests to the emulator are not authenticated.
+	Emulator bool `ignored:"true"`
+}
+
+// emulatorHost points the client at the GCS emulator named by STORAGE_EMULATOR_HOST, e.g localhost:4443 or
+// https://localhost:4443.  Emulators are plain http unless a scheme is given, and are path-style.
+func (c *ClientConfig) emulatorHost() {
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		return
+	}
+	c.Scheme = "http"
+	if i := strings.Index(host, "://"); i >= 0 {
+		c.Scheme, host = host[:i], host[i+len("://"):]
+	}
+	c.Endpoint = strings.TrimSuffix(host, "/")
+	c.PathStyle = true
+	c.Emulator = true
+}
+
+// ObjectURL returns the URL of the object, for the request URI (escaped path and query) of the object in the bucket
+func (c ClientConfig) ObjectURL(bucket string, requestURI string) string {
+	if c.PathStyle {
+		return c.Scheme + "://" + c.Endpoint + "/" + bucket + requestURI
+	}
+	return c.Scheme + "://" + bucket + "." + c.Endpoint + requestURI
+}
+
+// JSONURL returns the URL of the JSON API for the path, e.g /b/<bucket>/o
+func (c ClientConfig) JSONURL(path string) string {
+	return c.Scheme + "://" + c.Endpoint + "/storage/v1" + path
 }
 
 // BasicTLSClient sets up TLS, default application credentials, and timeouts.
@@ -49,14 +93,28 @@ func (c ClientConfig) BasicTLSClient() (*http.Client, error) {
 	}
 
 	t := http.Transport{
-		IdleConnTimeout: c.IdleConnTimeout,
-		MaxIdleConns:    c.MaxIdleConns,
-		TLSClientConfig: cfg,
+		DialContext:           (&net.Dialer{Timeout: c.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   c.Timeout,
+		ResponseHeaderTimeout: c.Timeout,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		TLSClientConfig:       cfg,
+	}
+	if c.Emulator {
+		return &http.Client{Transport: &t}, nil
 	}
-	gTransport, err := ghttp.NewTransport(context.Background(), &t, option.WithScopes(storage.ScopeReadOnly))
+	gTransport, err := ghttp.NewTransport(context.Background(), &t, option.WithScopes(storage.ScopeReadWrite))
 
-	return &http.Client{
-		Timeout:   c.Timeout,
-		Transport: gTransport,
-	}, err
+	return &http.Client{Transport: gTransport}, err
+}
+
+// StorageClient returns a GCS client with default application credentials, for the commands walking a bucket.
+// Transfers are not bound by Timeout, since objects may be large.
+func (c ClientConfig) StorageClient(ctx context.Context) (*storage.Client, error) {
+	// the library reads STORAGE_EMULATOR_HOST itself
+	opts := []option.ClientOption{option.WithScopes(storage.ScopeReadWrite)}
+	if !c.Emulator && c.Endpoint != "storage.googleapis.com" {
+		opts = append(opts, option.WithEndpoint(c.Scheme+"://"+c.Endpoint+"/storage/v1/"))
+	}
+	return storage.NewClient(ctx, opts...)
 }
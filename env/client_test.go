@@ -0,0 +1,51 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package env
+
+import (
+	"os"
+	"testing"
+)
+
+func TestClientConfig_ObjectURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		emulator string
+		config   ClientConfig
+		want     string
+	}{
+		{"virtual host", "", ClientConfig{Endpoint: "storage.googleapis.com", Scheme: "https"}, "https://bucket.storage.googleapis.com/dir/a%20b.enc?generation=1"},
+		{"path style", "", ClientConfig{Endpoint: "mirror.internal:8443", Scheme: "https", PathStyle: true}, "https://mirror.internal:8443/bucket/dir/a%20b.enc?generation=1"},
+		{"emulator", "localhost:4443", ClientConfig{Endpoint: "storage.googleapis.com", Scheme: "https"}, "http://localhost:4443/bucket/dir/a%20b.enc?generation=1"},
+		{"emulator with scheme", "https://localhost:4443/", ClientConfig{Endpoint: "storage.googleapis.com", Scheme: "https"}, "https://localhost:4443/bucket/dir/a%20b.enc?generation=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("STORAGE_EMULATOR_HOST", tt.emulator)
+			defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+
+			c := tt.config
+			c.emulatorHost()
+			if got := c.ObjectURL("bucket", "/dir/a%20b.enc?generation=1"); got != tt.want {
+				t.Errorf("ClientConfig.ObjectURL() = %v, want %v", got, tt.want)
+			}
+			if c.Emulator != (tt.emulator != "") {
+				t.Errorf("ClientConfig.Emulator = %v, want %v", c.Emulator, tt.emulator != "")
+			}
+		})
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"log"
 	"os"
 
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
 )
@@ -33,8 +35,28 @@ type Config struct {
 	KmsMkekURI  string `split_words:"true" required:"true"`
 	DekPathName string `split_words:"true" required:"true"`
 	AAD         string `split_words:"true" required:"true"`
-	Client      ClientConfig
-	Proxy       ProxyConfig
+	AADMode     string `split_words:"true" default:"object"` // static, object or object-tag, see data.AAD
+	AADTag      string `split_words:"true"`
+
+	// AADEnforce refuses objects whose envelope has a weaker AAD scheme than AADMode, e.g objects written before the
+	// mode was raised, which could be copied over another object.  Only set it once they are all migrated.
+	AADEnforce bool `split_words:"true"`
+	Client     ClientConfig
+	Proxy      ProxyConfig
+
+	// KekAllowList is a comma separated list of the KEKs objects may name, see kms.AllowList.
+	// It defaults to KmsMkekURI.
+	KekAllowList kms.AllowList `split_words:"true"`
+
+	// RoutesFile holds a JSON array of Route, so the proxy fronts more buckets than BucketName.  BucketPaths also serves
+	// the buckets of the configuration at /b/<bucket>/.
+	RoutesFile  string  `split_words:"true"`
+	BucketPaths bool    `split_words:"true"`
+	Routes      []Route `ignored:"true"`
+
+	// PolicyFile holds the authorization Policy of the proxy, YAML or JSON, reloaded when it changes
+	PolicyFile string  `split_words:"true"`
+	Policy     *Policy `ignored:"true"`
 }
 
 // Logger configures logging based on env variables
@@ -74,5 +96,17 @@ func (c Config) Logger() *logrus.Logger {
 func Get() (Config, error) {
 	var c Config
 	err := envconfig.Process("tinkproxy", &c)
+	c.Client.emulatorHost()
+	if len(c.KekAllowList) == 0 {
+		c.KekAllowList = kms.AllowList{c.KmsMkekURI}
+	}
+	if err == nil && c.RoutesFile != "" {
+		c.Routes, err = c.readRoutes(c.RoutesFile)
+	}
+	if err == nil && c.PolicyFile != "" {
+		var p Policy
+		p, err = ReadPolicy(c.PolicyFile)
+		c.Policy = &p
+	}
 	return c, err
 }
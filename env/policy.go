@@ -0,0 +1,103 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package env
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Policy effects
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// Policy restricts what authenticated clients may do with which objects.  The first rule matching the client, the
+// method and the object of a request decides.  Requests matching no rule take the Default effect, deny unless set.
+type Policy struct {
+	Default string              `mapstructure:"default"`
+	Groups  map[string][]string `mapstructure:"groups"` // lower case group name to the identities in it
+	Rules   []PolicyRule        `mapstructure:"rules"`
+}
+
+// PolicyRule allows, or denies, identities some methods on some objects
+type PolicyRule struct {
+	Effect string `mapstructure:"effect"` // allow, the default, or deny
+
+	// Identities are names of clients, "group:<name>" for the members of a group, "*" for any authenticated client or
+	// "anonymous" for clients that are not
+	Identities []string `mapstructure:"identities"`
+
+	// Methods are HTTP methods, with HEAD as GET, and LIST for listings.  None, or "*", is any method.
+	Methods []string `mapstructure:"methods"`
+
+	// Objects are <bucket>/<object> as stored, once requests are routed: prefixes ending with /, path.Match globs, or
+	// "*" for all
+	Objects []string `mapstructure:"objects"`
+}
+
+// ReadPolicy loads the policy file in path, YAML or JSON by its extension
+func ReadPolicy(path string) (Policy, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return Policy{}, errors.Wrap(err, "cannot read policy file")
+	}
+	var p Policy
+	if err := v.Unmarshal(&p); err != nil {
+		return Policy{}, errors.Wrap(err, "malformed policy file")
+	}
+	if err := p.check(); err != nil {
+		return Policy{}, errors.Wrapf(err, "policy file %s", path)
+	}
+	return p, nil
+}
+
+// check normalises the effects and methods of the policy, and rejects what would never match
+func (p *Policy) check() error {
+	if p.Default == "" {
+		p.Default = PolicyDeny
+	}
+	if p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return errors.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Effect == "" {
+			rule.Effect = PolicyAllow
+		}
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			return errors.Errorf("rule %d: effect must be allow or deny, not %q", i, rule.Effect)
+		}
+		if len(rule.Identities) == 0 || len(rule.Objects) == 0 {
+			return errors.Errorf("rule %d: needs identities and objects", i)
+		}
+		for j, method := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(method)
+		}
+		for _, pattern := range rule.Objects {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("rule %d: bad object pattern %q", i, pattern)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package env
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := Policy{
+		Default: PolicyDeny,
+		Groups:  map[string][]string{"finance": {"reporting", "CN=alice"}},
+		Rules: []PolicyRule{
+			{Effect: PolicyDeny, Identities: []string{"*"}, Methods: []string{"PUT"}, Objects: []string{"archive/"}},
+			{Effect: PolicyAllow, Identities: []string{"group:finance"}, Methods: []string{"GET", "LIST"}, Objects: []string{"reports/*.pdf"}},
+		},
+	}
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    Policy
+		wantErr bool
+	}{
+		{"yaml", "policy.yaml", `
+groups:
+  finance: [reporting, CN=alice]
+rules:
+  - effect: deny
+    identities: ["*"]
+    methods: [put]
+    objects: [archive/]
+  - identities: [group:finance]
+    methods: [GET, LIST]
+    objects: [reports/*.pdf]
+`, want, false},
+		{"json", "policy.json", `{"default": "deny", "groups": {"finance": ["reporting", "CN=alice"]}, "rules": [
+			{"effect": "deny", "identities": ["*"], "methods": ["PUT"], "objects": ["archive/"]},
+			{"effect": "allow", "identities": ["group:finance"], "methods": ["get", "list"], "objects": ["reports/*.pdf"]}]}`, want, false},
+		{"bad default", "default.yaml", "default: maybe\n", Policy{}, true},
+		{"bad effect", "effect.yaml", "rules:\n  - effect: permit\n    identities: ['*']\n    objects: ['*']\n", Policy{}, true},
+		{"no objects", "objects.yaml", "rules:\n  - identities: ['*']\n", Policy{}, true},
+		{"bad pattern", "pattern.yaml", "rules:\n  - identities: ['*']\n    objects: ['reports/[']\n", Policy{}, true},
+		{"missing", "", "", Policy{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "missing.yaml")
+			if tt.file != "" {
+				path = filepath.Join(dir, tt.file)
+				if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := ReadPolicy(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
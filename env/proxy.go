@@ -16,12 +16,72 @@
 
 package env
 
-import "time"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 // ProxyConfig contains configuration for the proxy mode.
 type ProxyConfig struct {
-	Listen          string        `default:":8080"`
+	Listen string `default:":8080"`
+	// Timeout bounds reading the headers of a request, the calls to GCS made for it, and a transfer of a body making no
+	// progress.  Objects may be of any size, so no deadline bounds a whole transfer.
 	Timeout         time.Duration `split_words:"true" default:"10s"`
 	CertFilePath    string        `split_words:"true" required:"true"`
 	CertKeyFilePath string        `split_words:"true" required:"true"`
+
+	// ClientCAFile holds the PEM certificates of the CAs issuing client certificates.  When set, clients must present
+	// a certificate verified against them (mutual TLS).
+	ClientCAFile string `envconfig:"CLIENT_CA_FILE"`
+
+	// JWKSFile holds the JSON Web Key Set of the issuer of bearer tokens.  When set, requests must carry a JWT signed by
+	// one of its keys, for JWTAudience, and by JWTIssuer when that is set.
+	JWKSFile    string `envconfig:"JWKS_FILE"`
+	JWTAudience string `envconfig:"JWT_AUDIENCE"`
+	JWTIssuer   string `envconfig:"JWT_ISSUER"`
+
+	// AdminListen is the address of the admin listener serving /metrics, none when empty
+	AdminListen string `split_words:"true"`
+
+	// AuditLogFile is the append-only file recording every encryption and decryption, see package audit
+	AuditLogFile string `split_words:"true"`
+	// AuditKeyFile holds the key of the MACs chaining the audit log, readable by the proxy but kept out of reach of
+	// whoever can write the log.  Required with AuditLogFile.
+	AuditKeyFile string `split_words:"true"`
+
+	// ListEnvelopesOnly leaves objects which are not envelopes out of listings.  The objects listed without the size of
+	// their plaintext recorded are read to find them, as with ListProbeEnvelopes.
+	ListEnvelopesOnly bool `split_words:"true"`
+	// ListProbeEnvelopes reads the envelope of the objects listed without the size of their plaintext recorded, one GET
+	// per object, to list that size rather than the size stored
+	ListProbeEnvelopes bool `split_words:"true"`
+
+	// S3Credentials maps the access key ids of S3 clients to their secret, as id:secret,id:secret, for proxy --s3
+	S3Credentials map[string]string `split_words:"true"`
+	S3Region      string            `split_words:"true" default:"us-east-1"`
+}
+
+// ServerTLSConfig returns the TLS configuration of the proxy listener, which requires and verifies client certificates
+// when ClientCAFile is set
+func (c ProxyConfig) ServerTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read client CA file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificate found in client CA file %s", c.ClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
 }
@@ -0,0 +1,59 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package env
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProxyConfig_ServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		clientCAFile string
+		wantAuth     tls.ClientAuthType
+		wantErr      bool
+	}{
+		{"no client CA", "", tls.NoClientCert, false},
+		{"missing client CA", filepath.Join(dir, "missing.pem"), 0, true},
+		{"no certificate in client CA", notPEM, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ProxyConfig{ClientCAFile: tt.clientCAFile}.ServerTLSConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ServerTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.ClientAuth != tt.wantAuth {
+				t.Errorf("ServerTLSConfig() ClientAuth = %v, want %v", cfg.ClientAuth, tt.wantAuth)
+			}
+		})
+	}
+}
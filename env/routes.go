@@ -0,0 +1,104 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package env
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+
+	"github.com/pkg/errors"
+)
+
+// Route sends proxy requests to a bucket, with its own KEK and AAD settings.  Requests match a route on their Host
+// header, on a path prefix, or on both.  A route with neither only serves /b/<bucket>/ paths, see BucketPaths.
+// Settings left empty are taken from Config.
+type Route struct {
+	Host   string `json:"host,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+
+	// Bucket holds the objects, under ObjectPrefix, e.g "finance/" serves <prefix>a.pdf from gs://<bucket>/finance/a.pdf
+	Bucket       string `json:"bucket"`
+	ObjectPrefix string `json:"objectPrefix,omitempty"`
+
+	KmsMkekURI   string        `json:"kek,omitempty"`
+	KekAllowList kms.AllowList `json:"kekAllowList,omitempty"`
+	AAD          string        `json:"aad,omitempty"`
+	AADMode      string        `json:"aadMode,omitempty"`
+	AADTag       string        `json:"aadTag,omitempty"`
+	AADEnforce   bool          `json:"aadEnforce,omitempty"`
+}
+
+// DefaultRoute serves BucketName with the settings of the configuration, for requests matching no other route
+func (c Config) DefaultRoute() Route {
+	return Route{
+		Bucket:       c.BucketName,
+		KmsMkekURI:   c.KmsMkekURI,
+		KekAllowList: c.KekAllowList,
+		AAD:          c.AAD,
+		AADMode:      c.AADMode,
+		AADTag:       c.AADTag,
+		AADEnforce:   c.AADEnforce,
+	}
+}
+
+// readRoutes loads the JSON array of routes in path, and completes them with the settings of the configuration
+func (c Config) readRoutes(path string) ([]Route, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read routes")
+	}
+	var routes []Route
+	if err := json.Unmarshal(b, &routes); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse routes in %s", path)
+	}
+
+	defaults := c.DefaultRoute()
+	for i := range routes {
+		rt := &routes[i]
+		if rt.Bucket == "" {
+			return nil, errors.Errorf("route %d of %s has no bucket", i, path)
+		}
+		rt.Host = strings.ToLower(rt.Host)
+		if rt.Prefix != "" {
+			rt.Prefix = "/" + strings.Trim(rt.Prefix, "/") + "/"
+		}
+		if rt.KmsMkekURI == "" {
+			rt.KmsMkekURI = defaults.KmsMkekURI
+		}
+		if len(rt.KekAllowList) == 0 {
+			// a route with its own KEK only unwraps with it, unless told otherwise
+			rt.KekAllowList = kms.AllowList{rt.KmsMkekURI}
+			if rt.KmsMkekURI == defaults.KmsMkekURI {
+				rt.KekAllowList = defaults.KekAllowList
+			}
+		}
+		if rt.AAD == "" {
+			rt.AAD = defaults.AAD
+		}
+		if rt.AADMode == "" {
+			rt.AADMode = defaults.AADMode
+		}
+		if rt.AADTag == "" {
+			rt.AADTag = defaults.AADTag
+		}
+		rt.AADEnforce = rt.AADEnforce || defaults.AADEnforce
+	}
+	return routes, nil
+}
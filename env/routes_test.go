@@ -0,0 +1,67 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package env
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/storage-client-side-encryption-proxy/kms"
+)
+
+func TestConfig_readRoutes(t *testing.T) {
+	f, err := ioutil.TempFile("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[
+		{"prefix": "finance", "bucket": "fin", "kek": "local:///finance", "aad": "finance"},
+		{"host": "Media.Example.com", "bucket": "media"}
+	]`)
+	f.Close()
+
+	c := Config{
+		BucketName:   "default",
+		KmsMkekURI:   "local:///kek",
+		KekAllowList: kms.AllowList{"local:///**"},
+		AAD:          "aad",
+		AADMode:      "object",
+	}
+	got, err := c.readRoutes(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Route{
+		{Prefix: "/finance/", Bucket: "fin", KmsMkekURI: "local:///finance", KekAllowList: kms.AllowList{"local:///finance"},
+			AAD: "finance", AADMode: "object"},
+		{Host: "media.example.com", Bucket: "media", KmsMkekURI: "local:///kek", KekAllowList: kms.AllowList{"local:///**"},
+			AAD: "aad", AADMode: "object"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Config.readRoutes() = %+v, want %+v", got, want)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte(`[{"prefix": "/x/"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.readRoutes(f.Name()); err == nil {
+		t.Errorf("Config.readRoutes() accepted a route without a bucket")
+	}
+}
@@ -4,10 +4,13 @@ go 1.14
 
 require (
 	cloud.google.com/go/storage v1.6.0
+	github.com/golang/protobuf v1.4.2
 	github.com/google/tink/go v0.0.0-20200415212014-15bc9c0a2c8f
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.6.3
@@ -0,0 +1,68 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/core/registry"
+)
+
+// ErrKekNotAllowed is returned for a KEK URI that no entry of the allow-list matches
+var ErrKekNotAllowed = errors.New("KEK is not in the allow-list")
+
+// AllowList holds the KEK URIs which may be used to unwrap deks.  Objects name their KEK, so without it anyone able to
+// write to the bucket could make us call an arbitrary key.  Each entry is one of
+//
+//   - an exact URI, gcp-kms://projects/p/locations/l/keyRings/r/cryptoKeys/k
+//   - a prefix ending in **, gcp-kms://projects/p/**
+//   - a pattern in the syntax of path.Match, gcp-kms://projects/p/locations/l/keyRings/r/cryptoKeys/*
+type AllowList []string
+
+// Check returns ErrKekNotAllowed unless an entry matches keyURI
+func (l AllowList) Check(keyURI string) error {
+	for _, entry := range l {
+		if allows(entry, keyURI) {
+			return nil
+		}
+	}
+	return errors.Wrap(ErrKekNotAllowed, keyURI)
+}
+
+// NewClient returns a client for keyURI, once the allow-list allows it.  Use it for every KEK URI read from an object,
+// so no client, e.g one sending credentials to the host of the URI, is created for a KEK which is not allowed.
+func (l AllowList) NewClient(keyURI string) (registry.KMSClient, error) {
+	if err := l.Check(keyURI); err != nil {
+		return nil, err
+	}
+	return NewClient(keyURI)
+}
+
+func allows(entry string, keyURI string) bool {
+	switch {
+	case strings.HasSuffix(entry, "**"):
+		return strings.HasPrefix(keyURI, strings.TrimSuffix(entry, "**"))
+	case strings.ContainsAny(entry, "*?["):
+		ok, err := path.Match(entry, keyURI)
+		return err == nil && ok
+	default:
+		return entry == keyURI
+	}
+}
@@ -0,0 +1,79 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/core/registry"
+)
+
+func TestAllowList_Check(t *testing.T) {
+	const ring = "gcp-kms://projects/p/locations/global/keyRings/r"
+	tests := []struct {
+		name    string
+		list    AllowList
+		keyURI  string
+		allowed bool
+	}{
+		{"exact", AllowList{ring + "/cryptoKeys/k"}, ring + "/cryptoKeys/k", true},
+		{"exact mismatch", AllowList{ring + "/cryptoKeys/k"}, ring + "/cryptoKeys/k2", false},
+		{"prefix", AllowList{"gcp-kms://projects/p/**"}, ring + "/cryptoKeys/k", true},
+		{"prefix mismatch", AllowList{"gcp-kms://projects/p/**"}, "gcp-kms://projects/q/locations/global", false},
+		{"pattern", AllowList{ring + "/cryptoKeys/*"}, ring + "/cryptoKeys/k", true},
+		{"pattern does not cross /", AllowList{"gcp-kms://projects/*"}, ring + "/cryptoKeys/k", false},
+		{"second entry", AllowList{"local://dev.json", ring + "/cryptoKeys/k"}, ring + "/cryptoKeys/k", true},
+		{"empty list", nil, ring + "/cryptoKeys/k", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.list.Check(tt.keyURI)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("AllowList.Check() error = %v, want allowed %v", err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrKekNotAllowed) {
+				t.Errorf("AllowList.Check() error = %v, want ErrKekNotAllowed", err)
+			}
+		})
+	}
+}
+
+func TestAllowList_NewClient(t *testing.T) {
+	created := 0
+	Register("test-kms", func(keyURI string) (registry.KMSClient, error) {
+		created++
+		return nil, nil
+	})
+	defer func() {
+		mu.Lock()
+		delete(backends, "test-kms://")
+		mu.Unlock()
+	}()
+
+	list := AllowList{"test-kms://allowed/*"}
+	if _, err := list.NewClient("test-kms://attacker/key"); !errors.Is(err, ErrKekNotAllowed) {
+		t.Errorf("NewClient() error = %v, want ErrKekNotAllowed", err)
+	}
+	if created != 0 {
+		t.Fatal("NewClient() created a client for a KEK which is not allowed")
+	}
+	if _, err := list.NewClient("test-kms://allowed/key"); err != nil || created != 1 {
+		t.Errorf("NewClient() error = %v, created %d clients, want 1", err, created)
+	}
+}
@@ -0,0 +1,89 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kms creates Tink KMS clients for KEK URIs, picking the backend from the URI scheme.
+//
+//   - gcp-kms://projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+//   - aws-kms://arn:aws:kms:<region>:<account>:key/<id>
+//   - hcvault://<host>[:<port>]/<mount>/keys/<key>
+//   - local://<path to a cleartext AEAD keyset in Tink's JSON format>
+package kms
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/integration/awskms"
+	"github.com/google/tink/go/integration/gcpkms"
+)
+
+// Backend creates a client for the KEK URIs starting with keyURI
+type Backend func(keyURI string) (registry.KMSClient, error)
+
+var (
+	mu       sync.RWMutex
+	backends = map[string]Backend{
+		"gcp-kms://": gcpkms.NewClient,
+		"aws-kms://": awskms.NewClient,
+		"hcvault://": newVaultClient,
+		"local://":   newLocalClient,
+	}
+)
+
+// Register adds or replaces the backend used for KEK URIs with the given scheme, e.g "gcp-kms"
+func Register(scheme string, backend Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	backends[scheme+"://"] = backend
+}
+
+// Schemes lists the registered schemes
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(backends))
+	for prefix := range backends {
+		schemes = append(schemes, strings.TrimSuffix(prefix, "://"))
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewClient returns a client for the KEK URI from the backend registered for its scheme
+func NewClient(keyURI string) (registry.KMSClient, error) {
+	i := strings.Index(keyURI, "://")
+	if i < 0 {
+		return nil, errors.Errorf("KEK URI %q has no scheme, expected one of %v", keyURI, Schemes())
+	}
+	prefix := strings.ToLower(keyURI[:i+len("://")])
+
+	mu.RLock()
+	backend, ok := backends[prefix]
+	mu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("no KMS backend for KEK URI %q, expected one of %v", keyURI, Schemes())
+	}
+
+	client, err := backend(keyURI)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s client creation failed", strings.TrimSuffix(prefix, "://"))
+	}
+	return client, nil
+}
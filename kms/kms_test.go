@@ -0,0 +1,218 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+)
+
+func TestNewClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.json")
+	writeKeyset(t, path)
+
+	tests := []struct {
+		name    string
+		keyURI  string
+		wantErr bool
+	}{
+		{"local", "local://" + path, false},
+		{"local missing file", "local://" + filepath.Join(dir, "missing.json"), true},
+		{"aws", "aws-kms://arn:aws:kms:us-east-1:123456789012:key/k", false},
+		{"no scheme", "projects/p/locations/global/keyRings/r/cryptoKeys/k", true},
+		{"unknown scheme", "foo-kms://key", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient(tt.keyURI)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !client.Supported(tt.keyURI) {
+				t.Errorf("NewClient() client does not support %s", tt.keyURI)
+			}
+		})
+	}
+}
+
+func TestLocalClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.json")
+	writeKeyset(t, path)
+
+	keyURI := "local://" + path
+	client, err := NewClient(keyURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAEAD("local://" + filepath.Join(dir, "other.json")); err == nil {
+		t.Error("localClient.GetAEAD() returned another keyset")
+	}
+	a, err := client.GetAEAD(keyURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, a.Encrypt, a.Decrypt)
+}
+
+func TestVaultClient(t *testing.T) {
+	// a transit engine which "encrypts" by prefixing the key name
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/my-key":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"ciphertext": "vault:v1:" + req["plaintext"]},
+			})
+		case "/v1/transit/decrypt/my-key":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"no handler for route"}})
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	keyURI := "hcvault://" + host + "/transit/keys/my-key"
+	client := &vaultClient{keyURIPrefix: vaultPrefix, scheme: "https", token: "token", http: server.Client()}
+
+	a, err := client.GetAEAD(keyURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, a.Encrypt, a.Decrypt)
+
+	for _, uri := range []string{"/transit/my-key", "/keys/my-key", "//keys/my-key", "/transit/keys/", "/transit/keys/a/b"} {
+		if _, err := client.GetAEAD("hcvault://" + host + uri); err == nil {
+			t.Errorf("vaultClient.GetAEAD(%s) accepted a URI without a mount and a key", uri)
+		}
+	}
+	// a key named with /keys/ is escaped, and stays so
+	escaped, err := client.GetAEAD("hcvault://" + host + "/transit/keys/a%2Fkeys%2Fb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := escaped.(*vaultAEAD).encryptURL, "https://"+host+"/v1/transit/encrypt/a%2Fkeys%2Fb"; got != want {
+		t.Errorf("encrypt URL = %s, want %s", got, want)
+	}
+	client.token = "wrong"
+	if _, err := a.Encrypt([]byte("dek"), nil); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("vaultAEAD.Encrypt() error = %v, want permission denied", err)
+	}
+}
+
+func TestVaultClient_addr(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       string
+		wantScheme string
+		wantErr    bool
+	}{
+		{"default", "", "https", false},
+		{"dev server", "http://127.0.0.1:8200", "http", false},
+		{"https", "https://vault.example.org:8200", "https", false},
+		{"other scheme", "ftp://vault.example.org", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "VAULT_TOKEN", "token")
+			setenv(t, "VAULT_ADDR", tt.addr)
+			client, err := newVaultClient(vaultPrefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newVaultClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && client.(*vaultClient).scheme != tt.wantScheme {
+				t.Errorf("scheme = %s, want %s", client.(*vaultClient).scheme, tt.wantScheme)
+			}
+		})
+	}
+}
+
+// setenv sets the environment variable for the test
+func setenv(t *testing.T, name string, value string) {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func writeKeyset(t *testing.T, path string) {
+	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(f)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func roundTrip(t *testing.T, encrypt, decrypt func(a, b []byte) ([]byte, error)) {
+	plaintext := []byte("wrapped dek")
+	ct, err := encrypt(plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := decrypt(ct, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pt, plaintext) {
+		t.Errorf("decrypt() = %q, want %q", pt, plaintext)
+	}
+	if bytes.Equal(ct, plaintext) {
+		t.Error("encrypt() returned the plaintext")
+	}
+}
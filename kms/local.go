@@ -0,0 +1,78 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+const localPrefix = "local://"
+
+// localClient uses a master keyset kept in a local file, for tests and development.  The keyset is in the clear, so
+// it is only as safe as the file holding it.
+type localClient struct {
+	keyURI string
+	aead   tink.AEAD
+}
+
+var _ registry.KMSClient = (*localClient)(nil)
+
+// newLocalClient reads the AEAD keyset in Tink's JSON format at the path following local://
+func newLocalClient(keyURI string) (registry.KMSClient, error) {
+	path := strings.TrimPrefix(keyURI, localPrefix)
+	if path == "" {
+		return nil, errors.Errorf("KEK URI %q has no keyset path", keyURI)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open local keyset")
+	}
+	defer f.Close()
+
+	kh, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(f))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read local keyset %s", path)
+	}
+	a, err := aead.New(kh)
+	if err != nil {
+		return nil, errors.Wrapf(err, "local keyset %s is not an AEAD keyset", path)
+	}
+	return &localClient{keyURI: keyURI, aead: a}, nil
+}
+
+// Supported is true only for the URI of the keyset file
+func (c *localClient) Supported(keyURI string) bool {
+	return keyURI == c.keyURI
+}
+
+// GetAEAD returns the keyset's primitive
+func (c *localClient) GetAEAD(keyURI string) (tink.AEAD, error) {
+	if !c.Supported(keyURI) {
+		return nil, errors.Errorf("unsupported KEK URI %q", keyURI)
+	}
+	return c.aead, nil
+}
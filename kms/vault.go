@@ -0,0 +1,173 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/tink"
+)
+
+const vaultPrefix = "hcvault://"
+
+// vaultClient uses keys of the HashiCorp Vault transit secrets engine, authenticating with VAULT_TOKEN.  Vault is
+// reached with https, unless VAULT_ADDR names another scheme, e.g http://127.0.0.1:8200 for a dev server.
+type vaultClient struct {
+	keyURIPrefix string
+	scheme       string
+	token        string
+	http         *http.Client
+}
+
+var _ registry.KMSClient = (*vaultClient)(nil)
+
+func newVaultClient(uriPrefix string) (registry.KMSClient, error) {
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return nil, errors.New("VAULT_TOKEN is not set")
+	}
+	scheme := "https"
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("VAULT_ADDR %q is not an http or https URL", addr)
+		}
+		scheme = u.Scheme
+	}
+	return &vaultClient{
+		keyURIPrefix: uriPrefix,
+		scheme:       scheme,
+		token:        token,
+		http:         &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Supported true if this client does support keyURI
+func (c *vaultClient) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, c.keyURIPrefix)
+}
+
+// GetAEAD returns the transit key hcvault://<host>[:<port>]/<mount>/keys/<key>.  The key is the last path segment
+// after /keys/, escape any / in its name.
+func (c *vaultClient) GetAEAD(keyURI string) (tink.AEAD, error) {
+	if !c.Supported(keyURI) {
+		return nil, errors.Errorf("unsupported KEK URI %q", keyURI)
+	}
+
+	u, err := url.Parse(keyURI)
+	if err != nil {
+		return nil, errors.Wrapf(err, "malformed KEK URI %q", keyURI)
+	}
+	escaped := u.EscapedPath()
+	i := strings.LastIndex(escaped, "/keys/")
+	if i < 0 {
+		return nil, errors.Errorf("KEK URI %q is not of the form hcvault://<host>/<mount>/keys/<key>", keyURI)
+	}
+	mount, key := escaped[:i], escaped[i+len("/keys/"):]
+	if u.Host == "" || strings.Trim(mount, "/") == "" || key == "" || strings.Contains(key, "/") {
+		return nil, errors.Errorf("KEK URI %q is not of the form hcvault://<host>/<mount>/keys/<key>", keyURI)
+	}
+
+	return &vaultAEAD{
+		client:     c,
+		encryptURL: c.scheme + "://" + u.Host + "/v1" + mount + "/encrypt/" + key,
+		decryptURL: c.scheme + "://" + u.Host + "/v1" + mount + "/decrypt/" + key,
+	}, nil
+}
+
+type vaultAEAD struct {
+	client     *vaultClient
+	encryptURL string
+	decryptURL string
+}
+
+// Encrypt sends the plaintext to transit.  Additional data is sent as the key derivation context, which Vault only
+// accepts for derived keys.
+func (a *vaultAEAD) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+	if len(additionalData) > 0 {
+		req["context"] = base64.StdEncoding.EncodeToString(additionalData)
+	}
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := a.client.call(a.encryptURL, req, &resp); err != nil {
+		return nil, errors.Wrap(err, "vault encrypt failed")
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+// Decrypt sends the ciphertext, of the form vault:v<version>:<base64>, to transit
+func (a *vaultAEAD) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	req := map[string]string{"ciphertext": string(ciphertext)}
+	if len(additionalData) > 0 {
+		req["context"] = base64.StdEncoding.EncodeToString(additionalData)
+	}
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := a.client.call(a.decryptURL, req, &resp); err != nil {
+		return nil, errors.Wrap(err, "vault decrypt failed")
+	}
+	pt, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "vault returned malformed plaintext")
+	}
+	return pt, nil
+}
+
+// call posts req to a transit endpoint and decodes the data field of the answer into resp
+func (c *vaultClient) call(endpoint string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("X-Vault-Token", c.token)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	var answer struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&answer); err != nil {
+		return errors.Wrapf(err, "unexpected answer from vault, %s", httpResp.Status)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return errors.Errorf("vault answered %s %v", httpResp.Status, answer.Errors)
+	}
+	return json.Unmarshal(answer.Data, resp)
+}
@@ -30,13 +30,58 @@ export TINKPROXY_BUCKET_NAME=""
 # example "gcp-kms://projects/<myproject>/locations/us/keyRings/<myKeyRing>/cryptoKeys/<myKey>" 
 export TINKPROXY_KMS_MKEK_URI=""
 
+# comma separated KEKs that objects may name, defaults to TINKPROXY_KMS_MKEK_URI
+# entries are exact URIs, prefixes ending in ** or patterns, e.g "gcp-kms://projects/<myproject>/locations/us/keyRings/<myKeyRing>/cryptoKeys/*"
+# export TINKPROXY_KEK_ALLOW_LIST=""
+
+# JSON route table for fronting more buckets, see README.  bucket paths also serve /b/<bucket>/<object>
+# export TINKPROXY_ROUTES_FILE="routes.json"
+# export TINKPROXY_BUCKET_PATHS="false"
+
+# YAML or JSON rules of which clients may do what with which objects, deny by default, see README
+# export TINKPROXY_POLICY_FILE="policy.yaml"
+
+# leave objects which are not envelopes out of listings
+# export TINKPROXY_PROXY_LIST_ENVELOPES_ONLY="false"
+# read the envelope of listed objects without a recorded plaintext size, one GET per object, to list that size
+# export TINKPROXY_PROXY_LIST_PROBE_ENVELOPES="false"
+
+# access key ids and secrets of the S3 clients of proxy --s3, as <id>:<secret>,<id>:<secret>
+# export TINKPROXY_PROXY_S3_CREDENTIALS=""
+# export TINKPROXY_PROXY_S3_REGION="us-east-1"
+
+# storage XML API endpoint, for a private endpoint or a GCS compatible store.  path style addresses objects as
+# <endpoint>/<bucket>/<object>.  STORAGE_EMULATOR_HOST (e.g "localhost:4443") overrides them for an emulator
+# export TINKPROXY_CLIENT_ENDPOINT="storage.googleapis.com"
+# export TINKPROXY_CLIENT_SCHEME="https"
+# export TINKPROXY_CLIENT_PATH_STYLE="false"
+
 # proxy only runs in TLS
 export TINKPROXY_PROXY_CERT_FILE_PATH="tools/cert.pem"
 export TINKPROXY_PROXY_CERT_KEY_FILE_PATH="tools/key.pem"
+# require client certificates issued by these CAs (mutual TLS)
+# export TINKPROXY_PROXY_CLIENT_CA_FILE="tools/client-ca.pem"
+# require bearer JWTs signed by a key of this JWKS file, for this audience and, when set, issuer
+# export TINKPROXY_PROXY_JWKS_FILE="tools/jwks.json"
+# export TINKPROXY_PROXY_JWT_AUDIENCE="tinkproxy"
+# export TINKPROXY_PROXY_JWT_ISSUER="https://accounts.google.com"
+# serve Prometheus metrics on /metrics of this address, in plain HTTP
+# export TINKPROXY_PROXY_ADMIN_LISTEN="127.0.0.1:9090"
+# record every encryption and decryption in this MAC chained audit log, see tinkproxy audit verify
+# export TINKPROXY_PROXY_AUDIT_LOG_FILE="/var/log/tinkproxy/audit.log"
+# key of the MACs, at least 32 random bytes kept apart from the log, e.g head -c 32 /dev/urandom
+# export TINKPROXY_PROXY_AUDIT_KEY_FILE="/etc/tinkproxy/audit.key"
 
 # AAD for AES encryption.  Pick a value that is meaningful and do not lose it. 
 # data cannot be decrypted unless the same AAD value is supplied at encryption time.
-export TINKPROXY_AAD="this aad"  
+export TINKPROXY_AAD="this aad"
+
+# static uses TINKPROXY_AAD for every object.  object binds the ciphertext to the bucket and object name, so it cannot
+# be copied over another object, and object-tag adds TINKPROXY_AAD_TAG, e.g a version
+export TINKPROXY_AAD_MODE="object"
+# refuse objects written with a weaker mode than TINKPROXY_AAD_MODE, once all of them are migrated
+# export TINKPROXY_AAD_ENFORCE="true"
+# export TINKPROXY_AAD_TAG=""  
 
 #===============================================================
 # The following are configurable, but do not need to be changed.
@@ -0,0 +1,146 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+// bucketStore keeps objects under a prefix of a GCS bucket
+type bucketStore struct {
+	bucket *storage.BucketHandle
+	name   string
+	prefix string
+
+	// generations read by Open, so Replace does not overwrite an object changed in the meantime
+	mu          sync.Mutex
+	generations map[string]int64
+}
+
+func newBucketStore(client *storage.Client, bucket string, prefix string) *bucketStore {
+	return &bucketStore{
+		bucket:      client.Bucket(bucket),
+		name:        bucket,
+		prefix:      prefix,
+		generations: map[string]int64{},
+	}
+}
+
+func (s *bucketStore) ObjectName(name string) (string, string) {
+	return s.name, s.prefix + name
+}
+
+func (s *bucketStore) String() string {
+	return "gs://" + s.name + "/" + s.prefix
+}
+
+func (s *bucketStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot list %s", s)
+		}
+		names = append(names, strings.TrimPrefix(attrs.Name, s.prefix))
+	}
+	return names, nil
+}
+
+func (s *bucketStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(s.prefix + name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.generations[name] = r.Attrs.Generation
+	s.mu.Unlock()
+	return r, nil
+}
+
+// proxyMetadataPrefix starts the metadata the proxy records about the envelope and plaintext of an object on upload,
+// which no longer holds once the content is replaced
+const proxyMetadataPrefix = "tinkproxy-"
+
+// Replace uploads the new content, which GCS only commits on Close.  The upload fails if the object changed since
+// it was opened.  The metadata of the object is kept, except that recorded by the proxy about the old content: the
+// proxy then reads the envelope to list the object, and serves it without checksums.
+func (s *bucketStore) Replace(ctx context.Context, name string) (Replacement, error) {
+	o := s.bucket.Object(s.prefix + name)
+	s.mu.Lock()
+	generation, ok := s.generations[name]
+	delete(s.generations, name)
+	s.mu.Unlock()
+
+	src := o
+	if ok {
+		src = o.Generation(generation)
+		o = o.If(storage.Conditions{GenerationMatch: generation})
+	}
+	attrs, err := src.Attrs(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, errors.Wrapf(err, "cannot read the metadata of %s%s", s, name)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := o.NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	if attrs != nil {
+		w.Metadata = userMetadata(attrs.Metadata)
+		w.ContentType = attrs.ContentType
+		w.ContentDisposition = attrs.ContentDisposition
+		w.ContentLanguage = attrs.ContentLanguage
+		w.CacheControl = attrs.CacheControl
+	}
+	return &objectReplacement{Writer: w, cancel: cancel}, nil
+}
+
+// userMetadata returns the metadata without that of the proxy
+func userMetadata(metadata map[string]string) map[string]string {
+	kept := map[string]string{}
+	for k, v := range metadata {
+		if !strings.HasPrefix(strings.ToLower(k), proxyMetadataPrefix) {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+type objectReplacement struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (r *objectReplacement) Close() error {
+	defer r.cancel()
+	return r.Writer.Close()
+}
+
+func (r *objectReplacement) Abort() {
+	r.cancel()
+	r.Writer.Close()
+}
@@ -0,0 +1,78 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint records the objects already processed, one name per line, so an interrupted run can resume
+type Checkpoint struct {
+	f    *os.File
+	done map[string]bool
+}
+
+// OpenCheckpoint loads the checkpoint file at path, creating it if needed.  An empty path keeps no file.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{done: map[string]bool{}}
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open checkpoint")
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		c.done[scanner.Text()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "cannot read checkpoint %s", path)
+	}
+	c.f = f
+	return c, nil
+}
+
+// Done is true for an object already processed
+func (c *Checkpoint) Done(name string) bool {
+	return c.done[name]
+}
+
+// Mark records that the object was processed
+func (c *Checkpoint) Mark(name string) error {
+	c.done[name] = true
+	if c.f == nil {
+		return nil
+	}
+	if _, err := c.f.WriteString(name + "\n"); err != nil {
+		return errors.Wrap(err, "cannot update checkpoint")
+	}
+	return c.f.Sync()
+}
+
+// Close closes the checkpoint file
+func (c *Checkpoint) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
@@ -0,0 +1,132 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tempPrefix marks replacements being written, which are not objects
+const tempPrefix = ".tinkproxy-"
+
+// dirStore keeps objects as the files of a directory tree
+type dirStore struct {
+	root string
+}
+
+func newDirStore(root string) (*dirStore, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "check the specified directory")
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", root)
+	}
+	return &dirStore{root: root}, nil
+}
+
+func (s *dirStore) ObjectName(name string) (string, string) {
+	return "", name
+}
+
+func (s *dirStore) String() string {
+	return s.root
+}
+
+// List walks the directory tree.  Names use / as separator, as in a bucket.
+func (s *dirStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			return nil
+		}
+		name, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list %s", s.root)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *dirStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+// Replace writes a temporary file next to the object, renamed over it on Close
+func (s *dirStore) Replace(ctx context.Context, name string) (Replacement, error) {
+	path := s.path(name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create replacement")
+	}
+	if err := f.Chmod(fi.Mode().Perm()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &fileReplacement{File: f, path: path}, nil
+}
+
+func (s *dirStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+type fileReplacement struct {
+	*os.File
+	path string
+}
+
+func (r *fileReplacement) Close() error {
+	if err := r.File.Sync(); err != nil {
+		r.Abort()
+		return err
+	}
+	if err := r.File.Close(); err != nil {
+		os.Remove(r.File.Name())
+		return err
+	}
+	return os.Rename(r.File.Name(), r.path)
+}
+
+func (r *fileReplacement) Abort() {
+	r.File.Close()
+	os.Remove(r.File.Name())
+}
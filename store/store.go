@@ -0,0 +1,69 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package store reads and replaces the encrypted objects kept in a local directory or under a bucket prefix, for the
+// commands which walk all of them.
+package store
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// Store holds encrypted objects
+type Store interface {
+	// List returns the names of all the objects, relative to the store
+	List(ctx context.Context) ([]string, error)
+	// Open reads an object
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Replace returns the writer of the new content of an object
+	Replace(ctx context.Context, name string) (Replacement, error)
+	// ObjectName returns the bucket and full object name of an object, with no bucket for a local directory
+	ObjectName(name string) (string, string)
+	// String returns the location of the store
+	String() string
+}
+
+// Replacement is the new content of an object.  Close commits it, while Abort discards it and leaves the object as it
+// was.
+type Replacement interface {
+	io.WriteCloser
+	Abort()
+}
+
+// Open returns the store at location, either gs://<bucket>[/<prefix>] or a local directory.  The client is only used
+// for buckets.
+func Open(location string, client *storage.Client) (Store, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return newDirStore(location)
+	}
+	if client == nil {
+		return nil, errors.Errorf("no storage client for %s", location)
+	}
+	path := strings.TrimPrefix(location, "gs://")
+	bucket, prefix := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, prefix = path[:i], path[i+1:]
+	}
+	if bucket == "" {
+		return nil, errors.Errorf("no bucket in %s", location)
+	}
+	return newBucketStore(client, bucket, prefix), nil
+}
@@ -0,0 +1,319 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.enc"), []byte("a"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.enc"), []byte("b"), 0640)
+
+	ctx := context.Background()
+	st, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := st.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.enc", "sub/b.enc"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("dirStore.List() = %v, want %v", names, want)
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		w, err := st.Replace(ctx, "a.enc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("discarded"))
+		w.Abort()
+		assertContent(t, filepath.Join(dir, "a.enc"), "a")
+		if names, _ := st.List(ctx); len(names) != 2 {
+			t.Errorf("dirStore.List() = %v after abort", names)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		w, err := st.Replace(ctx, "sub/b.enc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("replaced"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, filepath.Join(dir, "sub", "b.enc"), "replaced")
+		if fi, _ := os.Stat(filepath.Join(dir, "sub", "b.enc")); fi.Mode().Perm() != 0640 {
+			t.Errorf("dirStore.Replace() mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+		}
+	})
+}
+
+func TestBucketStore(t *testing.T) {
+	gcs := &fakeGCS{bucket: "archive", objects: map[string]*fakeObject{}}
+	server := httptest.NewTLSServer(gcs)
+	defer server.Close()
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx,
+		option.WithEndpoint(server.URL+"/storage/v1/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an object uploaded through the proxy, with a 5 byte envelope
+	gcs.objects["enc/a.enc"] = &fakeObject{
+		content:    []byte("envelciphertext"),
+		generation: 1,
+		metadata: map[string]string{
+			"tinkproxy-envelope-size": "5",
+			"tinkproxy-digest":        "sealed with the dek",
+			"owner":                   "finance",
+		},
+	}
+	st, err := Open("gs://archive/enc/", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := st.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.enc"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("bucketStore.List() = %v, want %v", names, want)
+	}
+
+	t.Run("rewrap", func(t *testing.T) {
+		r, err := st.Open(ctx, "a.enc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		w, err := st.Replace(ctx, "a.enc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a longer envelope ahead of the same ciphertext
+		w.Write([]byte("envelope ciphertext"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		o := gcs.object("enc/a.enc")
+		if string(o.content) != "envelope ciphertext" {
+			t.Errorf("bucketStore.Replace() content = %q", o.content)
+		}
+		// the listing of the proxy takes the size of the plaintext from the envelope size recorded, which a stale
+		// one gets wrong
+		if want := map[string]string{"owner": "finance"}; !reflect.DeepEqual(o.metadata, want) {
+			t.Errorf("bucketStore.Replace() metadata = %v, want %v", o.metadata, want)
+		}
+	})
+
+	t.Run("changed since opened", func(t *testing.T) {
+		r, err := st.Open(ctx, "a.enc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		gcs.object("enc/a.enc").generation++
+		w, err := st.Replace(ctx, "a.enc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("lost update"))
+		if err := w.Close(); err == nil {
+			t.Errorf("bucketStore.Replace() overwrote an object changed since it was opened")
+		}
+		if o := gcs.object("enc/a.enc"); string(o.content) != "envelope ciphertext" {
+			t.Errorf("bucketStore.Replace() content = %q after a failed upload", o.content)
+		}
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinkproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	c, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mark("a.enc"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	resumed, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if !resumed.Done("a.enc") || resumed.Done("b.enc") {
+		t.Errorf("Checkpoint.Done() did not resume from %s", path)
+	}
+}
+
+func assertContent(t *testing.T, path string, want string) {
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+}
+
+// fakeGCS serves the requests of the storage client for the objects of a bucket: listings, metadata, reads and
+// multipart uploads
+type fakeGCS struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+}
+
+type fakeObject struct {
+	content    []byte
+	generation int64
+	metadata   map[string]string
+}
+
+func (g *fakeGCS) object(name string) *fakeObject {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.objects[name]
+}
+
+func (g *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	objects := "/storage/v1/b/" + g.bucket + "/o"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == objects:
+		var items []interface{}
+		for name, o := range g.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				items = append(items, o.attrs(g.bucket, name))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#objects", "items": items})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, objects+"/"):
+		name := strings.TrimPrefix(r.URL.Path, objects+"/")
+		if o, ok := g.objects[name]; ok {
+			json.NewEncoder(w).Encode(o.attrs(g.bucket, name))
+			return
+		}
+		http.Error(w, "{}", http.StatusNotFound)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/"+g.bucket+"/"):
+		o, ok := g.objects[strings.TrimPrefix(r.URL.Path, "/"+g.bucket+"/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+		w.Header().Set("X-Goog-Metageneration", "1")
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.content)))
+		w.Write(o.content)
+	case r.Method == http.MethodPost && r.URL.Path == "/upload"+objects:
+		g.upload(w, r)
+	default:
+		http.Error(w, "{}", http.StatusNotImplemented)
+	}
+}
+
+func (g *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, "{}", http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var attrs struct {
+		Name     string            `json:"name"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&attrs)
+	}
+	if err == nil {
+		part, err = mr.NextPart()
+	}
+	if err != nil {
+		http.Error(w, "{}", http.StatusBadRequest)
+		return
+	}
+	content, err := ioutil.ReadAll(part)
+	if err != nil {
+		http.Error(w, "{}", http.StatusBadRequest)
+		return
+	}
+
+	o, ok := g.objects[attrs.Name]
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" {
+		if !ok || strconv.FormatInt(o.generation, 10) != match {
+			http.Error(w, "{}", http.StatusPreconditionFailed)
+			return
+		}
+	}
+	if !ok {
+		o = &fakeObject{}
+		g.objects[attrs.Name] = o
+	}
+	o.content, o.metadata = content, attrs.Metadata
+	o.generation++
+	json.NewEncoder(w).Encode(o.attrs(g.bucket, attrs.Name))
+}
+
+func (o *fakeObject) attrs(bucket string, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"bucket":         bucket,
+		"name":           name,
+		"size":           strconv.Itoa(len(o.content)),
+		"generation":     strconv.FormatInt(o.generation, 10),
+		"metageneration": "1",
+		"metadata":       o.metadata,
+	}
+}